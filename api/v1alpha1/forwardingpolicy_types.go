@@ -0,0 +1,89 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Protocol is a protocol forwards may use.
+// +kubebuilder:validation:Enum=tcp;udp;tcp_udp
+type Protocol string
+
+const (
+	ProtocolTCP    Protocol = "tcp"
+	ProtocolUDP    Protocol = "udp"
+	ProtocolTCPUDP Protocol = "tcp_udp"
+)
+
+// ForwardingPolicySpec defines which forwards the pods of the selected namespaces may publish.
+type ForwardingPolicySpec struct {
+	// NamespaceSelector selects the namespaces the policy applies to. An empty selector selects
+	// every namespace.
+	// +optional
+	NamespaceSelector metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// ExternalPorts are the external ports and port ranges, such as "443" or "30000-30999",
+	// pods may forward. Every port is allowed if empty.
+	// +optional
+	ExternalPorts []string `json:"externalPorts,omitempty"`
+
+	// Protocols are the protocols pods may forward. tcp_udp allows both tcp and udp. Every
+	// protocol is allowed if empty.
+	// +optional
+	Protocols []Protocol `json:"protocols,omitempty"`
+
+	// MaxForwardsPerNamespace limits the number of forwards of all pods in each selected
+	// namespace. IPv6 pinholes hold no gateway port and do not count. The earliest pods
+	// keep their forwards. Unlimited if unset.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxForwardsPerNamespace *int32 `json:"maxForwardsPerNamespace,omitempty"`
+
+	// RequireSourceRanges only allows forwards that are restricted to source ranges.
+	// +optional
+	RequireSourceRanges bool `json:"requireSourceRanges,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Ports",type=string,JSONPath=`.spec.externalPorts`
+// +kubebuilder:printcolumn:name="Max",type=integer,JSONPath=`.spec.maxForwardsPerNamespace`
+// +kubebuilder:printcolumn:name="Sources required",type=boolean,JSONPath=`.spec.requireSourceRanges`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ForwardingPolicy restricts the forwards pods may publish. Once any policy exists, the pods of
+// a namespace are only forwarded if a policy selecting the namespace allows all their forwards.
+type ForwardingPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ForwardingPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ForwardingPolicyList contains a list of ForwardingPolicy.
+type ForwardingPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ForwardingPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ForwardingPolicy{}, &ForwardingPolicyList{})
+}
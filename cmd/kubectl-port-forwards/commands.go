@@ -0,0 +1,483 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"atte.cloud/port-forward-controller/internal/config"
+	"atte.cloud/port-forward-controller/internal/controller"
+	"atte.cloud/port-forward-controller/internal/forwarding"
+)
+
+// podState is a controlled pod and its desired forwards.
+type podState struct {
+	pod     *corev1.Pod
+	desired controller.PodForwards
+}
+
+// orphan is a rule of the controller no pod owns.
+type orphan struct {
+	gateway string
+	rule    forwarding.PortForward
+}
+
+// survey is the state of the cluster and the gateways.
+type survey struct {
+	pods []podState
+	// rules holds the rules of every gateway that is not a mirror
+	rules map[string][]forwarding.PortForward
+	// owned holds the names of the rules owned by pods, by gateway
+	owned map[string]map[string]bool
+}
+
+func (p *plugin) survey(ctx context.Context) (*survey, error) {
+	var pods corev1.PodList
+	if err := p.kube.List(ctx, &pods); err != nil {
+		return nil, err
+	}
+
+	s := &survey{rules: map[string][]forwarding.PortForward{}, owned: map[string]map[string]bool{}}
+	own := func(gateway string, name string) {
+		for _, member := range p.members(gateway) {
+			if s.owned[member] == nil {
+				s.owned[member] = map[string]bool{}
+			}
+			s.owned[member][name] = true
+		}
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !p.pods.Controls(ctx, pod) {
+			continue
+		}
+		desired, err := p.pods.DesiredForwards(ctx, pod)
+		if err != nil {
+			return nil, err
+		}
+		s.pods = append(s.pods, podState{pod: pod, desired: desired})
+		own(desired.Gateway, desired.RuleName)
+		// The controller removes the rules from the previous gateway itself
+		if applied := pod.Annotations[controller.AppliedGatewayAnnotation]; applied != "" {
+			own(applied, desired.RuleName)
+		}
+	}
+
+	for _, backend := range p.cfg.Backends {
+		// The rules of mirrors are kept on their members
+		if backend.Type == config.BackendTypeMirror {
+			continue
+		}
+		rules, err := p.plans[backend.Name].ListAddresses(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("gateway %s: %w", backend.Name, err)
+		}
+		s.rules[backend.Name] = rules
+	}
+	return s, nil
+}
+
+// members returns the gateways holding the rules of the given gateway.
+func (p *plugin) members(gateway string) []string {
+	for _, backend := range p.cfg.Backends {
+		if backend.Name == gateway && backend.Type == config.BackendTypeMirror {
+			return backend.Mirror.Members
+		}
+	}
+	return []string{gateway}
+}
+
+// orphans returns the rules of the controller that no pod owns, ordered by gateway and name.
+func (p *plugin) orphans(s *survey) []orphan {
+	orphans := []orphan{}
+	for gateway, rules := range s.rules {
+		for _, rule := range rules {
+			if p.plans[gateway].Owns(rule.Name) && !s.owned[gateway][rule.Name] {
+				orphans = append(orphans, orphan{gateway: gateway, rule: rule})
+			}
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		if orphans[i].gateway != orphans[j].gateway {
+			return orphans[i].gateway < orphans[j].gateway
+		}
+		return orphans[i].rule.Name < orphans[j].rule.Name
+	})
+	return orphans
+}
+
+// forwardStatus is a desired forward and whether it is applied.
+type forwardStatus struct {
+	forward forwarding.PortForward
+	status  string
+}
+
+// status plans the forwards of the pod to find out which of them are applied.
+func (p *plugin) status(ctx context.Context, state podState) ([]forwardStatus, error) {
+	desired := state.desired
+	statuses := []forwardStatus{}
+	for _, conflict := range desired.Conflicts {
+		statuses = append(statuses, forwardStatus{conflict.Forward, "held by " + conflict.Holder})
+	}
+	if !state.pod.DeletionTimestamp.IsZero() {
+		for _, forward := range desired.Forwards {
+			statuses = append(statuses, forwardStatus{forward, "terminating"})
+		}
+		return statuses, nil
+	}
+
+	fwd := p.plans[desired.Gateway]
+	result, err := fwd.EnsureAddresses(ctx, desired.RuleName, desired.Forwards,
+		fwd.LegacyRuleName(state.pod.Namespace, state.pod.Name))
+	if err != nil {
+		return nil, err
+	}
+	for _, forward := range desired.Forwards {
+		// Pinholes are firewall rules, which the gateways do not list
+		if forward.IsPinhole() {
+			statuses = append(statuses, forwardStatus{forward, "pinhole"})
+			continue
+		}
+		status := "applied"
+		switch {
+		case containsTarget(result.Adopted, forward):
+			status = "adoptable"
+		case containsTarget(result.Created, forward):
+			status = "pending"
+		case containsTarget(result.Updated, forward):
+			status = "outdated"
+		}
+		for _, conflict := range result.Conflicts {
+			if conflict.Forward.SameTarget(forward) {
+				status = fmt.Sprintf("held by router rule %q", conflict.Holder)
+			}
+		}
+		statuses = append(statuses, forwardStatus{forward, status})
+	}
+	return statuses, nil
+}
+
+func (p *plugin) list(ctx context.Context, _ []string) error {
+	s, err := p.survey(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "POD\tGATEWAY\tRULE\tEXTERNAL\tTARGET\tSTATUS")
+	for _, state := range s.pods {
+		pod := client.ObjectKeyFromObject(state.pod)
+		desired := state.desired
+		if desired.Error != nil {
+			fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t%s: %v\n", pod, desired.Gateway, desired.RuleName, desired.Reason, desired.Error)
+			continue
+		}
+		for _, port := range desired.Unsupported {
+			fmt.Fprintf(w, "%s\t%s\t%s\t-\t%s:%d\tunsupported protocol %s\n",
+				pod, desired.Gateway, desired.RuleName, state.pod.Status.HostIP, port.HostPort, port.Protocol)
+		}
+		statuses, err := p.status(ctx, state)
+		if err != nil {
+			return fmt.Errorf("pod %s: %w", pod, err)
+		}
+		for _, status := range statuses {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				pod, desired.Gateway, desired.RuleName, status.forward, target(status.forward), status.status)
+		}
+	}
+	for _, orphan := range p.orphans(s) {
+		fmt.Fprintf(w, "<none>\t%s\t%s\t%s\t%s\torphaned\n",
+			orphan.gateway, orphan.rule.Name, orphan.rule, target(orphan.rule))
+	}
+	return w.Flush()
+}
+
+func (p *plugin) diff(ctx context.Context, _ []string) error {
+	s, err := p.survey(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, state := range s.pods {
+		desired := state.desired
+		fwd := p.plans[desired.Gateway]
+		legacy := fwd.LegacyRuleName(state.pod.Namespace, state.pod.Name)
+		var err error
+		switch {
+		case desired.Error != nil:
+			continue
+		case !state.pod.DeletionTimestamp.IsZero():
+			_, err = fwd.DeleteAddresses(ctx, desired.RuleName, legacy)
+		default:
+			_, err = fwd.EnsureAddresses(ctx, desired.RuleName, desired.Forwards, legacy)
+		}
+		if err != nil {
+			return fmt.Errorf("pod %s: %w", client.ObjectKeyFromObject(state.pod), err)
+		}
+	}
+	pruned := map[string]bool{}
+	for _, orphan := range p.orphans(s) {
+		if key := orphan.gateway + "/" + orphan.rule.Name; !pruned[key] {
+			pruned[key] = true
+			if _, err := p.plans[orphan.gateway].DeleteAddresses(ctx, orphan.rule.Name); err != nil {
+				return fmt.Errorf("gateway %s: %w", orphan.gateway, err)
+			}
+		}
+	}
+
+	plans := p.planner.Plans()
+	if len(plans) == 0 {
+		fmt.Fprintln(p.out, "No changes.")
+		return nil
+	}
+	for _, plan := range plans {
+		fmt.Fprintf(p.out, "--- gateway %s, rule %s\n", plan.Gateway, plan.Name)
+		for _, rule := range plan.Adopt {
+			fmt.Fprintf(p.out, "= %s -> %s adopted from %q\n", rule, target(rule), rule.Name)
+		}
+		for _, forward := range plan.Create {
+			fmt.Fprintf(p.out, "+ %s -> %s\n", forward, target(forward))
+		}
+		for _, update := range plan.Update {
+			fmt.Fprintf(p.out, "~ %s -> %s (was %s)\n", update.Desired, target(update.Desired), target(update.Existing))
+		}
+		for _, forward := range plan.Delete {
+			fmt.Fprintf(p.out, "- %s -> %s\n", forward, target(forward))
+		}
+		for _, conflict := range plan.Conflicts {
+			fmt.Fprintf(p.out, "! %s -> %s held by %q\n", conflict.Forward, target(conflict.Forward), conflict.Holder)
+		}
+	}
+	return nil
+}
+
+func (p *plugin) prune(ctx context.Context, _ []string) error {
+	s, err := p.survey(ctx)
+	if err != nil {
+		return err
+	}
+
+	orphans := p.orphans(s)
+	if len(orphans) == 0 {
+		fmt.Fprintln(p.out, "No orphaned rules.")
+		return nil
+	}
+	fmt.Fprintf(p.out, "%s these rules, which no pod owns:\n", p.verb("Deleting", "Would delete"))
+	for _, orphan := range orphans {
+		fmt.Fprintf(p.out, "  %s %s -> %s on gateway %s\n",
+			orphan.rule.Name, orphan.rule, target(orphan.rule), orphan.gateway)
+	}
+	if p.dryRun {
+		return nil
+	}
+	if !p.yes {
+		ok, err := p.confirm(fmt.Sprintf("Delete %d rules?", len(orphans)))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintln(p.out, "Nothing deleted.")
+			return nil
+		}
+	}
+
+	pruned := map[string]bool{}
+	for _, orphan := range orphans {
+		key := orphan.gateway + "/" + orphan.rule.Name
+		if pruned[key] {
+			continue
+		}
+		pruned[key] = true
+		deleted, err := p.pods.Gateways[orphan.gateway].DeleteAddresses(ctx, orphan.rule.Name)
+		if err != nil {
+			return fmt.Errorf("gateway %s: %w", orphan.gateway, err)
+		}
+		for _, forward := range deleted {
+			fmt.Fprintf(p.out, "Deleted rule %s %s -> %s from gateway %s\n",
+				forward.Name, forward, target(forward), orphan.gateway)
+		}
+	}
+	return nil
+}
+
+func (p *plugin) adopt(ctx context.Context, args []string) error {
+	pod, err := p.pod(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	desired, err := p.pods.DesiredForwards(ctx, pod)
+	if err != nil {
+		return err
+	}
+	if desired.Error != nil {
+		return fmt.Errorf("forwards of pod %s are not applied: %w", client.ObjectKeyFromObject(pod), desired.Error)
+	}
+	fwd := p.pods.Gateways[desired.Gateway]
+	rules, err := fwd.ListAddresses(ctx)
+	if err != nil {
+		return err
+	}
+
+	adopted := 0
+	for _, forward := range desired.Forwards {
+		for _, rule := range rules {
+			if fwd.Owns(rule.Name) || !rule.SameTarget(forward) {
+				continue
+			}
+			if err = fwd.Adopt(ctx, desired.RuleName, rule); err != nil {
+				return fmt.Errorf("unable to adopt rule %q: %w", rule.Name, err)
+			}
+			fmt.Fprintf(p.out, "%s rule %q %s -> %s as %s\n",
+				p.verb("Adopted", "Would adopt"), rule.Name, rule, target(rule), desired.RuleName)
+			adopted++
+			break
+		}
+	}
+	if adopted == 0 {
+		fmt.Fprintf(p.out, "No rules forward to the targets of pod %s.\n", client.ObjectKeyFromObject(pod))
+	}
+	return nil
+}
+
+func (p *plugin) disable(ctx context.Context, args []string) error {
+	pod, err := p.pod(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if err = p.pods.Disable(ctx, pod); err != nil {
+		return err
+	}
+	fmt.Fprintf(p.out, "%s forwarding for pod %s\n", p.verb("Disabled", "Would disable"), client.ObjectKeyFromObject(pod))
+	return nil
+}
+
+func (p *plugin) explain(ctx context.Context, args []string) error {
+	pod, err := p.pod(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "Pod:\t%s\n", client.ObjectKeyFromObject(pod))
+	if !p.pods.Controls(ctx, pod) {
+		fmt.Fprintf(w, "Forwarding:\tdisabled, set the annotation %s=true to enable it\n", controller.EnableAnnotation)
+		return nil
+	}
+	fmt.Fprintf(w, "Forwarding:\tenabled\n")
+	desired, err := p.pods.DesiredForwards(ctx, pod)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Gateway:\t%s\n", desired.Gateway)
+	fmt.Fprintf(w, "Rule name:\t%s\n", desired.RuleName)
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == controller.ForwardedCondition {
+			fmt.Fprintf(w, "Condition:\t%s %s: %s\n", condition.Status, condition.Reason, condition.Message)
+		}
+	}
+	if desired.Error != nil {
+		fmt.Fprintf(w, "Not applied:\t%s: %v\n", desired.Reason, desired.Error)
+		return nil
+	}
+	for _, port := range desired.Unsupported {
+		fmt.Fprintf(w, "Skipped:\thostPort %d uses protocol %s, which cannot be forwarded\n", port.HostPort, port.Protocol)
+	}
+
+	state := podState{pod: pod, desired: desired}
+	statuses, err := p.status(ctx, state)
+	if err != nil {
+		return err
+	}
+	if len(statuses) == 0 {
+		fmt.Fprintf(w, "Forwards:\tnone, the pod has no hostPorts or its external ports are not assigned yet\n")
+		return nil
+	}
+	fmt.Fprintf(w, "Forwards:\n")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "  %s -> %s\t%s\n", status.forward, target(status.forward), status.status)
+	}
+
+	fwd := p.plans[desired.Gateway]
+	rules, err := fwd.ListAddresses(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Rules on the gateway:\n")
+	for _, rule := range rules {
+		switch {
+		case rule.Name == desired.RuleName:
+			fmt.Fprintf(w, "  %s -> %s\towned, interface %s\n", rule, target(rule), rule.Interface)
+		case !fwd.Owns(rule.Name) && containsTarget(desired.Forwards, rule):
+			fmt.Fprintf(w, "  %s -> %s\tmade by hand as %q, see adopt\n", rule, target(rule), rule.Name)
+		}
+	}
+	return nil
+}
+
+// pod returns the pod of the given name in the namespace of the plugin.
+func (p *plugin) pod(ctx context.Context, name string) (*corev1.Pod, error) {
+	var pod corev1.Pod
+	if err := p.kube.Get(ctx, types.NamespacedName{Namespace: p.namespace, Name: name}, &pod); err != nil {
+		return nil, err
+	}
+	return &pod, nil
+}
+
+// confirm asks a yes or no question and reports whether the answer was yes.
+func (p *plugin) confirm(question string) (bool, error) {
+	fmt.Fprintf(p.out, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(p.in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// verb picks the wording of changes depending on the dry run mode.
+func (p *plugin) verb(done string, planned string) string {
+	if p.dryRun {
+		return planned
+	}
+	return done
+}
+
+func target(forward forwarding.PortForward) string {
+	return net.JoinHostPort(forward.Address, fmt.Sprint(forward.Port))
+}
+
+func containsTarget(forwards []forwarding.PortForward, forward forwarding.PortForward) bool {
+	for _, other := range forwards {
+		if other.SameTarget(forward) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	forwardingv1alpha1 "atte.cloud/port-forward-controller/api/v1alpha1"
+	"atte.cloud/port-forward-controller/internal/config"
+	"atte.cloud/port-forward-controller/internal/controller"
+	"atte.cloud/port-forward-controller/internal/forwarding"
+)
+
+var _ = Describe("Plugin", func() {
+	var (
+		ctx     context.Context
+		cfg     *config.Config
+		backend *forwarding.FakeClient
+		out     bytes.Buffer
+	)
+
+	rule := func(name string, port int32) forwarding.PortForward {
+		return forwarding.PortForward{Name: name, Address: "10.0.0.1", Port: port, ExternalPort: port, Protocol: "tcp"}
+	}
+	orphaned := rule("k8s-default-gone", 8080)
+	manual := rule("minecraft", 25565)
+
+	// newPlugin builds the plugin for a cluster holding a pod forwarding hostPort 25565, which
+	// answers prompts with input.
+	newPlugin := func(opts options, input string) *plugin {
+		scheme := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(forwardingv1alpha1.AddToScheme(scheme)).To(Succeed())
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "game", Namespace: "default", Annotations: map[string]string{
+				controller.EnableAnnotation: "true",
+			}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{
+				Name:  "game",
+				Ports: []corev1.ContainerPort{{ContainerPort: 25565, HostPort: 25565, Protocol: corev1.ProtocolTCP}},
+			}}},
+			Status: corev1.PodStatus{HostIP: "10.0.0.1"},
+		}
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+		kube := fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace, pod).Build()
+		clients := map[string]forwarding.Client{"home": backend}
+		return buildPlugin(strings.NewReader(input), &out, opts, "default", kube, scheme, cfg, clients)
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		out.Reset()
+		var err error
+		cfg, err = config.Parse([]byte(`
+backends:
+- name: home
+  unifi:
+    baseURL: https://unifi.local
+`), func(string) (string, bool) { return "", false })
+		Expect(err).NotTo(HaveOccurred())
+		backend = forwarding.NewFakeClient(orphaned, manual)
+	})
+
+	Describe("prune", func() {
+		It("should list the orphaned rules and keep them unless confirmed", func() {
+			Expect(newPlugin(options{}, "n\n").prune(ctx, nil)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("k8s-default-gone"))
+			Expect(out.String()).NotTo(ContainSubstring("minecraft"))
+			Expect(out.String()).To(ContainSubstring("Delete 1 rules? [y/N]"))
+			Expect(backend.Forwards()).To(ConsistOf(orphaned, manual))
+
+			Expect(newPlugin(options{}, "").prune(ctx, nil)).To(Succeed())
+			Expect(backend.Forwards()).To(ConsistOf(orphaned, manual))
+		})
+
+		It("should delete the orphaned rules once confirmed", func() {
+			Expect(newPlugin(options{}, "y\n").prune(ctx, nil)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("Deleted rule k8s-default-gone"))
+			Expect(backend.Forwards()).To(ConsistOf(manual))
+		})
+
+		It("should not ask with --yes", func() {
+			Expect(newPlugin(options{yes: true}, "").prune(ctx, nil)).To(Succeed())
+			Expect(out.String()).NotTo(ContainSubstring("[y/N]"))
+			Expect(backend.Forwards()).To(ConsistOf(manual))
+		})
+
+		It("should only list the rules with --dry-run", func() {
+			Expect(newPlugin(options{dryRun: true, yes: true}, "").prune(ctx, nil)).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("Would delete these rules"))
+			Expect(backend.Forwards()).To(ConsistOf(orphaned, manual))
+		})
+	})
+
+	Describe("adopt", func() {
+		It("should hand rules made by hand over to the pod", func() {
+			Expect(newPlugin(options{}, "").adopt(ctx, []string{"game"})).To(Succeed())
+			Expect(out.String()).To(ContainSubstring(`Adopted rule "minecraft"`))
+			adopted := manual
+			adopted.Name = "k8s-default-game"
+			Expect(backend.Forwards()).To(ConsistOf(orphaned, adopted))
+		})
+	})
+})
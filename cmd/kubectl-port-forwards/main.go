@@ -0,0 +1,440 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-port-forwards is a kubectl plugin to inspect and manage the forwards of the controller.
+// It builds the desired state from the cluster the same way the controller does and compares it
+// with the rules on the gateways.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/utils/ptr"
+
+	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	forwardingv1alpha1 "atte.cloud/port-forward-controller/api/v1alpha1"
+	"atte.cloud/port-forward-controller/internal/config"
+	"atte.cloud/port-forward-controller/internal/controller"
+	"atte.cloud/port-forward-controller/internal/forwarding"
+)
+
+const usage = `Inspect and manage the forwards of the port-forward-controller.
+
+Usage:
+  kubectl port-forwards [flags] [command] [args]
+
+Commands:
+  list           List the forwards of all pods and whether they are applied (default)
+  diff           Show the changes the controller would make to the gateways
+  prune          Remove rules of the controller that no pod owns anymore, after confirmation
+  adopt <pod>    Hand rules made by hand over to the pod forwarding to the same target
+  disable <pod>  Opt the pod out of forwarding and remove its forwards
+  explain <pod>  Explain why the forwards of a pod are or are not applied
+
+The configuration of the controller is read from its ConfigMap, with the overrides set in the
+environment of its Deployment, unless --config is given. Credentials are read from the Secrets
+it references.
+
+Flags:
+`
+
+// options holds the flags shared by all commands.
+type options struct {
+	kubeconfig          string
+	context             string
+	namespace           string
+	controllerNamespace string
+	configMap           string
+	deployment          string
+	configPath          string
+	dryRun              bool
+	yes                 bool
+}
+
+func main() {
+	var opts options
+	fs := flag.NewFlagSet("kubectl-port-forwards", flag.ExitOnError)
+	fs.StringVar(&opts.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file.")
+	fs.StringVar(&opts.context, "context", "", "The kubeconfig context to use.")
+	fs.StringVar(&opts.namespace, "namespace", "", "The namespace of the pod, defaults to the namespace of the context.")
+	fs.StringVar(&opts.namespace, "n", "", "Shorthand for --namespace.")
+	fs.StringVar(&opts.controllerNamespace, "controller-namespace", "port-forward-controller-system",
+		"The namespace the controller runs in.")
+	fs.StringVar(&opts.configMap, "config-map", "port-forward-controller-controller-config",
+		"The ConfigMap holding the configuration of the controller.")
+	fs.StringVar(&opts.deployment, "controller-deployment", "port-forward-controller-controller-manager",
+		"The Deployment of the controller, whose environment overrides the configuration.")
+	fs.StringVar(&opts.configPath, "config", "",
+		"Read the configuration of the controller from this file instead, without environment overrides.")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "Only print what prune, adopt and disable would change.")
+	fs.BoolVar(&opts.yes, "yes", false, "Prune without asking for confirmation.")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+
+	// Flags may come before and after the command
+	_ = fs.Parse(os.Args[1:])
+	command := "list"
+	args := fs.Args()
+	if len(args) > 0 {
+		command = args[0]
+		_ = fs.Parse(args[1:])
+		args = fs.Args()
+	}
+
+	if err := run(context.Background(), os.Stdin, os.Stdout, opts, command, args); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, in io.Reader, out io.Writer, opts options, command string, args []string) error {
+	commands := map[string]struct {
+		args int
+		run  func(p *plugin, ctx context.Context, args []string) error
+	}{
+		"list":    {0, (*plugin).list},
+		"diff":    {0, (*plugin).diff},
+		"prune":   {0, (*plugin).prune},
+		"adopt":   {1, (*plugin).adopt},
+		"disable": {1, (*plugin).disable},
+		"explain": {1, (*plugin).explain},
+	}
+	cmd, ok := commands[command]
+	if !ok {
+		return fmt.Errorf("unknown command %q, see --help", command)
+	}
+	if len(args) != cmd.args {
+		return fmt.Errorf("%s takes %d arguments, got %d", command, cmd.args, len(args))
+	}
+
+	p, err := newPlugin(ctx, in, out, opts)
+	if err != nil {
+		return err
+	}
+	return cmd.run(p, ctx, args)
+}
+
+// plugin holds what the commands share: the cluster, the configuration of the controller and
+// the gateways built from it.
+type plugin struct {
+	in        io.Reader
+	out       io.Writer
+	namespace string
+	dryRun    bool
+	yes       bool
+	kube      client.Client
+	cfg       *config.Config
+	// pods computes the desired state and changes pods and gateways. It works on plans in dry run
+	// mode.
+	pods *controller.PodReconciler
+	// plans never changes the gateways and records the changes it would make in planner
+	plans   map[string]*forwarding.ForwardingReconciler
+	planner *forwarding.Planner
+}
+
+func newPlugin(ctx context.Context, in io.Reader, out io.Writer, opts options) (*plugin, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = opts.kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules,
+		&clientcmd.ConfigOverrides{CurrentContext: opts.context})
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	namespace := opts.namespace
+	if namespace == "" {
+		if namespace, _, err = clientConfig.Namespace(); err != nil {
+			return nil, err
+		}
+	}
+
+	scheme := runtime.NewScheme()
+	if err = clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	if err = forwardingv1alpha1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	kube, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := loadConfig(ctx, kube, opts)
+	if err != nil {
+		return nil, err
+	}
+	clients := map[string]forwarding.Client{}
+	for _, backend := range cfg.Backends {
+		if backend.Type == config.BackendTypeMirror {
+			continue
+		}
+		var secret corev1.Secret
+		if ref := backend.UniFi.CredentialsSecret; ref != nil {
+			key := types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}
+			if err = kube.Get(ctx, key, &secret); err != nil {
+				return nil, fmt.Errorf("unable to read the credentials of gateway %s: %w", backend.Name, err)
+			}
+		}
+		if clients[backend.Name], err = cfg.NewClient(backend, secret.Data); err != nil {
+			return nil, fmt.Errorf("gateway %s: %w", backend.Name, err)
+		}
+	}
+	return buildPlugin(in, out, opts, namespace, kube, scheme, cfg, clients), nil
+}
+
+// buildPlugin wires the plugin up from the cluster, the configuration of the controller and the
+// clients of its gateways.
+func buildPlugin(in io.Reader, out io.Writer, opts options, namespace string, kube client.Client,
+	scheme *runtime.Scheme, cfg *config.Config, clients map[string]forwarding.Client) *plugin {
+	p := &plugin{
+		in:        in,
+		out:       out,
+		namespace: namespace,
+		dryRun:    opts.dryRun,
+		yes:       opts.yes,
+		kube:      kube,
+		cfg:       cfg,
+		plans:     cfg.Gateways(clients),
+		planner:   forwarding.NewPlanner(),
+	}
+	for _, gateway := range p.plans {
+		gateway.DryRun = true
+		gateway.Plans = p.planner
+	}
+
+	gateways := cfg.Gateways(clients)
+	var podClient client.Client = &namespaceCache{Client: kube, namespaces: map[string]*corev1.Namespace{}}
+	if opts.dryRun {
+		gateways = p.plans
+		podClient = client.NewDryRunClient(podClient)
+	}
+	// Validated by config.Parse
+	portRange, _ := forwarding.ParsePortRange(cfg.Policies.ExternalPortRange)
+	podSelector, _ := cfg.PodSelector()
+	p.pods = &controller.PodReconciler{
+		Client:        podClient,
+		Scheme:        scheme,
+		Recorder:      printRecorder{out: out},
+		Fwd:           gateways[cfg.DefaultBackend],
+		Gateways:      gateways,
+		PortRange:     portRange,
+		ReservedPorts: cfg.ReservedPorts(),
+		PodSelector:   podSelector,
+		Protocol:      cfg.Defaults.Protocol,
+	}
+	return p
+}
+
+// loadConfig reads the configuration of the controller from its ConfigMap and applies the
+// overrides set in the environment of its Deployment, such as FORWARDING_PREFIX, so that rules
+// are told apart exactly like the controller does. A file given with --config is taken as is;
+// only the namespace of the controller is filled in.
+func loadConfig(ctx context.Context, kube client.Client, opts options) (*config.Config, error) {
+	var data []byte
+	source := opts.configPath
+	env := map[string]envVar{"POD_NAMESPACE": {value: opts.controllerNamespace}}
+	if opts.configPath != "" {
+		var err error
+		if data, err = os.ReadFile(opts.configPath); err != nil {
+			return nil, err
+		}
+	} else {
+		var configMap corev1.ConfigMap
+		key := types.NamespacedName{Namespace: opts.controllerNamespace, Name: opts.configMap}
+		if err := kube.Get(ctx, key, &configMap); err != nil {
+			return nil, fmt.Errorf("unable to read the configuration of the controller: %w", err)
+		}
+		data = []byte(configMap.Data["config.yaml"])
+		source = "configmap " + key.String()
+		overrides, err := controllerEnv(ctx, kube, opts)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(env, overrides)
+	}
+
+	var errs []error
+	cfg, err := config.Parse(data, func(name string) (string, bool) {
+		variable, ok := env[name]
+		if variable.err != nil {
+			errs = append(errs, fmt.Errorf("unable to resolve %s of the controller: %w", name, variable.err))
+		}
+		return variable.value, ok
+	})
+	if err = errors.Join(append(errs, err)...); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	return cfg, nil
+}
+
+// envVar is a variable of the environment of the controller, or why its value is unknown.
+type envVar struct {
+	value string
+	err   error
+}
+
+// controllerEnv returns the environment of the manager container of the controller Deployment.
+// Variables are resolved from the ConfigMaps and Secrets they reference; those the plugin cannot
+// resolve only fail the configuration if it reads them.
+func controllerEnv(ctx context.Context, kube client.Client, opts options) (map[string]envVar, error) {
+	var deployment appsv1.Deployment
+	key := types.NamespacedName{Namespace: opts.controllerNamespace, Name: opts.deployment}
+	if err := kube.Get(ctx, key, &deployment); err != nil {
+		return nil, fmt.Errorf("unable to read the environment of the controller: %w", err)
+	}
+	containers := deployment.Spec.Template.Spec.Containers
+	i := slices.IndexFunc(containers, func(container corev1.Container) bool { return container.Name == "manager" })
+	if i < 0 {
+		return nil, fmt.Errorf("deployment %s has no manager container", key)
+	}
+
+	env := map[string]envVar{}
+	for _, source := range containers[i].EnvFrom {
+		data, err := envSource(ctx, kube, opts.controllerNamespace, source)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the environment of the controller: %w", err)
+		}
+		for name, value := range data {
+			env[source.Prefix+name] = envVar{value: value}
+		}
+	}
+	for _, variable := range containers[i].Env {
+		value, err := envValue(ctx, kube, opts.controllerNamespace, variable)
+		env[variable.Name] = envVar{value: value, err: err}
+	}
+	return env, nil
+}
+
+// envSource returns the variables of a ConfigMap or Secret the container takes as a whole.
+func envSource(ctx context.Context, kube client.Client, namespace string, source corev1.EnvFromSource) (map[string]string, error) {
+	data := map[string]string{}
+	var err error
+	switch {
+	case source.ConfigMapRef != nil:
+		var configMap corev1.ConfigMap
+		err = kube.Get(ctx, types.NamespacedName{Namespace: namespace, Name: source.ConfigMapRef.Name}, &configMap)
+		maps.Copy(data, configMap.Data)
+		if apierrors.IsNotFound(err) && ptr.Deref(source.ConfigMapRef.Optional, false) {
+			err = nil
+		}
+	case source.SecretRef != nil:
+		var secret corev1.Secret
+		err = kube.Get(ctx, types.NamespacedName{Namespace: namespace, Name: source.SecretRef.Name}, &secret)
+		for name, value := range secret.Data {
+			data[name] = string(value)
+		}
+		if apierrors.IsNotFound(err) && ptr.Deref(source.SecretRef.Optional, false) {
+			err = nil
+		}
+	}
+	return data, err
+}
+
+// envValue resolves the value of a variable like the kubelet does for the controller.
+func envValue(ctx context.Context, kube client.Client, namespace string, variable corev1.EnvVar) (string, error) {
+	from := variable.ValueFrom
+	switch {
+	case from == nil:
+		return variable.Value, nil
+	case from.FieldRef != nil && from.FieldRef.FieldPath == "metadata.namespace":
+		return namespace, nil
+	case from.ConfigMapKeyRef != nil:
+		var configMap corev1.ConfigMap
+		ref := from.ConfigMapKeyRef
+		if err := kube.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, &configMap); err != nil {
+			return "", err
+		}
+		value, ok := configMap.Data[ref.Key]
+		if !ok {
+			return "", fmt.Errorf("configmap %s has no key %s", ref.Name, ref.Key)
+		}
+		return value, nil
+	case from.SecretKeyRef != nil:
+		var secret corev1.Secret
+		ref := from.SecretKeyRef
+		if err := kube.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, &secret); err != nil {
+			return "", err
+		}
+		value, ok := secret.Data[ref.Key]
+		if !ok {
+			return "", fmt.Errorf("secret %s has no key %s", ref.Name, ref.Key)
+		}
+		return string(value), nil
+	}
+	return "", errors.New("its value is only known to the pod")
+}
+
+// namespaceCache remembers the namespaces it read. The controller logic looks up the namespace of
+// every pod it considers, which the controller serves from its cache.
+type namespaceCache struct {
+	client.Client
+	namespaces map[string]*corev1.Namespace
+}
+
+func (c *namespaceCache) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	namespace, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return c.Client.Get(ctx, key, obj, opts...)
+	}
+	if cached, ok := c.namespaces[key.Name]; ok {
+		cached.DeepCopyInto(namespace)
+		return nil
+	}
+	if err := c.Client.Get(ctx, key, namespace, opts...); err != nil {
+		return err
+	}
+	c.namespaces[key.Name] = namespace.DeepCopy()
+	return nil
+}
+
+// printRecorder prints the events the controller logic records, so that the user sees what was
+// changed.
+type printRecorder struct {
+	out io.Writer
+}
+
+func (r printRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	fmt.Fprintf(r.out, "%s: %s\n", reason, message)
+}
+
+func (r printRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r printRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason,
+	messageFmt string, args ...interface{}) {
+	r.Eventf(object, eventtype, reason, messageFmt, args...)
+}
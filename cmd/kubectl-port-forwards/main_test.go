@@ -0,0 +1,93 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("loadConfig", func() {
+	const namespace = "port-forward-controller-system"
+	opts := options{
+		controllerNamespace: namespace,
+		configMap:           "controller-config",
+		deployment:          "controller-manager",
+	}
+
+	// newKube returns a cluster running the controller with the given environment.
+	newKube := func(env ...corev1.EnvVar) client.Client {
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "controller-config", Namespace: namespace},
+			Data: map[string]string{"config.yaml": `
+backends:
+- name: home
+  unifi:
+    baseURL: https://unifi.local
+    credentialsSecret:
+      name: unifi
+`},
+		}
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "controller-manager", Namespace: namespace},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "manager", Env: env}},
+			}}},
+		}
+		overrides := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "overrides", Namespace: namespace},
+			Data:       map[string][]byte{"range": []byte("30000-30999")},
+		}
+		return fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).
+			WithObjects(configMap, deployment, overrides).Build()
+	}
+
+	It("should apply the overrides in the environment of the controller", func() {
+		kube := newKube(
+			corev1.EnvVar{Name: "POD_NAMESPACE", ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+			}},
+			corev1.EnvVar{Name: "FORWARDING_PREFIX", Value: "cluster-"},
+			corev1.EnvVar{Name: "EXTERNAL_PORT_RANGE", ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "overrides"}, Key: "range",
+				},
+			}},
+		)
+		cfg, err := loadConfig(context.Background(), kube, opts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Naming.Prefix).To(Equal("cluster-"))
+		Expect(cfg.Policies.ExternalPortRange).To(Equal("30000-30999"))
+		Expect(cfg.Backends[0].UniFi.CredentialsSecret.Namespace).To(Equal(namespace))
+	})
+
+	It("should refuse overrides it cannot resolve", func() {
+		kube := newKube(corev1.EnvVar{Name: "FORWARDING_PREFIX", ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+		}})
+		_, err := loadConfig(context.Background(), kube, opts)
+		Expect(err).To(MatchError(ContainSubstring("unable to resolve FORWARDING_PREFIX")))
+	})
+})
@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"os"
@@ -26,18 +27,28 @@ import (
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	forwardingv1alpha1 "atte.cloud/port-forward-controller/api/v1alpha1"
+	"atte.cloud/port-forward-controller/internal/config"
 	"atte.cloud/port-forward-controller/internal/controller"
 	"atte.cloud/port-forward-controller/internal/forwarding"
+	webhookv1 "atte.cloud/port-forward-controller/internal/webhook/v1"
+	webhookv1alpha1 "atte.cloud/port-forward-controller/internal/webhook/v1alpha1"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -49,6 +60,7 @@ var (
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
+	utilruntime.Must(forwardingv1alpha1.AddToScheme(scheme))
 	// +kubebuilder:scaffold:scheme
 }
 
@@ -56,10 +68,13 @@ func init() {
 func main() {
 	var metricsAddr string
 	var metricsCertPath, metricsCertName, metricsCertKey string
+	var webhookCertPath, webhookCertName, webhookCertKey string
 	var enableLeaderElection bool
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var configPath string
+	var dryRun bool
 	var tlsOpts []func(*tls.Config)
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
 		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
@@ -69,12 +84,21 @@ func main() {
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.BoolVar(&secureMetrics, "metrics-secure", true,
 		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
+	flag.StringVar(&webhookCertPath, "webhook-cert-path", "", "The directory that contains the webhook certificate.")
+	flag.StringVar(&webhookCertName, "webhook-cert-name", "tls.crt", "The name of the webhook certificate file.")
+	flag.StringVar(&webhookCertKey, "webhook-cert-key", "tls.key", "The name of the webhook key file.")
 	flag.StringVar(&metricsCertPath, "metrics-cert-path", "",
 		"The directory that contains the metrics server certificate.")
 	flag.StringVar(&metricsCertName, "metrics-cert-name", "tls.crt", "The name of the metrics server certificate file.")
 	flag.StringVar(&metricsCertKey, "metrics-cert-key", "tls.key", "The name of the metrics server key file.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&configPath, "config", "",
+		"The path of the controller configuration file. The UNIFI_* environment variables, "+
+			"FORWARDING_PREFIX and EXTERNAL_PORT_RANGE override the values in it.")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"If set, changes to the gateways are only planned, never made. Plans are logged, reported as "+
+			"pod events and served as JSON on /debug/plan of the metrics endpoint, if enabled.")
 
 	opts := zap.Options{
 		Development: true,
@@ -100,7 +124,33 @@ func main() {
 	}
 
 	// Create watchers for metrics and webhooks certificates
-	var metricsCertWatcher *certwatcher.CertWatcher
+	var metricsCertWatcher, webhookCertWatcher *certwatcher.CertWatcher
+
+	// Initial webhook TLS options
+	webhookTLSOpts := tlsOpts
+
+	if len(webhookCertPath) > 0 {
+		setupLog.Info("Initializing webhook certificate watcher using provided certificates",
+			"webhook-cert-path", webhookCertPath, "webhook-cert-name", webhookCertName, "webhook-cert-key", webhookCertKey)
+
+		var err error
+		webhookCertWatcher, err = certwatcher.New(
+			filepath.Join(webhookCertPath, webhookCertName),
+			filepath.Join(webhookCertPath, webhookCertKey),
+		)
+		if err != nil {
+			setupLog.Error(err, "Failed to initialize webhook certificate watcher")
+			os.Exit(1)
+		}
+
+		webhookTLSOpts = append(webhookTLSOpts, func(config *tls.Config) {
+			config.GetCertificate = webhookCertWatcher.GetCertificate
+		})
+	}
+
+	webhookServer := webhook.NewServer(webhook.Options{
+		TLSOpts: webhookTLSOpts,
+	})
 
 	// Metrics endpoint is enabled in 'config/default/kustomization.yaml'. The Metrics options configure the server.
 	// More info:
@@ -147,9 +197,20 @@ func main() {
 		})
 	}
 
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		setupLog.Error(err, "unable to load configuration", "config", configPath)
+		os.Exit(1)
+	}
+	// Validated by config.Load
+	portRange, _ := forwarding.ParsePortRange(cfg.Policies.ExternalPortRange)
+	podSelector, _ := cfg.PodSelector()
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
+		Cache:                  secretCacheOptions(cfg),
 		Metrics:                metricsServerOptions,
+		WebhookServer:          webhookServer,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "47696f69.atte.cloud",
@@ -170,30 +231,73 @@ func main() {
 		os.Exit(1)
 	}
 
-	unifiClient, err := forwarding.NewUnifiClient(
-		os.Getenv("UNIFI_SITE"),
-		os.Getenv("UNIFI_BASEURL"),
-		os.Getenv("UNIFI_USER"),
-		os.Getenv("UNIFI_PASS"),
-		os.Getenv("UNIFI_INSECURE") == "true",
-	)
-	if err != nil {
-		setupLog.Error(err, "Failed to create Unifi API client")
-		os.Exit(1)
+	clients := map[string]forwarding.Client{}
+	for _, backend := range cfg.Backends {
+		if backend.Type == config.BackendTypeMirror {
+			continue
+		}
+		gatewayClient, err := setupGateway(mgr, cfg, backend)
+		if err != nil {
+			setupLog.Error(err, "unable to set up gateway", "gateway", backend.Name)
+			os.Exit(1)
+		}
+		clients[backend.Name] = gatewayClient
 	}
-	if err = (&controller.PodReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-		Fwd: &forwarding.ForwardingReconciler{
-			RulePrefix: os.Getenv("FORWARDING_PREFIX"),
-			Client:     unifiClient,
-		},
-	}).SetupWithManager(mgr); err != nil {
+	gateways := cfg.Gateways(clients)
+	if dryRun {
+		setupLog.Info("dry run mode, gateways will not be changed")
+		planner := forwarding.NewPlanner()
+		for _, gateway := range gateways {
+			gateway.DryRun = true
+			gateway.Plans = planner
+		}
+		if err = mgr.AddMetricsServerExtraHandler("/debug/plan", planner); err != nil {
+			setupLog.Error(err, "unable to set up plan endpoint")
+			os.Exit(1)
+		}
+	}
+	fwd := gateways[cfg.DefaultBackend]
+	podReconciler := &controller.PodReconciler{
+		Client:                mgr.GetClient(),
+		Scheme:                mgr.GetScheme(),
+		Recorder:              mgr.GetEventRecorderFor("port-forward-controller"),
+		Fwd:                   fwd,
+		Gateways:              gateways,
+		PortRange:             portRange,
+		ReservedPorts:         cfg.ReservedPorts(),
+		PodSelector:           podSelector,
+		Protocol:              cfg.Defaults.Protocol,
+		ResyncInterval:        cfg.Resync.Interval.Duration,
+		ConflictRetryInterval: cfg.Resync.ConflictRetryInterval.Duration,
+	}
+	if err = podReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Pod")
 		os.Exit(1)
 	}
+	// nolint:goconst
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = webhookv1.SetupPodWebhookWithManager(mgr, podReconciler); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Pod")
+			os.Exit(1)
+		}
+	}
+	// nolint:goconst
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = webhookv1alpha1.SetupForwardingPolicyWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ForwardingPolicy")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
+	if webhookCertWatcher != nil {
+		setupLog.Info("Adding webhook certificate watcher to manager")
+		if err := mgr.Add(webhookCertWatcher); err != nil {
+			setupLog.Error(err, "unable to add webhook certificate watcher to manager")
+			os.Exit(1)
+		}
+	}
+
 	if metricsCertWatcher != nil {
 		setupLog.Info("Adding metrics certificate watcher to manager")
 		if err := mgr.Add(metricsCertWatcher); err != nil {
@@ -210,6 +314,13 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	// Only readiness depends on the backends; restarting the manager does not help an unreachable router
+	for name, gateway := range gateways {
+		if err := mgr.AddReadyzCheck("backend-"+name, gateway.Healthz); err != nil {
+			setupLog.Error(err, "unable to set up ready check")
+			os.Exit(1)
+		}
+	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
@@ -217,3 +328,78 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// secretCacheOptions limits the cache of Secrets to the credential Secrets of the backends; the
+// controller has no business with any other.
+func secretCacheOptions(cfg *config.Config) cache.Options {
+	names := map[string][]string{}
+	for _, backend := range cfg.Backends {
+		if backend.UniFi == nil {
+			continue
+		}
+		if ref := backend.UniFi.CredentialsSecret; ref != nil {
+			names[ref.Namespace] = append(names[ref.Namespace], ref.Name)
+		}
+	}
+	if len(names) == 0 {
+		return cache.Options{}
+	}
+
+	namespaces := map[string]cache.Config{}
+	for namespace, secrets := range names {
+		// Field selectors cannot match one of several names, so cache the whole namespace then
+		namespaces[namespace] = cache.Config{}
+		if len(secrets) == 1 {
+			namespaces[namespace] = cache.Config{FieldSelector: fields.OneTermEqualSelector("metadata.name", secrets[0])}
+		}
+	}
+	return cache.Options{
+		ByObject: map[client.Object]cache.ByObject{
+			&corev1.Secret{}: {Namespaces: namespaces},
+		},
+	}
+}
+
+// setupGateway creates the client of a backend and, if its credentials are kept in a Secret, the
+// controller reloading them.
+func setupGateway(mgr ctrl.Manager, cfg *config.Config, backend config.Backend) (forwarding.Client, error) {
+	newClient := func(secret map[string][]byte) (forwarding.Client, error) {
+		return cfg.NewClient(backend, secret)
+	}
+
+	ref := backend.UniFi.CredentialsSecret
+	var secretData map[string][]byte
+	if ref != nil {
+		// The cache is not running yet, so read the secret directly
+		var secret corev1.Secret
+		key := types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}
+		if err := mgr.GetAPIReader().Get(context.Background(), key, &secret); err != nil {
+			setupLog.Error(err, "unable to read credentials secret, waiting for it to appear",
+				"gateway", backend.Name, "secret", key)
+		}
+		secretData = secret.Data
+	}
+	unifiClient, err := newClient(secretData)
+	if err != nil {
+		return nil, err
+	}
+	if err = unifiClient.Health(context.Background()); err != nil {
+		// The client logs in again on every use, so carry on and report not ready until it succeeds
+		setupLog.Error(err, "Unifi API is unavailable, starting in degraded mode", "gateway", backend.Name)
+	}
+	backendClient := forwarding.NewSwappableClient(unifiClient)
+
+	if ref != nil {
+		if err = (&controller.CredentialsReconciler{
+			Client:    mgr.GetClient(),
+			Gateway:   backend.Name,
+			Secret:    types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name},
+			NewClient: newClient,
+			Target:    backendClient,
+		}).SetupWithManager(mgr); err != nil {
+			return nil, err
+		}
+	}
+
+	return backendClient, nil
+}
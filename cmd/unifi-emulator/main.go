@@ -0,0 +1,77 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// unifi-emulator serves the API of a UniFi Network controller from memory, for end-to-end tests
+// of the controller without a device. Credentials are read from the UNIFI_USER and UNIFI_PASS
+// environment variables unless given as flags.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"atte.cloud/port-forward-controller/internal/forwarding/unifitest"
+)
+
+func main() {
+	var addr, sites string
+	var opts unifitest.Options
+	flag.StringVar(&addr, "bind-address", ":8080", "The address the API is served on.")
+	flag.StringVar(&opts.Username, "username", os.Getenv("UNIFI_USER"), "The username accepted by the login endpoint.")
+	flag.StringVar(&opts.Password, "password", os.Getenv("UNIFI_PASS"), "The password accepted by the login endpoint.")
+	flag.StringVar(&opts.APIKey, "api-key", os.Getenv("UNIFI_API_KEY"), "An API key accepted instead of a session, if set.")
+	flag.StringVar(&sites, "sites", "default", "Comma separated names of the sites.")
+	flag.StringVar(&opts.WANAddress, "wan-address", "203.0.113.1", "The address reported for the WAN uplink.")
+	flag.DurationVar(&opts.SessionTTL, "session-ttl", 0, "How long logins are valid, 0 keeps them forever.")
+	flag.IntVar(&opts.RateLimit, "rate-limit", 0, "The number of requests served per second, 0 for no limit.")
+	flag.BoolVar(&opts.Legacy, "legacy", false, "Serve the API of a standalone controller instead of a UniFi OS console.")
+	flag.BoolVar(&opts.ZoneBasedFirewall, "zone-based-firewall", false, "Report the sites as using the zone based firewall.")
+	flag.Parse()
+	opts.Sites = strings.Split(sites, ",")
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           logRequests(unifitest.New(opts)),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("serving the UniFi API on %s", addr)
+	log.Fatal(server.ListenAndServe())
+}
+
+// statusRecorder remembers the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// logRequests logs every request with the status of its response, so that the calls of the
+// controller can be followed in the logs of the emulator.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		log.Printf("%s %s %d", r.Method, r.URL.Path, recorder.status)
+	})
+}
@@ -0,0 +1,533 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config loads the configuration file of the controller.
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"atte.cloud/port-forward-controller/internal/forwarding"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	APIVersion = "port-forward-controller.atte.cloud/v1alpha1"
+	Kind       = "ControllerConfig"
+)
+
+// Config is the configuration file of the controller.
+type Config struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// Backends are the gateways forwards are published on. Pods select one by name with the
+	// gateway annotation.
+	Backends []Backend `json:"backends"`
+	// DefaultBackend is used by pods that select no gateway; it defaults to the first backend
+	DefaultBackend string   `json:"defaultBackend,omitempty"`
+	Defaults       Defaults `json:"defaults,omitempty"`
+	Naming         Naming   `json:"naming,omitempty"`
+	Policies       Policies `json:"policies,omitempty"`
+	OptIn          OptIn    `json:"optIn,omitempty"`
+	Resync         Resync   `json:"resync,omitempty"`
+}
+
+// Backend describes a router.
+type Backend struct {
+	Name string `json:"name"`
+	// Type selects the implementation: "unifi", or "mirror" to publish every forward on several
+	// other backends
+	Type   string         `json:"type"`
+	UniFi  *UniFiBackend  `json:"unifi,omitempty"`
+	Mirror *MirrorBackend `json:"mirror,omitempty"`
+	// ManageFirewallRules creates an allow rule next to every forward, for gateways whose
+	// firewall drops forwarded traffic by default
+	ManageFirewallRules bool `json:"manageFirewallRules,omitempty"`
+	// ManagePinholes opens IPv6 pinholes to the global address of pods next to their IPv4
+	// forwards. Only unifi backends support pinholes.
+	ManagePinholes bool `json:"managePinholes,omitempty"`
+}
+
+// MirrorBackend publishes identical forwards on several backends, e.g. redundant edge routers.
+type MirrorBackend struct {
+	// Members name the backends forwards are mirrored to
+	Members []string `json:"members"`
+	// Policy decides when an operation succeeded: "all" members (the default), "any" member or
+	// a "quorum" of them
+	Policy string `json:"policy,omitempty"`
+}
+
+type UniFiBackend struct {
+	BaseURL  string `json:"baseURL"`
+	Site     string `json:"site,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Insecure disables verification of the certificate chain of the controller; prefer CAFile
+	// or PinnedPublicKeys for self-signed certificates
+	Insecure bool `json:"insecure,omitempty"`
+	// CAFile is a PEM bundle of the authorities trusted to sign the certificate of the controller
+	CAFile string `json:"caFile,omitempty"`
+	// PinnedPublicKeys are SHA-256 pins of the public key of the controller certificate, in the
+	// "sha256/<base64>" form. Without a CA, a matching certificate is trusted even if self-signed.
+	PinnedPublicKeys []string `json:"pinnedPublicKeys,omitempty"`
+	// CredentialsSecret references a Secret holding the credentials. Its keys take precedence
+	// over the fields above and are reloaded whenever the Secret changes.
+	CredentialsSecret *SecretReference `json:"credentialsSecret,omitempty"`
+}
+
+// SecretReference names a Secret. The namespace defaults to the namespace of the controller.
+type SecretReference struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Keys read from credential Secrets.
+const (
+	SecretKeyUsername = "username"
+	SecretKeyPassword = "password"
+	SecretKeyAPIKey   = "apiKey"
+	// The CA bundle in ca.crt takes precedence over caFile
+	SecretKeyCA = "ca.crt"
+	// The client certificate is read from the tls.crt and tls.key keys of kubernetes.io/tls Secrets
+	SecretKeyCertificate = "tls.crt"
+	SecretKeyPrivateKey  = "tls.key"
+)
+
+type Defaults struct {
+	// Protocol of the forwards: "container" to follow the protocol of the container port, or
+	// one of "tcp", "udp" and "tcp_udp" to use that protocol for every forward
+	Protocol string `json:"protocol,omitempty"`
+	// Interface is the WAN interface forwards are published on
+	Interface string `json:"interface,omitempty"`
+}
+
+type Naming struct {
+	// Prefix of every rule name; rules starting with it are considered owned by the controller.
+	// It defaults to DefaultPrefix and may not be empty.
+	Prefix string `json:"prefix,omitempty"`
+	// Template renders rule names from .Prefix, .Namespace and .Name
+	Template string `json:"template,omitempty"`
+}
+
+type Policies struct {
+	// ExternalPortRange is the range external ports are allocated from, e.g. "30000-30999"
+	ExternalPortRange string `json:"externalPortRange,omitempty"`
+	// ReservedExternalPorts are ports and ranges such as "22" or "8000-8099" that pods may not
+	// forward, e.g. because the gateway uses them itself. They are never allocated.
+	ReservedExternalPorts []string `json:"reservedExternalPorts,omitempty"`
+	// AdoptMatchingRules takes over rules made by hand that forward the external port of a pod to
+	// the same target, rather than reporting them as conflicts
+	AdoptMatchingRules bool `json:"adoptMatchingRules,omitempty"`
+}
+
+// OptIn selects pods that are forwarded without being annotated with enable=true, e.g. pods of
+// Helm charts that do not allow setting annotations. Only pods with hostPorts are selected, and
+// pods annotated with enable=false are never forwarded. Namespaces opt in all their pods with
+// the enable label or annotation.
+type OptIn struct {
+	// PodSelector opts in the pods whose labels match
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+}
+
+type Resync struct {
+	// Interval is how often controlled pods are reconciled again
+	Interval metav1.Duration `json:"interval,omitempty"`
+	// ConflictRetryInterval is how often pods with conflicting forwards are retried
+	ConflictRetryInterval metav1.Duration `json:"conflictRetryInterval,omitempty"`
+}
+
+const (
+	BackendTypeUniFi  = "unifi"
+	BackendTypeMirror = "mirror"
+
+	ProtocolContainer = "container"
+
+	DefaultPrefix       = "k8s-"
+	DefaultNameTemplate = "{{.Prefix}}{{.Namespace}}-{{.Name}}"
+)
+
+// Load reads the configuration file at path, applies the environment overrides, fills in
+// defaults and validates the result. An empty path loads the configuration from the
+// environment alone.
+func Load(path string) (*Config, error) {
+	var data []byte
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("unable to read configuration: %w", err)
+		}
+	}
+	cfg, err := Parse(data, os.LookupEnv)
+	if err != nil && path != "" {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, err
+}
+
+// Parse parses a configuration file, applies the overrides found by lookup, fills in defaults
+// and validates the result.
+func Parse(data []byte, lookup func(string) (string, bool)) (*Config, error) {
+	cfg := &Config{APIVersion: APIVersion, Kind: Kind}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse configuration: %w", err)
+	}
+
+	cfg.applyEnv(lookup)
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// applyEnv applies the environment variables used before the configuration file existed. They
+// take precedence over the file and configure the first backend.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) {
+	overrides := map[string]func(*UniFiBackend, string){
+		"UNIFI_BASEURL":  func(b *UniFiBackend, v string) { b.BaseURL = v },
+		"UNIFI_SITE":     func(b *UniFiBackend, v string) { b.Site = v },
+		"UNIFI_USER":     func(b *UniFiBackend, v string) { b.Username = v },
+		"UNIFI_PASS":     func(b *UniFiBackend, v string) { b.Password = v },
+		"UNIFI_INSECURE": func(b *UniFiBackend, v string) { b.Insecure = v == "true" },
+	}
+	for name, apply := range overrides {
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if len(c.Backends) == 0 {
+			c.Backends = append(c.Backends, Backend{Name: "default", Type: BackendTypeUniFi})
+		}
+		if c.Backends[0].UniFi == nil {
+			c.Backends[0].UniFi = &UniFiBackend{}
+		}
+		apply(c.Backends[0].UniFi, value)
+	}
+
+	if namespace, ok := lookup("POD_NAMESPACE"); ok {
+		for _, backend := range c.Backends {
+			if backend.UniFi != nil && backend.UniFi.CredentialsSecret != nil && backend.UniFi.CredentialsSecret.Namespace == "" {
+				backend.UniFi.CredentialsSecret.Namespace = namespace
+			}
+		}
+	}
+	if value, ok := lookup("FORWARDING_PREFIX"); ok {
+		c.Naming.Prefix = value
+	}
+	if value, ok := lookup("EXTERNAL_PORT_RANGE"); ok {
+		c.Policies.ExternalPortRange = value
+	}
+}
+
+func (c *Config) setDefaults() {
+	if c.DefaultBackend == "" && len(c.Backends) > 0 {
+		c.DefaultBackend = c.Backends[0].Name
+	}
+	for i := range c.Backends {
+		if c.Backends[i].Type == "" {
+			c.Backends[i].Type = BackendTypeUniFi
+		}
+		if unifi := c.Backends[i].UniFi; unifi != nil && unifi.Site == "" {
+			unifi.Site = "default"
+		}
+		if mirror := c.Backends[i].Mirror; mirror != nil && mirror.Policy == "" {
+			mirror.Policy = string(forwarding.MirrorAll)
+		}
+	}
+	if c.Defaults.Protocol == "" {
+		c.Defaults.Protocol = ProtocolContainer
+	}
+	if c.Defaults.Interface == "" {
+		c.Defaults.Interface = "wan"
+	}
+	if c.Naming.Prefix == "" {
+		c.Naming.Prefix = DefaultPrefix
+	}
+	if c.Naming.Template == "" {
+		c.Naming.Template = DefaultNameTemplate
+	}
+	if c.Resync.Interval.Duration == 0 {
+		c.Resync.Interval.Duration = 5 * time.Minute
+	}
+	if c.Resync.ConflictRetryInterval.Duration == 0 {
+		c.Resync.ConflictRetryInterval.Duration = time.Minute
+	}
+}
+
+// Validate returns every problem found in the configuration.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(field string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if c.APIVersion != APIVersion {
+		fail("apiVersion", "must be %q", APIVersion)
+	}
+	if c.Kind != Kind {
+		fail("kind", "must be %q", Kind)
+	}
+
+	if len(c.Backends) == 0 {
+		fail("backends", "at least one backend is required")
+	}
+	names := map[string]bool{}
+	for i, backend := range c.Backends {
+		field := fmt.Sprintf("backends[%d]", i)
+		if backend.Name == "" {
+			fail(field+".name", "is required")
+		} else if names[backend.Name] {
+			fail(field+".name", "duplicate backend %q", backend.Name)
+		}
+		names[backend.Name] = true
+	}
+	for i, backend := range c.Backends {
+		field := fmt.Sprintf("backends[%d]", i)
+		switch backend.Type {
+		case BackendTypeUniFi:
+			if backend.UniFi == nil {
+				fail(field+".unifi", "is required for backends of type %q", backend.Type)
+			} else if !strings.HasPrefix(backend.UniFi.BaseURL, "http://") && !strings.HasPrefix(backend.UniFi.BaseURL, "https://") {
+				fail(field+".unifi.baseURL", "must be an http or https URL, got %q", backend.UniFi.BaseURL)
+			}
+			if backend.UniFi != nil {
+				for j, pin := range backend.UniFi.PinnedPublicKeys {
+					if _, err := forwarding.ParsePin(pin); err != nil {
+						fail(fmt.Sprintf("%s.unifi.pinnedPublicKeys[%d]", field, j), "%v", err)
+					}
+				}
+			}
+			if backend.UniFi != nil && backend.UniFi.CredentialsSecret != nil {
+				ref := backend.UniFi.CredentialsSecret
+				if ref.Name == "" {
+					fail(field+".unifi.credentialsSecret.name", "is required")
+				}
+				if ref.Namespace == "" {
+					fail(field+".unifi.credentialsSecret.namespace", "is required when POD_NAMESPACE is not set")
+				}
+			}
+		case BackendTypeMirror:
+			if backend.Mirror == nil || len(backend.Mirror.Members) == 0 {
+				fail(field+".mirror.members", "at least one member is required for backends of type %q", backend.Type)
+				continue
+			}
+			for j, member := range backend.Mirror.Members {
+				if target := c.backend(member); target == nil {
+					fail(fmt.Sprintf("%s.mirror.members[%d]", field, j), "unknown backend %q", member)
+				} else if target.Type == BackendTypeMirror {
+					fail(fmt.Sprintf("%s.mirror.members[%d]", field, j), "mirrors cannot be members of mirrors")
+				}
+			}
+			switch forwarding.MirrorPolicy(backend.Mirror.Policy) {
+			case forwarding.MirrorAll, forwarding.MirrorAny, forwarding.MirrorQuorum:
+			default:
+				fail(field+".mirror.policy", "must be one of all, any or quorum, got %q", backend.Mirror.Policy)
+			}
+		default:
+			fail(field+".type", "unsupported backend type %q", backend.Type)
+		}
+	}
+
+	for _, backend := range c.Backends {
+		if backend.Type == BackendTypeUniFi && !slices.Contains(forwarding.UnifiInterfaces, c.Defaults.Interface) {
+			fail("defaults.interface", "backend %s has no interface %q, expected one of %s",
+				backend.Name, c.Defaults.Interface, strings.Join(forwarding.UnifiInterfaces, ", "))
+			break
+		}
+	}
+	if len(c.Backends) > 0 && !names[c.DefaultBackend] {
+		fail("defaultBackend", "unknown backend %q", c.DefaultBackend)
+	}
+
+	switch c.Defaults.Protocol {
+	case ProtocolContainer, "tcp", "udp", "tcp_udp":
+	default:
+		fail("defaults.protocol", "must be one of container, tcp, udp or tcp_udp, got %q", c.Defaults.Protocol)
+	}
+
+	if c.Naming.Prefix == "" {
+		fail("naming.prefix", "must not be empty, or every rule of the gateways would be considered owned")
+	}
+	if _, err := c.RuleNameTemplate(); err != nil {
+		fail("naming.template", "%v", err)
+	}
+	if _, err := forwarding.ParsePortRange(c.Policies.ExternalPortRange); err != nil {
+		fail("policies.externalPortRange", "%v", err)
+	}
+	for i, reserved := range c.Policies.ReservedExternalPorts {
+		if _, err := forwarding.ParsePortRange(reserved); err != nil || reserved == "" {
+			fail(fmt.Sprintf("policies.reservedExternalPorts[%d]", i), "invalid port or range %q", reserved)
+		}
+	}
+
+	if _, err := c.PodSelector(); err != nil {
+		fail("optIn.podSelector", "%v", err)
+	}
+
+	if c.Resync.Interval.Duration < 0 {
+		fail("resync.interval", "must not be negative")
+	}
+	if c.Resync.ConflictRetryInterval.Duration < 0 {
+		fail("resync.conflictRetryInterval", "must not be negative")
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Config) backend(name string) *Backend {
+	for i := range c.Backends {
+		if c.Backends[i].Name == name {
+			return &c.Backends[i]
+		}
+	}
+	return nil
+}
+
+// ReservedPorts returns the reserved external ports.
+func (c *Config) ReservedPorts() []forwarding.PortRange {
+	ranges := []forwarding.PortRange{}
+	for _, reserved := range c.Policies.ReservedExternalPorts {
+		// Validated by Parse
+		portRange, _ := forwarding.ParsePortRange(reserved)
+		ranges = append(ranges, portRange)
+	}
+	return ranges
+}
+
+// PodSelector returns the selector of the pods that opt in by their labels, or nil if there is
+// none.
+func (c *Config) PodSelector() (labels.Selector, error) {
+	if c.OptIn.PodSelector == nil {
+		return nil, nil
+	}
+	return metav1.LabelSelectorAsSelector(c.OptIn.PodSelector)
+}
+
+// RuleNameTemplate parses the naming template and checks that the names it renders keep the
+// prefix, so that the controller recognises its own rules.
+func (c *Config) RuleNameTemplate() (*template.Template, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(c.Naming.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	var name bytes.Buffer
+	if err = tmpl.Execute(&name, forwarding.RuleNameData{Prefix: c.Naming.Prefix, Namespace: "namespace", Name: "name"}); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(name.String(), c.Naming.Prefix) {
+		return nil, fmt.Errorf("rendered name %q does not start with the prefix %q", name.String(), c.Naming.Prefix)
+	}
+	return tmpl, nil
+}
+
+// NewClient creates the client of a backend that is not a mirror. secret holds the data of its
+// credentials Secret, if it references one.
+func (c *Config) NewClient(backend Backend, secret map[string][]byte) (forwarding.Client, error) {
+	opts, err := c.UnifiOptions(backend, secret)
+	if err != nil {
+		return nil, err
+	}
+	return forwarding.NewUnifiClient(opts)
+}
+
+// Gateways returns a reconciler for every backend. clients holds the client of every backend that
+// is not a mirror; mirrors reuse the clients of their members.
+func (c *Config) Gateways(clients map[string]forwarding.Client) map[string]*forwarding.ForwardingReconciler {
+	// Validated by Parse
+	nameTemplate, _ := c.RuleNameTemplate()
+	gateways := map[string]*forwarding.ForwardingReconciler{}
+	for _, backend := range c.Backends {
+		client := clients[backend.Name]
+		if backend.Type == BackendTypeMirror {
+			mirror := &forwarding.MirrorClient{Policy: forwarding.MirrorPolicy(backend.Mirror.Policy)}
+			for _, member := range backend.Mirror.Members {
+				mirror.Members = append(mirror.Members, forwarding.MirrorMember{Name: member, Client: clients[member]})
+			}
+			client = mirror
+		}
+		gateways[backend.Name] = &forwarding.ForwardingReconciler{
+			RulePrefix:       c.Naming.Prefix,
+			RuleNameTemplate: nameTemplate,
+			Client:           client,
+			Backend:          backend.Name,
+			ManageFirewall:   backend.ManageFirewallRules,
+			ManagePinholes:   backend.ManagePinholes,
+			AdoptMatching:    c.Policies.AdoptMatchingRules,
+		}
+	}
+	return gateways
+}
+
+// UnifiOptions returns the options of the client for a backend of type unifi. secret holds the
+// data of its credentials Secret, if it references one.
+func (c *Config) UnifiOptions(backend Backend, secret map[string][]byte) (forwarding.UnifiOptions, error) {
+	opts := forwarding.UnifiOptions{
+		Backend:   backend.Name,
+		Site:      backend.UniFi.Site,
+		BaseURL:   backend.UniFi.BaseURL,
+		User:      backend.UniFi.Username,
+		Pass:      backend.UniFi.Password,
+		Interface: c.Defaults.Interface,
+		TLS: forwarding.TLSOptions{
+			Insecure: backend.UniFi.Insecure,
+			Pins:     backend.UniFi.PinnedPublicKeys,
+		},
+	}
+	if backend.UniFi.CAFile != "" {
+		ca, err := os.ReadFile(backend.UniFi.CAFile)
+		if err != nil {
+			return forwarding.UnifiOptions{}, fmt.Errorf("unable to read CA bundle: %w", err)
+		}
+		opts.TLS.CA = ca
+	}
+	if value, ok := secret[SecretKeyUsername]; ok {
+		opts.User = string(value)
+	}
+	if value, ok := secret[SecretKeyPassword]; ok {
+		opts.Pass = string(value)
+	}
+	if value, ok := secret[SecretKeyAPIKey]; ok {
+		opts.APIKey = string(value)
+	}
+	if value, ok := secret[SecretKeyCA]; ok {
+		opts.TLS.CA = value
+	}
+
+	certificate, hasCertificate := secret[SecretKeyCertificate]
+	key, hasKey := secret[SecretKeyPrivateKey]
+	switch {
+	case hasCertificate && hasKey:
+		pair, err := tls.X509KeyPair(certificate, key)
+		if err != nil {
+			return forwarding.UnifiOptions{}, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		opts.TLS.Certificate = &pair
+	case hasCertificate || hasKey:
+		return forwarding.UnifiOptions{}, fmt.Errorf("client certificates need both %s and %s", SecretKeyCertificate, SecretKeyPrivateKey)
+	}
+	return opts, nil
+}
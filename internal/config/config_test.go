@@ -0,0 +1,284 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"atte.cloud/port-forward-controller/internal/forwarding"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Load", func() {
+	write := func(content string) string {
+		path := filepath.Join(GinkgoT().TempDir(), "config.yaml")
+		Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+		return path
+	}
+
+	BeforeEach(func() {
+		for _, name := range []string{"UNIFI_BASEURL", "UNIFI_SITE", "UNIFI_USER", "UNIFI_PASS", "UNIFI_INSECURE",
+			"FORWARDING_PREFIX", "EXTERNAL_PORT_RANGE"} {
+			if value, ok := os.LookupEnv(name); ok {
+				Expect(os.Unsetenv(name)).To(Succeed())
+				DeferCleanup(os.Setenv, name, value)
+			}
+		}
+	})
+
+	It("should load a file and fill in defaults", func() {
+		cfg, err := Load(write(`
+apiVersion: port-forward-controller.atte.cloud/v1alpha1
+kind: ControllerConfig
+backends:
+- name: home
+  unifi:
+    baseURL: https://unifi.local
+naming:
+  prefix: k8s-
+`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Backends).To(HaveLen(1))
+		Expect(cfg.Backends[0].Type).To(Equal(BackendTypeUniFi))
+		Expect(cfg.Backends[0].UniFi.Site).To(Equal("default"))
+		Expect(cfg.Defaults.Protocol).To(Equal(ProtocolContainer))
+		Expect(cfg.Naming.Template).To(Equal(DefaultNameTemplate))
+		Expect(cfg.Resync.Interval.Duration).To(Equal(5 * time.Minute))
+	})
+
+	It("should let the environment override the file", func() {
+		GinkgoT().Setenv("UNIFI_BASEURL", "https://other.local")
+		GinkgoT().Setenv("UNIFI_PASS", "secret")
+		GinkgoT().Setenv("FORWARDING_PREFIX", "env-")
+
+		cfg, err := Load(write(`
+apiVersion: port-forward-controller.atte.cloud/v1alpha1
+kind: ControllerConfig
+backends:
+- name: home
+  unifi:
+    baseURL: https://unifi.local
+`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Backends[0].UniFi.BaseURL).To(Equal("https://other.local"))
+		Expect(cfg.Backends[0].UniFi.Password).To(Equal("secret"))
+		Expect(cfg.Naming.Prefix).To(Equal("env-"))
+	})
+
+	It("should build a backend from the environment alone", func() {
+		GinkgoT().Setenv("UNIFI_BASEURL", "https://unifi.local")
+
+		cfg, err := Load("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Backends).To(HaveLen(1))
+		Expect(cfg.Backends[0].Name).To(Equal("default"))
+		Expect(cfg.Naming.Prefix).To(Equal(DefaultPrefix))
+	})
+
+	It("should default to the first backend", func() {
+		cfg, err := Load(write(`
+apiVersion: port-forward-controller.atte.cloud/v1alpha1
+kind: ControllerConfig
+backends:
+- name: home
+  unifi:
+    baseURL: https://unifi.local
+- name: office
+  unifi:
+    baseURL: https://office.local
+    site: office
+`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.DefaultBackend).To(Equal("home"))
+	})
+
+	It("should check the members of mirrors", func() {
+		_, err := Load(write(`
+apiVersion: port-forward-controller.atte.cloud/v1alpha1
+kind: ControllerConfig
+backends:
+- name: home
+  unifi:
+    baseURL: https://unifi.local
+- name: ha
+  type: mirror
+  mirror:
+    members: [home, missing, ha]
+    policy: most
+`))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`backends[1].mirror.members[1]: unknown backend "missing"`))
+		Expect(err.Error()).To(ContainSubstring("backends[1].mirror.members[2]: mirrors cannot be members of mirrors"))
+		Expect(err.Error()).To(ContainSubstring("backends[1].mirror.policy"))
+	})
+
+	It("should reject unknown fields", func() {
+		_, err := Load(write(`
+apiVersion: port-forward-controller.atte.cloud/v1alpha1
+kind: ControllerConfig
+backend: []
+`))
+		Expect(err).To(MatchError(ContainSubstring(`unknown field "backend"`)))
+	})
+
+	It("should report every validation error", func() {
+		_, err := Load(write(`
+apiVersion: port-forward-controller.atte.cloud/v1alpha1
+kind: ControllerConfig
+backends:
+- name: home
+  type: opnsense
+- name: home
+  unifi:
+    baseURL: unifi.local
+defaults:
+  protocol: sctp
+naming:
+  prefix: k8s-
+  template: "{{.Namespace}}-{{.Name}}"
+policies:
+  externalPortRange: 2000-1000
+  reservedExternalPorts: ["22", "http"]
+optIn:
+  podSelector:
+    matchExpressions:
+    - {key: app, operator: Near}
+defaultBackend: office
+`))
+		Expect(err).To(HaveOccurred())
+		for _, field := range []string{"backends[0].type", "backends[1].name", "backends[1].unifi.baseURL",
+			"defaults.protocol", "naming.template", "defaultBackend", "policies.externalPortRange",
+			"policies.reservedExternalPorts[1]", "optIn.podSelector"} {
+			Expect(err.Error()).To(ContainSubstring(field))
+		}
+	})
+})
+
+var _ = Describe("UnifiOptions", func() {
+	backend := Backend{Name: "home", Type: BackendTypeUniFi, UniFi: &UniFiBackend{
+		BaseURL:  "https://unifi.local",
+		Site:     "default",
+		Username: "file-user",
+		Password: "file-pass",
+	}}
+	cfg := &Config{Defaults: Defaults{Interface: "wan2"}}
+
+	It("should prefer the credentials from the secret", func() {
+		opts, err := cfg.UnifiOptions(backend, map[string][]byte{
+			SecretKeyPassword: []byte("secret-pass"),
+			SecretKeyAPIKey:   []byte("key"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(opts.User).To(Equal("file-user"))
+		Expect(opts.Pass).To(Equal("secret-pass"))
+		Expect(opts.APIKey).To(Equal("key"))
+		Expect(opts.Interface).To(Equal("wan2"))
+	})
+
+	It("should reject a certificate without a key", func() {
+		_, err := cfg.UnifiOptions(backend, map[string][]byte{SecretKeyCertificate: []byte("cert")})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Parse", func() {
+	It("should take overrides from the lookup", func() {
+		cfg, err := Parse([]byte(`
+backends:
+- name: home
+  unifi:
+    baseURL: https://unifi.local
+    credentialsSecret:
+      name: unifi
+`), func(name string) (string, bool) {
+			return "controller", name == "POD_NAMESPACE"
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Backends[0].UniFi.CredentialsSecret.Namespace).To(Equal("controller"))
+	})
+
+	It("should tell rules made by hand apart with the default naming", func() {
+		cfg, err := Parse([]byte(`
+backends:
+- name: home
+  unifi:
+    baseURL: https://unifi.local
+policies:
+  adoptMatchingRules: true
+`), func(string) (string, bool) { return "", false })
+		Expect(err).NotTo(HaveOccurred())
+
+		manual := forwarding.PortForward{Name: "minecraft", Address: "10.0.0.1", Port: 25565, ExternalPort: 25565, Protocol: "tcp"}
+		client := forwarding.NewFakeClient(manual)
+		fr := cfg.Gateways(map[string]forwarding.Client{"home": client})["home"]
+		Expect(fr.Owns(manual.Name)).To(BeFalse())
+
+		name := fr.RuleName("default", "pod")
+		desired := manual
+		desired.Name = name
+		result, err := fr.EnsureAddresses(context.Background(), name, []forwarding.PortForward{desired})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Adopted).To(ConsistOf(manual))
+		Expect(client.Forwards()).To(ConsistOf(desired))
+	})
+
+	It("should reject an empty prefix", func() {
+		cfg, err := Parse(nil, func(name string) (string, bool) { return "https://unifi.local", name == "UNIFI_BASEURL" })
+		Expect(err).NotTo(HaveOccurred())
+		cfg.Naming.Prefix = ""
+		Expect(cfg.Validate()).To(MatchError(ContainSubstring("naming.prefix")))
+	})
+
+	It("should build a reconciler for every gateway", func() {
+		cfg, err := Parse([]byte(`
+backends:
+- name: home
+  unifi:
+    baseURL: https://unifi.local
+- name: office
+  unifi:
+    baseURL: https://office.local
+- name: edge
+  type: mirror
+  manageFirewallRules: true
+  mirror:
+    members: [home, office]
+naming:
+  prefix: k8s-
+`), func(string) (string, bool) { return "", false })
+		Expect(err).NotTo(HaveOccurred())
+
+		clients := map[string]forwarding.Client{}
+		for _, name := range []string{"home", "office"} {
+			clients[name], err = cfg.NewClient(*cfg.backend(name), nil)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		gateways := cfg.Gateways(clients)
+		Expect(gateways).To(HaveLen(3))
+		Expect(gateways["home"].Client).To(Equal(clients["home"]))
+		Expect(gateways["edge"].ManageFirewall).To(BeTrue())
+		Expect(gateways["edge"].RuleName("default", "pod")).To(Equal("k8s-default-pod"))
+		mirror, ok := gateways["edge"].Client.(*forwarding.MirrorClient)
+		Expect(ok).To(BeTrue())
+		Expect(mirror.Policy).To(Equal(forwarding.MirrorAll))
+		Expect(mirror.Members).To(HaveLen(2))
+	})
+})
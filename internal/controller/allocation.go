@@ -0,0 +1,171 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+
+	"atte.cloud/port-forward-controller/internal/forwarding"
+	v1 "k8s.io/api/core/v1"
+)
+
+// assignExternalPorts allocates an external port for every hostPort of the pod that asks for one
+// and records the allocations on the pod, so that they survive controller restarts. Ports are
+// only taken from the part of the range the forwarding policies of the pod allow. Allocations of
+// hostPorts that no longer ask for one, or that the policies stopped allowing, are released.
+func (r *PodReconciler) assignExternalPorts(ctx context.Context, pod *v1.Pod, fwd *forwarding.ForwardingReconciler) error {
+	mapping, auto, err := externalPorts(pod.Annotations)
+	if err != nil {
+		return err
+	}
+	assigned, err := parsePortMapping(pod.Annotations[AssignedExternalPortsAnnotation], false)
+	if err != nil {
+		// The annotation is managed by us, so start over rather than getting stuck on it
+		assigned = portMapping{}
+	}
+
+	wanted := map[int32]string{}
+	for _, port := range selectedPorts(pod) {
+		protocol, ok := r.protocol(port)
+		if !ok || !(auto || mapping[port.HostPort] == autoPort) {
+			continue
+		}
+		if existing, ok := wanted[port.HostPort]; ok && existing != protocol {
+			protocol = "tcp_udp"
+		}
+		wanted[port.HostPort] = protocol
+	}
+
+	allowed, err := r.allowedExternalPorts(ctx, pod)
+	if err != nil {
+		return err
+	}
+	kept := portMapping{}
+	missing := []int{}
+	for hostPort := range wanted {
+		if externalPort, ok := assigned[hostPort]; ok && portAllowed(allowed, externalPort) {
+			kept[hostPort] = externalPort
+		} else {
+			missing = append(missing, int(hostPort))
+		}
+	}
+	if len(missing) == 0 && len(kept) == len(assigned) {
+		return nil
+	}
+
+	if len(missing) > 0 {
+		used, err := r.usedExternalPorts(ctx, pod, fwd)
+		if err != nil {
+			return err
+		}
+		sort.Ints(missing)
+		for _, hostPort := range missing {
+			protocol := wanted[int32(hostPort)]
+			externalPort, err := r.allocate(protocol, used, allowed)
+			if err != nil {
+				return err
+			}
+			kept[int32(hostPort)] = externalPort
+			used = append(used, forwarding.PortForward{ExternalPort: externalPort, Protocol: protocol})
+		}
+	}
+
+	return r.setAssignedExternalPorts(ctx, pod, kept)
+}
+
+// allocate returns the lowest free port of the allocation range within the allowed ranges, or of
+// the whole allocation range if allowed is nil.
+func (r *PodReconciler) allocate(protocol string, used []forwarding.PortForward, allowed []forwarding.PortRange) (int32, error) {
+	if allowed == nil || r.PortRange.IsEmpty() {
+		return r.PortRange.Allocate(protocol, used)
+	}
+	for _, portRange := range allowed {
+		if port, err := r.PortRange.Intersect(portRange).Allocate(protocol, used); err == nil {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free external port left in range %s that the forwarding policies allow", r.PortRange)
+}
+
+// portAllowed reports whether the port is in one of the allowed ranges, or allowed is nil.
+func portAllowed(allowed []forwarding.PortRange, port int32) bool {
+	return allowed == nil || slices.ContainsFunc(allowed, func(portRange forwarding.PortRange) bool {
+		return portRange.Contains(port)
+	})
+}
+
+// releaseExternalPorts drops the allocations of the given forwards, so that they are allocated
+// again on the next reconcile.
+func (r *PodReconciler) releaseExternalPorts(ctx context.Context, pod *v1.Pod, forwards []forwarding.PortForward) (bool, error) {
+	assigned, err := parsePortMapping(pod.Annotations[AssignedExternalPortsAnnotation], false)
+	if err != nil {
+		return false, nil
+	}
+
+	released := false
+	for _, forward := range forwards {
+		if externalPort, ok := assigned[forward.Port]; ok && externalPort == forward.ExternalPort {
+			delete(assigned, forward.Port)
+			released = true
+		}
+	}
+	if !released {
+		return false, nil
+	}
+	return true, r.setAssignedExternalPorts(ctx, pod, assigned)
+}
+
+func (r *PodReconciler) setAssignedExternalPorts(ctx context.Context, pod *v1.Pod, assigned portMapping) error {
+	return setAnnotation(ctx, r.Client, pod, AssignedExternalPortsAnnotation, assigned.String())
+}
+
+// usedExternalPorts returns the forwards of all other controlled pods on the same gateway, every
+// rule on the gateway not owned by the pod and the reserved ports.
+func (r *PodReconciler) usedExternalPorts(ctx context.Context, pod *v1.Pod, fwd *forwarding.ForwardingReconciler) ([]forwarding.PortForward, error) {
+	var pods v1.PodList
+	if err := r.List(ctx, &pods); err != nil {
+		return nil, err
+	}
+
+	used := []forwarding.PortForward{}
+	for i := range pods.Items {
+		other := &pods.Items[i]
+		if other.UID == pod.UID || !r.controls(ctx, other) || !r.sameGateway(pod, other) {
+			continue
+		}
+		forwards, _ := r.desiredForwards(other)
+		used = append(used, forwards...)
+	}
+
+	rules, err := fwd.ListAddresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ruleName := fwd.RuleName(pod.Namespace, pod.Name)
+	for _, rule := range rules {
+		if rule.Name != ruleName {
+			used = append(used, rule)
+		}
+	}
+	for _, reserved := range r.ReservedPorts {
+		used = append(used, forwarding.PortForward{ExternalPorts: []forwarding.PortRange{reserved}, Protocol: "tcp_udp"})
+	}
+	return used, nil
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"atte.cloud/port-forward-controller/internal/forwarding"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// EnableAnnotation opts a pod in to forwarding when set to "true", and out when set to
+	// "false". As a label or annotation of a namespace, it opts in every pod of the namespace
+	// that has hostPorts.
+	EnableAnnotation = Annotation + "/enable"
+
+	// ConflictsAnnotation lists the external ports of a pod that could not be forwarded because
+	// they are held by another pod or router rule.
+	ConflictsAnnotation = Annotation + "/conflicts"
+
+	// UnsupportedPortsAnnotation lists the hostPorts of a pod whose protocol cannot be forwarded,
+	// as "<hostPort>/<protocol>". It is managed by the controller.
+	UnsupportedPortsAnnotation = Annotation + "/unsupported-ports"
+
+	// ExternalPortAnnotation selects the external port of the forwarded hostPorts. It is either
+	// "auto" to allocate a port for every hostPort, or a comma separated list of
+	// "<hostPort>:<externalPort>" mappings where the external port may also be "auto".
+	// HostPorts without a mapping keep their own port number.
+	ExternalPortAnnotation = Annotation + "/external-port"
+
+	// AssignedExternalPortsAnnotation records the ports allocated for "auto" mappings as a comma
+	// separated list of "<hostPort>:<externalPort>". It is managed by the controller.
+	AssignedExternalPortsAnnotation = Annotation + "/assigned-external-ports"
+
+	// ExternalEndpointsAnnotation holds a JSON list of the public "ip:port/proto" endpoints of a
+	// pod, or of all pods of a Deployment or StatefulSet. It is managed by the controller.
+	ExternalEndpointsAnnotation = Annotation + "/external-endpoints"
+
+	// InterfaceAnnotation selects the WAN interface the forwards of a pod are published on, e.g.
+	// "wan", "wan2" or "both" on UniFi gateways. Pods without it use the default interface.
+	InterfaceAnnotation = Annotation + "/interface"
+
+	// SourceRangesAnnotation restricts the forwards of a pod to clients from a comma separated
+	// list of addresses and CIDR ranges. Entries of the form "group:<name>" reference an address
+	// group of the gateway instead. Pods without it accept clients from any source.
+	SourceRangesAnnotation = Annotation + "/source-ranges"
+
+	// PortsAnnotation limits the forwards of a pod to the hostPorts it lists, separated by commas.
+	// Ports are listed by the name of the container port or by the number of the hostPort.
+	PortsAnnotation = Annotation + "/ports"
+
+	// ExcludePortsAnnotation lists hostPorts that are not forwarded, in the same form as
+	// PortsAnnotation, e.g. to keep an admin port on the LAN.
+	ExcludePortsAnnotation = Annotation + "/exclude-ports"
+
+	// AdoptRulesAnnotation lists the IDs of rules made by hand, separated by commas, that the
+	// controller takes over as rules of the pod instead of creating its own. Mirror gateways do
+	// not support it, as the IDs differ between their members.
+	AdoptRulesAnnotation = Annotation + "/adopt-rules"
+)
+
+// autoPort marks a hostPort whose external port is allocated by the controller.
+const autoPort int32 = -1
+
+// portMapping maps hostPorts to external ports.
+type portMapping map[int32]int32
+
+// parsePortMapping parses a list of "<hostPort>:<externalPort>" pairs. If allowAuto is set,
+// external ports may be "auto".
+func parsePortMapping(value string, allowAuto bool) (portMapping, error) {
+	mapping := portMapping{}
+	if strings.TrimSpace(value) == "" {
+		return mapping, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		hostPort, externalPort, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found {
+			return nil, fmt.Errorf("invalid port mapping %q: expected <hostPort>:<externalPort>", pair)
+		}
+		from, err := forwarding.ParsePort(hostPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port mapping %q: %w", pair, err)
+		}
+		if allowAuto && externalPort == "auto" {
+			mapping[from] = autoPort
+			continue
+		}
+		to, err := forwarding.ParsePort(externalPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port mapping %q: %w", pair, err)
+		}
+		mapping[from] = to
+	}
+	return mapping, nil
+}
+
+// externalPorts returns the mapping requested by the external port annotation. The special
+// value "auto" is returned as a nil mapping with auto set.
+func externalPorts(annotations map[string]string) (mapping portMapping, auto bool, err error) {
+	value := annotations[ExternalPortAnnotation]
+	if strings.TrimSpace(value) == "auto" {
+		return nil, true, nil
+	}
+	mapping, err = parsePortMapping(value, true)
+	return mapping, false, err
+}
+
+func (m portMapping) String() string {
+	hostPorts := make([]int, 0, len(m))
+	for hostPort := range m {
+		hostPorts = append(hostPorts, int(hostPort))
+	}
+	sort.Ints(hostPorts)
+
+	pairs := make([]string, 0, len(m))
+	for _, hostPort := range hostPorts {
+		pairs = append(pairs, fmt.Sprintf("%d:%d", hostPort, m[int32(hostPort)]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// sourceRanges returns the sorted sources of the source ranges annotation, or nil if there are none.
+func sourceRanges(annotations map[string]string) ([]string, error) {
+	var sources []string
+	for _, source := range strings.Split(annotations[SourceRangesAnnotation], ",") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		if !strings.HasPrefix(source, "group:") {
+			if _, err := forwarding.ParseSource(source); err != nil {
+				return nil, err
+			}
+		}
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	return sources, nil
+}
+
+// adoptRules returns the IDs of the rules the pod adopts.
+func adoptRules(annotations map[string]string) []string {
+	ids := []string{}
+	for _, id := range strings.Split(annotations[AdoptRulesAnnotation], ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// portSelection returns the entries of a ports or exclude-ports annotation.
+func portSelection(value string) []string {
+	entries := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// selectsPort reports whether an entry of a port selection names the port or its hostPort.
+func selectsPort(entries []string, port v1.ContainerPort) bool {
+	for _, entry := range entries {
+		if number, err := forwarding.ParsePort(entry); err == nil {
+			if number == port.HostPort {
+				return true
+			}
+		} else if entry == port.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// setAnnotation patches a single annotation of obj, removing it if value is empty.
+func setAnnotation(ctx context.Context, c client.Client, obj client.Object, key string, value string) error {
+	annotations := obj.GetAnnotations()
+	if annotations[key] == value {
+		return nil
+	}
+
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+	if value == "" {
+		delete(annotations, key)
+	} else {
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[key] = value
+	}
+	obj.SetAnnotations(annotations)
+	return c.Patch(ctx, obj, patch)
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"atte.cloud/port-forward-controller/internal/forwarding"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// claimedForwards returns the forwards of the pod that are not already claimed by an earlier pod,
+// along with a conflict for every forward that is.
+func (r *PodReconciler) claimedForwards(ctx context.Context, pod *v1.Pod) ([]forwarding.PortForward, []forwarding.Conflict, error) {
+	forwards := []forwarding.PortForward{}
+	conflicts := []forwarding.Conflict{}
+	desired, _ := r.desiredForwards(pod)
+	if len(desired) == 0 {
+		return forwards, conflicts, nil
+	}
+	var pods v1.PodList
+	if err := r.List(ctx, &pods); err != nil {
+		return nil, nil, err
+	}
+
+	earlier := slices.DeleteFunc(r.claimants(ctx, pod, pods.Items), func(other claimant) bool {
+		return !claimsBefore(other.pod, pod)
+	})
+	for _, forward := range desired {
+		holder := claimedBy(forward, earlier)
+		if holder == nil {
+			forwards = append(forwards, forward)
+			continue
+		}
+		conflicts = append(conflicts, forwarding.Conflict{
+			Forward: forward,
+			Holder:  fmt.Sprintf("pod %s", client.ObjectKeyFromObject(holder)),
+		})
+	}
+	return forwards, conflicts, nil
+}
+
+// claimant is a controlled pod along with the forwards it desires.
+type claimant struct {
+	pod      *v1.Pod
+	forwards []forwarding.PortForward
+}
+
+// claimants returns the controlled pods other than pod that share its gateway and are not being
+// deleted, computing their forwards once for all forwards of pod.
+func (r *PodReconciler) claimants(ctx context.Context, pod *v1.Pod, pods []v1.Pod) []claimant {
+	key := client.ObjectKeyFromObject(pod)
+	claimants := []claimant{}
+	for i := range pods {
+		other := &pods[i]
+		if client.ObjectKeyFromObject(other) == key || !other.DeletionTimestamp.IsZero() || !r.sameGateway(pod, other) ||
+			!r.controls(ctx, other) {
+			continue
+		}
+		forwards, _ := r.desiredForwards(other)
+		claimants = append(claimants, claimant{pod: other, forwards: forwards})
+	}
+	return claimants
+}
+
+// claimedBy returns the first of the claimants whose forwards overlap forward, if any.
+func claimedBy(forward forwarding.PortForward, claimants []claimant) *v1.Pod {
+	for _, other := range claimants {
+		if overlapsAny([]forwarding.PortForward{forward}, other.forwards) {
+			return other.pod
+		}
+	}
+	return nil
+}
+
+// claimsBefore orders claimants by creation time, falling back to the namespaced name for pods
+// created within the same second.
+func claimsBefore(a *v1.Pod, b *v1.Pod) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	return client.ObjectKeyFromObject(a).String() < client.ObjectKeyFromObject(b).String()
+}
+
+// reportConflicts records an event for every conflict and keeps the conflicts annotation of the pod in sync.
+func (r *PodReconciler) reportConflicts(ctx context.Context, pod *v1.Pod, conflicts []forwarding.Conflict) error {
+	ports := []string{}
+	for _, conflict := range conflicts {
+		r.Recorder.Eventf(pod, v1.EventTypeWarning, ReasonConflict,
+			"External port %s is already held by %s", conflict.Forward, conflict.Holder)
+		ports = append(ports, conflict.Forward.String())
+	}
+
+	return setAnnotation(ctx, r.Client, pod, ConflictsAnnotation, strings.Join(ports, ","))
+}
+
+// competingPods maps a pod event to the controlled pods that may have to give up or take over
+// one of its external ports.
+func (r *PodReconciler) competingPods(ctx context.Context, obj client.Object) []reconcile.Request {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return nil
+	}
+
+	var pods v1.PodList
+	if err := r.List(ctx, &pods); err != nil {
+		return nil
+	}
+
+	forwards := []forwarding.PortForward{}
+	if r.controls(ctx, pod) {
+		forwards, _ = r.desiredForwards(pod)
+	}
+
+	requests := []reconcile.Request{}
+	for i := range pods.Items {
+		other := &pods.Items[i]
+		if other.UID == pod.UID || !r.controls(ctx, other) {
+			continue
+		}
+		_, conflicting := other.Annotations[ConflictsAnnotation]
+		// Pods over the forward limit of their namespace may fit once another pod is gone
+		limited := other.Namespace == pod.Namespace && policyDenied(other)
+		// Only pods sharing the gateway need their forwards computed
+		if !conflicting && !limited && len(forwards) > 0 && r.sameGateway(pod, other) {
+			otherForwards, _ := r.desiredForwards(other)
+			conflicting = overlapsAny(forwards, otherForwards)
+		}
+		if conflicting || limited {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(other)})
+		}
+	}
+	return requests
+}
+
+func overlapsAny(forwards []forwarding.PortForward, others []forwarding.PortForward) bool {
+	for _, forward := range forwards {
+		for _, other := range others {
+			if forward.Overlaps(other) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	"atte.cloud/port-forward-controller/internal/forwarding"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// CredentialsReconciler rebuilds the forwarding client whenever the Secret holding the
+// credentials of the backend changes.
+type CredentialsReconciler struct {
+	client.Client
+	// Gateway names the backend the credentials belong to
+	Gateway string
+	// Secret holds the credentials
+	Secret types.NamespacedName
+	// NewClient builds a client from the data of the Secret
+	NewClient func(data map[string][]byte) (forwarding.Client, error)
+	// Target is swapped to the new client, so that reconciles in flight finish on the old one
+	Target *forwarding.SwappableClient
+
+	// resourceVersion is the version of the Secret the current client was built from
+	resourceVersion string
+}
+
+// Secrets are only readable in the namespace of the controller; Secrets kept elsewhere need a Role
+// and RoleBinding of their own.
+// +kubebuilder:rbac:groups="",namespace=system,resources=secrets,verbs=get;list;watch
+
+func (r *CredentialsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	var secret v1.Secret
+	if err := r.Get(ctx, req.NamespacedName, &secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			log.Info("Credentials secret not found, keeping the current client")
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if secret.ResourceVersion == r.resourceVersion {
+		return ctrl.Result{}, nil
+	}
+
+	forwardingClient, err := r.NewClient(secret.Data)
+	if err != nil {
+		// Retrying does not help until the secret is fixed, which triggers another reconcile
+		log.Error(err, "Invalid credentials secret, keeping the current client")
+		return ctrl.Result{}, nil
+	}
+	r.Target.Swap(forwardingClient)
+	r.resourceVersion = secret.ResourceVersion
+	log.Info("Reloaded backend credentials", "resourceVersion", secret.ResourceVersion)
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager. It runs on every replica, not only on
+// the leader, as the clients of standby replicas serve health checks and take over on failover.
+func (r *CredentialsReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	needLeaderElection := false
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("credentials-"+r.Gateway).
+		WithOptions(controller.Options{NeedLeaderElection: &needLeaderElection}).
+		For(&v1.Secret{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(object client.Object) bool {
+			return object.GetNamespace() == r.Secret.Namespace && object.GetName() == r.Secret.Name
+		}))).
+		Complete(r)
+}
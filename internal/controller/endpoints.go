@@ -0,0 +1,171 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+
+	"atte.cloud/port-forward-controller/internal/forwarding"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// +kubebuilder:rbac:groups=apps,resources=deployments;statefulsets,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch
+
+// endpoints returns the public endpoints of the given forwards in the "ip:port/proto" form.
+// Pinholes are reached at the address of the pod itself.
+func endpoints(address string, forwards []forwarding.PortForward) []string {
+	result := []string{}
+	for _, forward := range forwards {
+		host := address
+		if forward.IsPinhole() {
+			host = forward.Address
+		}
+		result = append(result, fmt.Sprintf("%s/%s",
+			net.JoinHostPort(host, fmt.Sprint(forward.ExternalPort)), forward.Protocol))
+	}
+	sort.Strings(result)
+	return result
+}
+
+// publishEndpoints records the public endpoints of the pod on the pod and on its owning workload.
+func (r *PodReconciler) publishEndpoints(ctx context.Context, pod *v1.Pod, fwd *forwarding.ForwardingReconciler, forwards []forwarding.PortForward) error {
+	address, err := fwd.WANAddress(ctx)
+	if err != nil || address == "" {
+		return err
+	}
+
+	value, err := json.Marshal(endpoints(address, forwards))
+	if err != nil {
+		return err
+	}
+	if err := setAnnotation(ctx, r.Client, pod, ExternalEndpointsAnnotation, string(value)); err != nil {
+		return err
+	}
+	return r.publishOwnerEndpoints(ctx, pod)
+}
+
+// unpublishEndpoints removes the public endpoints of a released pod from the pod and from its
+// owning workload.
+func (r *PodReconciler) unpublishEndpoints(ctx context.Context, pod *v1.Pod) error {
+	if err := setAnnotation(ctx, r.Client, pod, ExternalEndpointsAnnotation, ""); err != nil {
+		return err
+	}
+	return r.publishOwnerEndpoints(ctx, pod)
+}
+
+// publishOwnerEndpoints records the public endpoints of all controlled pods belonging to the
+// workload of the pod on that workload. Pods that are being deleted do not contribute, and the
+// annotation is removed once no pod does.
+func (r *PodReconciler) publishOwnerEndpoints(ctx context.Context, pod *v1.Pod) error {
+	owner, err := r.workload(ctx, pod)
+	if err != nil || owner == nil {
+		return err
+	}
+
+	var pods v1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(pod.Namespace)); err != nil {
+		return err
+	}
+
+	unique := map[string]bool{}
+	published := false
+	for i := range pods.Items {
+		other := &pods.Items[i]
+		if other.UID == pod.UID {
+			other = pod
+		}
+		if !other.DeletionTimestamp.IsZero() || !r.controls(ctx, other) {
+			continue
+		}
+		otherOwner, err := r.workload(ctx, other)
+		if err != nil {
+			return err
+		}
+		if otherOwner == nil || otherOwner.GetUID() != owner.GetUID() {
+			continue
+		}
+
+		var podEndpoints []string
+		if err := json.Unmarshal([]byte(other.Annotations[ExternalEndpointsAnnotation]), &podEndpoints); err != nil {
+			continue
+		}
+		published = true
+		for _, endpoint := range podEndpoints {
+			unique[endpoint] = true
+		}
+	}
+
+	ownerEndpoints := []string{}
+	for endpoint := range unique {
+		ownerEndpoints = append(ownerEndpoints, endpoint)
+	}
+	sort.Strings(ownerEndpoints)
+	if !published {
+		return setAnnotation(ctx, r.Client, owner, ExternalEndpointsAnnotation, "")
+	}
+	value, err := json.Marshal(ownerEndpoints)
+	if err != nil {
+		return err
+	}
+	return setAnnotation(ctx, r.Client, owner, ExternalEndpointsAnnotation, string(value))
+}
+
+// workload returns the Deployment or StatefulSet owning the pod, if any.
+func (r *PodReconciler) workload(ctx context.Context, pod *v1.Pod) (client.Object, error) {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return nil, nil
+	}
+
+	switch ref.Kind {
+	case "StatefulSet":
+		return r.getOwner(ctx, pod.Namespace, ref, &appsv1.StatefulSet{})
+	case "ReplicaSet":
+		replicaSet, err := r.getOwner(ctx, pod.Namespace, ref, &appsv1.ReplicaSet{})
+		if err != nil || replicaSet == nil {
+			return nil, err
+		}
+		ref = metav1.GetControllerOf(replicaSet)
+		if ref == nil || ref.Kind != "Deployment" {
+			return nil, nil
+		}
+		return r.getOwner(ctx, pod.Namespace, ref, &appsv1.Deployment{})
+	}
+	return nil, nil
+}
+
+func (r *PodReconciler) getOwner(ctx context.Context, namespace string, ref *metav1.OwnerReference, obj client.Object) (client.Object, error) {
+	if err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.Name}, obj); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if obj.GetUID() != ref.UID {
+		return nil, nil
+	}
+	return obj, nil
+}
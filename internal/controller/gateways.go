@@ -0,0 +1,166 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"atte.cloud/port-forward-controller/internal/forwarding"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// GatewayAnnotation selects the gateway the forwards of a pod are published on. Pods without it
+// use the default gateway.
+const GatewayAnnotation = Annotation + "/gateway"
+
+// AppliedGatewayAnnotation records the gateway holding the rules of a pod, so that they are
+// removed from it once the pod selects another gateway.
+const AppliedGatewayAnnotation = Annotation + "/applied-gateway"
+
+// gatewayName returns the name of the gateway selected by the pod.
+func (r *PodReconciler) gatewayName(pod *v1.Pod) string {
+	if name := pod.Annotations[GatewayAnnotation]; name != "" {
+		return name
+	}
+	return r.Fwd.Backend
+}
+
+// gateway returns the gateway selected by the pod.
+func (r *PodReconciler) gateway(pod *v1.Pod) (*forwarding.ForwardingReconciler, error) {
+	return r.lookupGateway(r.gatewayName(pod))
+}
+
+// managesPinholes reports whether the gateway of the pod opens IPv6 pinholes.
+func (r *PodReconciler) managesPinholes(pod *v1.Pod) bool {
+	fwd, err := r.gateway(pod)
+	return err == nil && fwd.ManagePinholes
+}
+
+func (r *PodReconciler) lookupGateway(name string) (*forwarding.ForwardingReconciler, error) {
+	if name == r.Fwd.Backend {
+		return r.Fwd, nil
+	}
+	if fwd, ok := r.Gateways[name]; ok {
+		return fwd, nil
+	}
+	return nil, fmt.Errorf("unknown gateway %q", name)
+}
+
+// sameGateway reports whether both pods publish their forwards on the same gateway, and hence
+// compete for the same external ports.
+func (r *PodReconciler) sameGateway(a *v1.Pod, b *v1.Pod) bool {
+	return r.gatewayName(a) == r.gatewayName(b)
+}
+
+// ruleName returns the name of the rules of the pod on its gateway.
+func (r *PodReconciler) ruleName(pod *v1.Pod) string {
+	fwd, err := r.gateway(pod)
+	if err != nil {
+		fwd = r.Fwd
+	}
+	return fwd.RuleName(pod.Namespace, pod.Name)
+}
+
+// leavePreviousGateway removes the rules of the pod from the gateway it used before selecting its
+// current one, and records the current gateway once that succeeded. A failing previous gateway
+// does not hold up the current one; the removal is retried on the next reconcile.
+func (r *PodReconciler) leavePreviousGateway(ctx context.Context, pod *v1.Pod) error {
+	current := r.gatewayName(pod)
+	previous := pod.Annotations[AppliedGatewayAnnotation]
+	if previous != "" && previous != current {
+		for _, name := range r.leftGateways(previous, current) {
+			// Gateways removed from the configuration cannot be cleaned up anymore
+			fwd, err := r.lookupGateway(name)
+			if err != nil {
+				continue
+			}
+			deleted, err := fwd.DeleteAddresses(ctx, fwd.RuleName(pod.Namespace, pod.Name), fwd.LegacyRuleName(pod.Namespace, pod.Name))
+			r.recordResult(pod, forwarding.Result{Deleted: deleted, DryRun: fwd.DryRun})
+			if err != nil {
+				r.Recorder.Eventf(pod, v1.EventTypeWarning, ReasonBackendError,
+					"Unable to remove forwards from gateway %s: %v", name, err)
+				return err
+			}
+		}
+	}
+	return setAnnotation(ctx, r.Client, pod, AppliedGatewayAnnotation, current)
+}
+
+// leftGateways returns the gateways to remove the rules of a pod from when it moves from the
+// previous gateway to the current one. The members of a mirror hold its rules, so members of the
+// previous gateway that hold the rules for the current one as well are kept.
+func (r *PodReconciler) leftGateways(previous string, current string) []string {
+	kept := map[string]bool{}
+	for _, name := range r.memberNames(current) {
+		kept[name] = true
+	}
+	members := r.memberNames(previous)
+	left := []string{}
+	for _, name := range members {
+		if !kept[name] {
+			left = append(left, name)
+		}
+	}
+	if len(left) == len(members) {
+		return []string{previous}
+	}
+	return left
+}
+
+// memberNames returns the gateways holding the rules of the named gateway: the members of a
+// mirror, or the gateway itself.
+func (r *PodReconciler) memberNames(name string) []string {
+	fwd, err := r.lookupGateway(name)
+	if err != nil {
+		return []string{name}
+	}
+	mirror, ok := fwd.Client.(*forwarding.MirrorClient)
+	if !ok {
+		return []string{name}
+	}
+	names := []string{}
+	for _, member := range mirror.Members {
+		names = append(names, member.Name)
+	}
+	return names
+}
+
+// deleteFromGateways removes the rules of the pod from every gateway that may hold them.
+func (r *PodReconciler) deleteFromGateways(ctx context.Context, pod *v1.Pod) error {
+	names := []string{r.gatewayName(pod)}
+	if applied := pod.Annotations[AppliedGatewayAnnotation]; applied != "" && applied != names[0] {
+		names = append(names, applied)
+	}
+
+	for _, name := range names {
+		fwd, err := r.lookupGateway(name)
+		if err != nil {
+			log.FromContext(ctx).Info("Skipping unknown gateway", "gateway", name)
+			continue
+		}
+		deleted, err := fwd.DeleteAddresses(ctx, fwd.RuleName(pod.Namespace, pod.Name), fwd.LegacyRuleName(pod.Namespace, pod.Name))
+		r.recordResult(pod, forwarding.Result{Deleted: deleted, DryRun: fwd.DryRun})
+		if err != nil {
+			r.Recorder.Eventf(pod, v1.EventTypeWarning, ReasonBackendError,
+				"Unable to remove forwards from gateway %s: %v", name, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"atte.cloud/port-forward-controller/internal/forwarding"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// PodForwards is the desired state of the forwards of a pod, as computed by Reconcile.
+type PodForwards struct {
+	// Gateway names the gateway the pod selected
+	Gateway string
+	// RuleName is the name of the rules of the pod on its gateway
+	RuleName string
+	// Forwards are applied unless a rule of someone else holds their external port
+	Forwards []forwarding.PortForward
+	// Conflicts are forwards whose external port is held by an earlier pod
+	Conflicts []forwarding.Conflict
+	// Unsupported are hostPorts whose protocol cannot be forwarded
+	Unsupported []v1.ContainerPort
+	// Reason and Error explain why no forwards are applied at all
+	Reason string
+	Error  error
+}
+
+// Controls reports whether the pod opted in to forwarding.
+func (r *PodReconciler) Controls(ctx context.Context, pod *v1.Pod) bool {
+	return r.controls(ctx, pod)
+}
+
+// Gateway returns the gateway selected by the pod.
+func (r *PodReconciler) Gateway(pod *v1.Pod) (*forwarding.ForwardingReconciler, error) {
+	return r.gateway(pod)
+}
+
+// DesiredForwards computes the forwards Reconcile would apply for the pod without changing
+// anything. External ports the controller has yet to allocate are missing.
+func (r *PodReconciler) DesiredForwards(ctx context.Context, pod *v1.Pod) (PodForwards, error) {
+	desired := PodForwards{Gateway: r.gatewayName(pod), RuleName: r.ruleName(pod)}
+	if _, reason, err := r.validate(pod); err != nil {
+		desired.Reason, desired.Error = reason, err
+		return desired, nil
+	}
+	if _, _, err := externalPorts(pod.Annotations); err != nil {
+		desired.Reason, desired.Error = ReasonAllocationFailed, err
+		return desired, nil
+	}
+	violation, err := r.PolicyViolation(ctx, pod)
+	if err != nil {
+		return desired, err
+	}
+	if violation != "" {
+		desired.Reason, desired.Error = ReasonPolicyDenied, errors.New(violation)
+		return desired, nil
+	}
+
+	_, desired.Unsupported = r.desiredForwards(pod)
+	forwards, conflicts, err := r.claimedForwards(ctx, pod)
+	if err != nil {
+		return desired, err
+	}
+	desired.Forwards, desired.Conflicts = forwards, conflicts
+	return desired, nil
+}
+
+// Disable opts the pod out of forwarding and removes its forwards from every gateway that may
+// hold them.
+func (r *PodReconciler) Disable(ctx context.Context, pod *v1.Pod) error {
+	// Opt out first, so that the controller does not publish the forwards again
+	if err := setAnnotation(ctx, r.Client, pod, EnableAnnotation, "false"); err != nil {
+		return err
+	}
+	if err := r.deleteFromGateways(ctx, pod); err != nil {
+		return err
+	}
+	if !controllerutil.ContainsFinalizer(pod, finalizerName) {
+		return nil
+	}
+	controllerutil.RemoveFinalizer(pod, finalizerName)
+	if err := r.Update(ctx, pod); err != nil {
+		return fmt.Errorf("unable to remove finalizer: %w", err)
+	}
+	return nil
+}
@@ -18,30 +18,68 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/netip"
+	"reflect"
+	"time"
 
+	forwardingv1alpha1 "atte.cloud/port-forward-controller/api/v1alpha1"
 	"atte.cloud/port-forward-controller/internal/forwarding"
 	v1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 )
 
 const Annotation = "port-forward-controller.atte.cloud"
 
+// finalizerName keeps pods around until their forwards are removed.
+const finalizerName = "finalizer." + Annotation + "/v1"
+
+// defaultConflictRetryInterval is how often pods with conflicting forwards are retried, so that
+// they pick up ports released by rules the controller does not watch.
+const defaultConflictRetryInterval = time.Minute
+
+// defaultResyncInterval is how often controlled pods are reconciled again, so that changes on the
+// gateway such as a new WAN address are picked up.
+const defaultResyncInterval = 5 * time.Minute
+
 // PodReconciler reconciles a Pod object
 type PodReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
-	Fwd    *forwarding.ForwardingReconciler
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// Fwd is the default gateway
+	Fwd *forwarding.ForwardingReconciler
+	// Gateways are the other gateways pods can select by name
+	Gateways map[string]*forwarding.ForwardingReconciler
+	// PortRange is the range external ports are allocated from for pods that ask for it
+	PortRange forwarding.PortRange
+	// ReservedPorts are external ports pods may not forward
+	ReservedPorts []forwarding.PortRange
+	// PodSelector opts in the pods it matches, unless nil
+	PodSelector labels.Selector
+	// Protocol overrides the protocol of every forward unless empty or "container"
+	Protocol string
+	// ResyncInterval and ConflictRetryInterval default to defaultResyncInterval and
+	// defaultConflictRetryInterval
+	ResyncInterval        time.Duration
+	ConflictRetryInterval time.Duration
 }
 
-// +kubebuilder:rbac:groups=atte.cloud,resources=pods,verbs=get;list;watch;create;update;patch;delete
-// +kubebuilder:rbac:groups=atte.cloud,resources=pods/status,verbs=get;update;patch
-// +kubebuilder:rbac:groups=atte.cloud,resources=pods/finalizers,verbs=update
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups="",resources=pods/finalizers,verbs=update
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -64,36 +102,88 @@ func (r *PodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 		return ctrl.Result{}, err
 	}
 
-	if !r.controls(&pod) {
+	optedIn, err := r.optedIn(ctx, &pod)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !optedIn {
+		if controllerutil.ContainsFinalizer(&pod, finalizerName) {
+			// The pod opted out, or its namespace or labels no longer opt it in
+			log.Info("Pod opted out, removing its forwards")
+			if err := r.release(ctx, &pod); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
 		return ctrl.Result{}, nil
 	}
 
-	hostPorts := []forwarding.PortForward{}
-	for _, container := range pod.Spec.Containers {
-		// TODO: consider indexed access to the slice to be copy-free
-		// var nodeName string
-		for _, port := range container.Ports {
-			if port.HostPort == 0 {
-				continue
-			}
+	if pod.ObjectMeta.DeletionTimestamp.IsZero() {
+		fwd, reason, err := r.validate(&pod)
+		if err != nil {
+			r.Recorder.Eventf(&pod, v1.EventTypeWarning, reason, "Unable to apply forwards: %v", err)
+			// Fixing the annotation triggers another reconcile
+			return ctrl.Result{}, r.setForwardedCondition(ctx, &pod, v1.ConditionFalse, reason, err.Error())
+		}
 
-			info := forwarding.PortForward{
-				Address: pod.Status.HostIP,
-				Port:    port.HostPort,
-				Name:    fmt.Sprintf("%s-%s", pod.Namespace, pod.Name),
-			}
+		_, unsupported := r.desiredForwards(&pod)
+		if err := r.reportUnsupportedPorts(ctx, &pod, unsupported); err != nil {
+			return ctrl.Result{}, err
+		}
 
-			hostPorts = append(hostPorts, info)
+		if err := r.assignExternalPorts(ctx, &pod, fwd); err != nil {
+			log.Error(err, "Unable to assign external ports")
+			r.Recorder.Eventf(&pod, v1.EventTypeWarning, ReasonAllocationFailed, "Unable to assign external ports: %v", err)
 		}
-	}
 
-	finalizerName := fmt.Sprintf("finalizer.%s/v1", Annotation)
+		// Checked once external ports are allocated, as they must be allowed as well
+		violation, err := r.PolicyViolation(ctx, &pod)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if violation != "" {
+			return ctrl.Result{}, r.denyByPolicy(ctx, &pod, violation)
+		}
 
-	if pod.ObjectMeta.DeletionTimestamp.IsZero() {
-		err := r.Fwd.EnsureAddresses(ctx, hostPorts)
+		hostPorts, conflicts, err := r.claimedForwards(ctx, &pod)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
+		forwarding.RecordConflicts(fwd.Backend, len(conflicts))
+
+		if ids := adoptRules(pod.Annotations); len(ids) > 0 {
+			adopted, err := fwd.AdoptRules(ctx, fwd.RuleName(pod.Namespace, pod.Name), ids)
+			r.recordResult(&pod, forwarding.Result{Adopted: adopted, DryRun: fwd.DryRun})
+			if err != nil {
+				// The forwards are still applied, alongside the rules that were not adopted
+				log.Error(err, "Unable to adopt rules")
+				r.Recorder.Eventf(&pod, v1.EventTypeWarning, ReasonAdoptionFailed, "Unable to adopt rules: %v", err)
+			}
+		}
+
+		result, err := fwd.EnsureAddresses(ctx, fwd.RuleName(pod.Namespace, pod.Name), hostPorts,
+			fwd.LegacyRuleName(pod.Namespace, pod.Name))
+		r.recordResult(&pod, result)
+		if err != nil {
+			reason := ReasonBackendError
+			if errors.Is(err, forwarding.ErrUnsupportedFirewall) {
+				reason = ReasonUnsupportedFirewall
+			}
+			r.Recorder.Eventf(&pod, v1.EventTypeWarning, reason, "Unable to apply forwards: %v", err)
+			if statusErr := r.setForwardedCondition(ctx, &pod, v1.ConditionFalse, reason, err.Error()); statusErr != nil {
+				log.Error(statusErr, "Unable to update pod condition")
+			}
+			return ctrl.Result{}, err
+		}
+		for _, conflict := range result.Conflicts {
+			conflicts = append(conflicts, forwarding.Conflict{
+				Forward: conflict.Forward,
+				Holder:  fmt.Sprintf("router rule %q", conflict.Holder),
+			})
+		}
+		if err = r.leavePreviousGateway(ctx, &pod); err != nil {
+			log.Error(err, "Unable to remove forwards from the previous gateway")
+		}
+
 		if !controllerutil.ContainsFinalizer(&pod, finalizerName) {
 			controllerutil.AddFinalizer(&pod, finalizerName)
 			if err = r.Update(ctx, &pod); err != nil {
@@ -101,36 +191,333 @@ func (r *PodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 			}
 		}
 
-	} else {
-		err := r.Fwd.DeleteAddresses(ctx, hostPorts)
+		if err = r.reportConflicts(ctx, &pod, conflicts); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		// Allocated ports can be lost to a pod or rule we could not see yet; pick another one
+		conflicting := []forwarding.PortForward{}
+		for _, conflict := range conflicts {
+			conflicting = append(conflicting, conflict.Forward)
+		}
+		released, err := r.releaseExternalPorts(ctx, &pod, conflicting)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
+		if released {
+			return ctrl.Result{Requeue: true}, nil
+		}
 
-		if controllerutil.ContainsFinalizer(&pod, finalizerName) {
-			controllerutil.RemoveFinalizer(&pod, finalizerName)
-			if err = r.Update(ctx, &pod); err != nil {
+		applied := []forwarding.PortForward{}
+		for _, forward := range hostPorts {
+			if !containsForward(conflicting, forward) {
+				applied = append(applied, forward)
+			}
+		}
+		if fwd.DryRun {
+			// Nothing is live, so neither publish endpoints nor claim the pod is reachable
+			message := fmt.Sprintf("dry run, %d forwards planned", len(applied))
+			if err = r.setForwardedCondition(ctx, &pod, v1.ConditionFalse, ReasonDryRun, message); err != nil {
+				return ctrl.Result{}, err
+			}
+			log.Info("Reconcile planned")
+			return ctrl.Result{RequeueAfter: orDefault(r.ResyncInterval, defaultResyncInterval)}, nil
+		}
+		if err = r.publishEndpoints(ctx, &pod, fwd, applied); err != nil {
+			log.Error(err, "Unable to publish external endpoints")
+		}
+
+		if len(conflicts) > 0 {
+			message := fmt.Sprintf("%d of %d forwards conflict with other claimants", len(conflicts), len(conflicts)+len(applied))
+			if err = r.setForwardedCondition(ctx, &pod, v1.ConditionFalse, ReasonConflict, message); err != nil {
 				return ctrl.Result{}, err
 			}
+			log.Info("Reconcile finished with conflicts", "conflicts", len(conflicts))
+			return ctrl.Result{RequeueAfter: orDefault(r.ConflictRetryInterval, defaultConflictRetryInterval)}, nil
+		}
+
+		message := fmt.Sprintf("%d forwards are live", len(applied))
+		if err = r.setForwardedCondition(ctx, &pod, v1.ConditionTrue, ReasonForwarded, message); err != nil {
+			return ctrl.Result{}, err
+		}
+		log.Info("Reconcile successful")
+		return ctrl.Result{RequeueAfter: orDefault(r.ResyncInterval, defaultResyncInterval)}, nil
+
+	} else {
+		if err := r.release(ctx, &pod); err != nil {
+			return ctrl.Result{}, err
 		}
 	}
 	log.Info("Reconcile successful")
 	return ctrl.Result{}, nil
 }
 
+// release removes the forwards of a pod that is deleted or opted out, and then its finalizer.
+func (r *PodReconciler) release(ctx context.Context, pod *v1.Pod) error {
+	if err := r.deleteFromGateways(ctx, pod); err != nil {
+		return err
+	}
+	if err := r.unpublishEndpoints(ctx, pod); err != nil {
+		return err
+	}
+
+	if controllerutil.ContainsFinalizer(pod, finalizerName) {
+		controllerutil.RemoveFinalizer(pod, finalizerName)
+		if err := r.Update(ctx, pod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *PodReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&v1.Pod{}).
+		For(&v1.Pod{}, builder.WithPredicates(predicate.NewPredicateFuncs(mayControl))).
+		Watches(&v1.Pod{}, handler.EnqueueRequestsFromMapFunc(r.competingPods),
+			builder.WithPredicates(predicate.NewPredicateFuncs(mayControl))).
+		Watches(&forwardingv1alpha1.ForwardingPolicy{}, handler.EnqueueRequestsFromMapFunc(r.policyPods)).
+		Watches(&v1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.namespacePods),
+			builder.WithPredicates(predicate.Or[client.Object](predicate.LabelChangedPredicate{},
+				predicate.AnnotationChangedPredicate{}))).
 		Named("pod").
 		Complete(r)
 }
 
-func (r *PodReconciler) controls(pod *v1.Pod) bool {
-	for annotation, value := range pod.GetAnnotations() {
-		if annotation == fmt.Sprintf("%s/enable", Annotation) && value == "true" {
+// validate returns the gateway of the pod, or the reason and error of the first annotation that
+// keeps its forwards from being applied.
+func (r *PodReconciler) validate(pod *v1.Pod) (*forwarding.ForwardingReconciler, string, error) {
+	fwd, err := r.gateway(pod)
+	if err != nil {
+		return nil, ReasonUnknownGateway, err
+	}
+	if iface := pod.Annotations[InterfaceAnnotation]; iface != "" {
+		if err = fwd.ValidateInterface(iface); err != nil {
+			return nil, ReasonInvalidInterface, err
+		}
+	}
+	sources, err := sourceRanges(pod.Annotations)
+	if err == nil {
+		err = fwd.ValidateSources(sources)
+	}
+	if err != nil {
+		return nil, ReasonInvalidSourceRanges, err
+	}
+	if err = r.checkReservedPorts(pod); err != nil {
+		return nil, ReasonReservedPort, err
+	}
+	if len(adoptRules(pod.Annotations)) > 0 && !fwd.CanAdoptRules() {
+		return nil, ReasonAdoptionFailed, fmt.Errorf("%s is not supported by gateway %s, which cannot look up rules by ID",
+			AdoptRulesAnnotation, fwd.Backend)
+	}
+	return fwd, "", nil
+}
+
+// controls reports whether the pod opted in to forwarding. Pods that cannot be checked are not
+// controlled.
+func (r *PodReconciler) controls(ctx context.Context, pod *v1.Pod) bool {
+	optedIn, err := r.optedIn(ctx, pod)
+	return err == nil && optedIn
+}
+
+// optedIn reports whether the pod is annotated with enable=true, or has hostPorts and is selected
+// by the pod selector or its namespace. The annotation enable=false always opts the pod out.
+func (r *PodReconciler) optedIn(ctx context.Context, pod *v1.Pod) (bool, error) {
+	if pod == nil {
+		return false, nil
+	}
+	switch pod.Annotations[EnableAnnotation] {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if len(hostPorts(pod)) == 0 {
+		return false, nil
+	}
+	if r.PodSelector != nil && r.PodSelector.Matches(labels.Set(pod.Labels)) {
+		return true, nil
+	}
+
+	var namespace v1.Namespace
+	if err := r.Get(ctx, types.NamespacedName{Name: pod.Namespace}, &namespace); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	return namespace.Labels[EnableAnnotation] == "true" || namespace.Annotations[EnableAnnotation] == "true", nil
+}
+
+// mayControl filters the events of pods that can neither be controlled nor hold forwards, so
+// that pods without hostPorts are not reconciled.
+func mayControl(obj client.Object) bool {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return false
+	}
+	_, annotated := pod.Annotations[EnableAnnotation]
+	return annotated || len(hostPorts(pod)) > 0 || controllerutil.ContainsFinalizer(pod, finalizerName)
+}
+
+// hostPorts returns every container port of the pod that is bound to a hostPort, including
+// those of init containers that run as sidecars. The container ports of pods on the host network
+// are bound to the same port of the node, whether or not they declare the hostPort.
+func hostPorts(pod *v1.Pod) []v1.ContainerPort {
+	ports := []v1.ContainerPort{}
+	containers := pod.Spec.Containers
+	for _, container := range pod.Spec.InitContainers {
+		if container.RestartPolicy != nil && *container.RestartPolicy == v1.ContainerRestartPolicyAlways {
+			containers = append(containers, container)
+		}
+	}
+	for _, container := range containers {
+		for _, port := range container.Ports {
+			if port.HostPort == 0 && pod.Spec.HostNetwork {
+				port.HostPort = port.ContainerPort
+			}
+			if port.HostPort == 0 {
+				continue
+			}
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// selectedPorts returns the hostPorts of the pod that the ports annotation selects and the
+// exclude-ports annotation does not.
+func selectedPorts(pod *v1.Pod) []v1.ContainerPort {
+	include := portSelection(pod.Annotations[PortsAnnotation])
+	exclude := portSelection(pod.Annotations[ExcludePortsAnnotation])
+	ports := []v1.ContainerPort{}
+	for _, port := range hostPorts(pod) {
+		if (len(include) == 0 || selectsPort(include, port)) && !selectsPort(exclude, port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// hostAddresses returns the IPv4 address of the node of the pod and its global IPv6 address, if it
+// has them. Private and link local IPv6 addresses cannot be reached from the internet.
+func hostAddresses(pod *v1.Pod) (string, string) {
+	ips := []string{pod.Status.HostIP}
+	for _, hostIP := range pod.Status.HostIPs {
+		ips = append(ips, hostIP.IP)
+	}
+	ipv4, ipv6 := "", ""
+	for _, ip := range ips {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			continue
+		}
+		switch {
+		case addr.Is4() && ipv4 == "":
+			ipv4 = addr.String()
+		case addr.Is6() && addr.IsGlobalUnicast() && !addr.IsPrivate() && ipv6 == "":
+			ipv6 = addr.String()
+		}
+	}
+	return ipv4, ipv6
+}
+
+// desiredForwards returns a forward for every hostPort declared by the pod, along with the
+// hostPorts that cannot be forwarded because of their protocol. HostPorts still waiting for an
+// external port to be assigned are left out. Pods with a global IPv6 address also get a pinhole
+// for every hostPort, if their gateway manages pinholes.
+func (r *PodReconciler) desiredForwards(pod *v1.Pod) ([]forwarding.PortForward, []v1.ContainerPort) {
+	unsupported := []v1.ContainerPort{}
+	forwards := []forwarding.PortForward{}
+
+	mapping, auto, err := externalPorts(pod.Annotations)
+	if err != nil {
+		return forwards, unsupported
+	}
+	assigned, _ := parsePortMapping(pod.Annotations[AssignedExternalPortsAnnotation], false)
+	// Forwarding without the restrictions the pod asked for would expose it to everyone
+	sources, err := sourceRanges(pod.Annotations)
+	if err != nil {
+		return forwards, unsupported
+	}
+	ipv4, ipv6 := hostAddresses(pod)
+	// The sources of the pod are IPv4 ranges, so restricted pods get no pinholes
+	pinholes := ipv6 != "" && len(sources) == 0 && r.managesPinholes(pod)
+
+	for _, port := range selectedPorts(pod) {
+		protocol, ok := r.protocol(port)
+		if !ok {
+			unsupported = append(unsupported, port)
+			continue
+		}
+
+		if pinholes {
+			forwards = append(forwards, forwarding.PortForward{
+				Family:       forwarding.FamilyIPv6,
+				Address:      ipv6,
+				Port:         port.HostPort,
+				ExternalPort: port.HostPort,
+				Protocol:     protocol,
+				Name:         r.ruleName(pod),
+			})
+		}
+		// IPv6 only nodes have nothing to forward to
+		if ipv4 == "" && ipv6 != "" {
+			continue
+		}
+
+		externalPort := port.HostPort
+		if mapped, ok := mapping[port.HostPort]; ok {
+			externalPort = mapped
+		}
+		if auto || externalPort == autoPort {
+			if externalPort, ok = assigned[port.HostPort]; !ok {
+				continue
+			}
+		}
+
+		info := forwarding.PortForward{
+			Address:      ipv4,
+			Port:         port.HostPort,
+			ExternalPort: externalPort,
+			Protocol:     protocol,
+			Interface:    pod.Annotations[InterfaceAnnotation],
+			Sources:      sources,
+			Name:         r.ruleName(pod),
+		}
+
+		forwards = append(forwards, info)
+	}
+	return forwards, unsupported
+}
+
+func orDefault(interval time.Duration, defaultInterval time.Duration) time.Duration {
+	if interval == 0 {
+		return defaultInterval
+	}
+	return interval
+}
+
+func containsForward(forwards []forwarding.PortForward, forward forwarding.PortForward) bool {
+	for _, other := range forwards {
+		if reflect.DeepEqual(other, forward) {
 			return true
 		}
 	}
 	return false
 }
+
+var protocols = map[v1.Protocol]string{
+	"":             "tcp",
+	v1.ProtocolTCP: "tcp",
+	v1.ProtocolUDP: "udp",
+}
+
+// protocol returns the protocol the port is forwarded with, or false if it cannot be forwarded.
+func (r *PodReconciler) protocol(port v1.ContainerPort) (string, bool) {
+	protocol, ok := protocols[port.Protocol]
+	if !ok {
+		return "", false
+	}
+	if r.Protocol != "" && r.Protocol != "container" {
+		return r.Protocol, true
+	}
+	return protocol, true
+}
@@ -17,16 +17,294 @@ limitations under the License.
 package controller
 
 import (
+	"context"
+	"errors"
+	"strings"
+
 	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	forwardingv1alpha1 "atte.cloud/port-forward-controller/api/v1alpha1"
+	"atte.cloud/port-forward-controller/internal/forwarding"
 )
 
 var _ = Describe("Pod Controller", func() {
 	Context("When reconciling a resource", func() {
+		const podName = "game"
+		key := types.NamespacedName{Namespace: "default", Name: podName}
+		errBackend := errors.New("backend unavailable")
+
+		var (
+			backend    *forwarding.FakeClient
+			reconciler *PodReconciler
+		)
+
+		reconcilePod := func() error {
+			_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			return err
+		}
+
+		forwardedCondition := func() *v1.PodCondition {
+			var pod v1.Pod
+			ExpectWithOffset(1, k8sClient.Get(ctx, key, &pod)).To(Succeed())
+			for i := range pod.Status.Conditions {
+				if pod.Status.Conditions[i].Type == ForwardedCondition {
+					return &pod.Status.Conditions[i]
+				}
+			}
+			return nil
+		}
+
+		BeforeEach(func() {
+			backend = forwarding.NewFakeClient()
+			reconciler = &PodReconciler{
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				Recorder: record.NewFakeRecorder(100),
+				Fwd:      &forwarding.ForwardingReconciler{Client: backend, Backend: "default", RulePrefix: "k8s-"},
+			}
+
+			pod := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        podName,
+					Namespace:   "default",
+					Annotations: map[string]string{EnableAnnotation: "true"},
+				},
+				Spec: v1.PodSpec{Containers: []v1.Container{{
+					Name:  "server",
+					Image: "server",
+					Ports: []v1.ContainerPort{{ContainerPort: 25565, HostPort: 25565, Protocol: v1.ProtocolTCP}},
+				}}},
+			}
+			Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+			pod.Status.HostIP = "10.0.0.1"
+			Expect(k8sClient.Status().Update(ctx, pod)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			var pod v1.Pod
+			if err := k8sClient.Get(ctx, key, &pod); apierrors.IsNotFound(err) {
+				return
+			}
+			controllerutil.RemoveFinalizer(&pod, finalizerName)
+			Expect(k8sClient.Update(ctx, &pod)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, &pod)).To(Succeed())
+		})
 
 		It("should successfully reconcile the resource", func() {
+			Expect(reconcilePod()).To(Succeed())
+			Expect(backend.Forwards()).To(ConsistOf(forwarding.PortForward{
+				Name: "k8s-default-game", Address: "10.0.0.1", Port: 25565, ExternalPort: 25565, Protocol: "tcp",
+			}))
+			Expect(forwardedCondition()).To(HaveField("Status", v1.ConditionTrue))
+
+			By("removing the forwards once the pod is deleted")
+			var pod v1.Pod
+			Expect(k8sClient.Get(ctx, key, &pod)).To(Succeed())
+			Expect(pod.Finalizers).To(ContainElement(finalizerName))
+			Expect(k8sClient.Delete(ctx, &pod)).To(Succeed())
+			Expect(reconcilePod()).To(Succeed())
+			Expect(backend.Forwards()).To(BeEmpty())
+			Expect(apierrors.IsNotFound(k8sClient.Get(ctx, key, &pod))).To(BeTrue())
+		})
+
+		It("should keep the rules on gateways that are members of the new one", func() {
+			office := forwarding.NewFakeClient()
+			reconciler.Gateways = map[string]*forwarding.ForwardingReconciler{
+				"office": {Client: office, Backend: "office", RulePrefix: "k8s-"},
+				"edge": {Backend: "edge", RulePrefix: "k8s-", Client: &forwarding.MirrorClient{
+					Policy:  forwarding.MirrorAll,
+					Members: []forwarding.MirrorMember{{Name: "default", Client: backend}, {Name: "office", Client: office}},
+				}},
+			}
+			selectGateway := func(name string) {
+				var pod v1.Pod
+				ExpectWithOffset(1, k8sClient.Get(ctx, key, &pod)).To(Succeed())
+				pod.Annotations[GatewayAnnotation] = name
+				ExpectWithOffset(1, k8sClient.Update(ctx, &pod)).To(Succeed())
+			}
+
+			Expect(reconcilePod()).To(Succeed())
+			Expect(backend.Forwards()).To(HaveLen(1))
+
+			By("moving the pod from the default gateway to a mirror of it")
+			selectGateway("edge")
+			Expect(reconcilePod()).To(Succeed())
+			Expect(backend.Forwards()).To(HaveLen(1))
+			Expect(office.Forwards()).To(HaveLen(1))
+
+			By("moving the pod back to the default gateway")
+			selectGateway("default")
+			Expect(reconcilePod()).To(Succeed())
+			Expect(backend.Forwards()).To(HaveLen(1))
+			Expect(office.Forwards()).To(BeEmpty())
+		})
+
+		It("should only allocate external ports the policies allow", func() {
+			policy := &forwardingv1alpha1.ForwardingPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "high-ports"},
+				Spec:       forwardingv1alpha1.ForwardingPolicySpec{ExternalPorts: []string{"30500-31999"}},
+			}
+			Expect(k8sClient.Create(ctx, policy)).To(Succeed())
+			DeferCleanup(k8sClient.Delete, ctx, policy)
+			reconciler.PortRange = forwarding.PortRange{First: 30000, Last: 30999}
 
-			// TODO(user): Add more specific assertions depending on your controller's reconciliation logic.
-			// Example: If you expect a certain status condition after reconciliation, verify it here.
+			var pod v1.Pod
+			Expect(k8sClient.Get(ctx, key, &pod)).To(Succeed())
+			pod.Annotations[ExternalPortAnnotation] = "auto"
+			Expect(k8sClient.Update(ctx, &pod)).To(Succeed())
+
+			Expect(reconcilePod()).To(Succeed())
+			Expect(backend.Forwards()).To(ConsistOf(HaveField("ExternalPort", int32(30500))))
+			Expect(forwardedCondition()).To(HaveField("Status", v1.ConditionTrue))
+		})
+
+		It("should only report unsupported protocols when they change", func() {
+			recorder := record.NewFakeRecorder(100)
+			reconciler.Recorder = recorder
+			pod := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "voice",
+					Namespace:   "default",
+					Annotations: map[string]string{EnableAnnotation: "true"},
+				},
+				Spec: v1.PodSpec{Containers: []v1.Container{{
+					Name:  "server",
+					Image: "server",
+					Ports: []v1.ContainerPort{
+						{ContainerPort: 5060, HostPort: 5060, Protocol: v1.ProtocolUDP},
+						{ContainerPort: 5061, HostPort: 5061, Protocol: v1.ProtocolSCTP},
+					},
+				}}},
+			}
+			Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+			DeferCleanup(func() {
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(pod), pod)).To(Succeed())
+				controllerutil.RemoveFinalizer(pod, finalizerName)
+				Expect(k8sClient.Update(ctx, pod)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, pod)).To(Succeed())
+			})
+			pod.Status.HostIP = "10.0.0.1"
+			Expect(k8sClient.Status().Update(ctx, pod)).To(Succeed())
+
+			for range 2 {
+				_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(pod)})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			unsupported := []string{}
+			for len(recorder.Events) > 0 {
+				if event := <-recorder.Events; strings.Contains(event, ReasonUnsupportedProtocol) {
+					unsupported = append(unsupported, event)
+				}
+			}
+			Expect(unsupported).To(ConsistOf(ContainSubstring("HostPort 5061 uses protocol SCTP")))
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(pod), pod)).To(Succeed())
+			Expect(pod.Annotations).To(HaveKeyWithValue(UnsupportedPortsAnnotation, "5061/sctp"))
+		})
+
+		It("should reject adopting rules on mirror gateways", func() {
+			office := forwarding.NewFakeClient()
+			reconciler.Gateways = map[string]*forwarding.ForwardingReconciler{
+				"edge": {Backend: "edge", RulePrefix: "k8s-", Client: &forwarding.MirrorClient{
+					Policy:  forwarding.MirrorAll,
+					Members: []forwarding.MirrorMember{{Name: "default", Client: backend}, {Name: "office", Client: office}},
+				}},
+			}
+			var pod v1.Pod
+			Expect(k8sClient.Get(ctx, key, &pod)).To(Succeed())
+			pod.Annotations[GatewayAnnotation] = "edge"
+			pod.Annotations[AdoptRulesAnnotation] = "5f1b2c3d4e5f6a7b8c9d0e1f"
+			Expect(k8sClient.Update(ctx, &pod)).To(Succeed())
+
+			Expect(reconcilePod()).To(Succeed())
+			Expect(forwardedCondition()).To(And(
+				HaveField("Status", v1.ConditionFalse),
+				HaveField("Reason", ReasonAdoptionFailed),
+				HaveField("Message", ContainSubstring("cannot look up rules by ID")),
+			))
+			Expect(backend.Forwards()).To(BeEmpty())
+			Expect(office.Forwards()).To(BeEmpty())
+
+			Expect(k8sClient.Get(ctx, key, &pod)).To(Succeed())
+			Expect(reconciler.CheckPod(ctx, &pod)).To(MatchError(ContainSubstring("cannot look up rules by ID")))
+		})
+
+		It("should remove the endpoints of pods that opt out", func() {
+			reconciler.Fwd.Client = wanClient{FakeClient: backend}
+			labels := map[string]string{"app": "web"}
+			template := v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "web", Image: "web"}}},
+			}
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: labels},
+					Template: template,
+				},
+			}
+			Expect(k8sClient.Create(ctx, deployment)).To(Succeed())
+			DeferCleanup(k8sClient.Delete, ctx, deployment)
+			replicaSet := &appsv1.ReplicaSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "default", Labels: labels},
+				Spec: appsv1.ReplicaSetSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: labels},
+					Template: template,
+				},
+			}
+			Expect(controllerutil.SetControllerReference(deployment, replicaSet, k8sClient.Scheme())).To(Succeed())
+			Expect(k8sClient.Create(ctx, replicaSet)).To(Succeed())
+			DeferCleanup(k8sClient.Delete, ctx, replicaSet)
+
+			var pod v1.Pod
+			Expect(k8sClient.Get(ctx, key, &pod)).To(Succeed())
+			Expect(controllerutil.SetControllerReference(replicaSet, &pod, k8sClient.Scheme())).To(Succeed())
+			Expect(k8sClient.Update(ctx, &pod)).To(Succeed())
+
+			Expect(reconcilePod()).To(Succeed())
+			Expect(k8sClient.Get(ctx, key, &pod)).To(Succeed())
+			Expect(pod.Annotations).To(HaveKeyWithValue(ExternalEndpointsAnnotation, `["203.0.113.1:25565/tcp"]`))
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), deployment)).To(Succeed())
+			Expect(deployment.Annotations).To(HaveKeyWithValue(ExternalEndpointsAnnotation, `["203.0.113.1:25565/tcp"]`))
+
+			By("opting the pod out")
+			pod.Annotations[EnableAnnotation] = "false"
+			Expect(k8sClient.Update(ctx, &pod)).To(Succeed())
+			Expect(reconcilePod()).To(Succeed())
+			Expect(backend.Forwards()).To(BeEmpty())
+			Expect(k8sClient.Get(ctx, key, &pod)).To(Succeed())
+			Expect(pod.Annotations).NotTo(HaveKey(ExternalEndpointsAnnotation))
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(deployment), deployment)).To(Succeed())
+			Expect(deployment.Annotations).NotTo(HaveKey(ExternalEndpointsAnnotation))
+		})
+
+		It("should report backend errors and recover from them", func() {
+			backend.FailCall(1, forwarding.Fault{Err: errBackend})
+			Expect(reconcilePod()).To(MatchError(errBackend))
+			Expect(backend.Forwards()).To(BeEmpty())
+			Expect(forwardedCondition()).To(HaveField("Reason", ReasonBackendError))
+
+			Expect(reconcilePod()).To(Succeed())
+			Expect(backend.Forwards()).To(HaveLen(1))
+			Expect(forwardedCondition()).To(HaveField("Status", v1.ConditionTrue))
 		})
 	})
 })
+
+// wanClient is a FakeClient that reports the address of the WAN uplink.
+type wanClient struct {
+	*forwarding.FakeClient
+}
+
+func (c wanClient) WANAddress(context.Context) (string, error) {
+	return "203.0.113.1", nil
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	forwardingv1alpha1 "atte.cloud/port-forward-controller/api/v1alpha1"
+	"atte.cloud/port-forward-controller/internal/forwarding"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// +kubebuilder:rbac:groups=forwarding.atte.cloud,resources=forwardingpolicies,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+// PolicyViolation returns why no ForwardingPolicy allows the forwards of the pod, or an empty
+// string if one does. Pods are not restricted while no policies exist.
+func (r *PodReconciler) PolicyViolation(ctx context.Context, pod *v1.Pod) (string, error) {
+	var policies forwardingv1alpha1.ForwardingPolicyList
+	if err := r.List(ctx, &policies); err != nil {
+		if meta.IsNoMatchError(err) {
+			// The CRD is not installed
+			return "", nil
+		}
+		return "", err
+	}
+	if len(policies.Items) == 0 {
+		return "", nil
+	}
+	selecting, err := r.selectingPolicies(ctx, pod, policies.Items)
+	if err != nil {
+		return "", err
+	}
+
+	violations := []string{}
+	for i := range selecting {
+		policy := &selecting[i]
+		violation, err := r.policyViolation(ctx, policy, pod)
+		if err != nil {
+			return "", err
+		}
+		if violation == "" {
+			return "", nil
+		}
+		violations = append(violations, fmt.Sprintf("policy %s: %s", policy.Name, violation))
+	}
+	if len(violations) == 0 {
+		return fmt.Sprintf("no forwarding policy selects namespace %s", pod.Namespace), nil
+	}
+	return strings.Join(violations, "; "), nil
+}
+
+// allowedExternalPorts returns the external ports the policies selecting the namespace of the pod
+// allow, or nil if they allow any port or no policy selects it.
+func (r *PodReconciler) allowedExternalPorts(ctx context.Context, pod *v1.Pod) ([]forwarding.PortRange, error) {
+	var policies forwardingv1alpha1.ForwardingPolicyList
+	if err := r.List(ctx, &policies); err != nil {
+		if meta.IsNoMatchError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(policies.Items) == 0 {
+		return nil, nil
+	}
+	selecting, err := r.selectingPolicies(ctx, pod, policies.Items)
+	if err != nil || len(selecting) == 0 {
+		return nil, err
+	}
+
+	allowed := []forwarding.PortRange{}
+	for _, policy := range selecting {
+		if len(policy.Spec.ExternalPorts) == 0 {
+			return nil, nil
+		}
+		for _, ports := range policy.Spec.ExternalPorts {
+			if portRange, err := forwarding.ParsePortRange(ports); err == nil && !portRange.IsEmpty() {
+				allowed = append(allowed, portRange)
+			}
+		}
+	}
+	sort.Slice(allowed, func(i, j int) bool { return allowed[i].First < allowed[j].First })
+	return allowed, nil
+}
+
+// selectingPolicies returns the policies selecting the namespace of the pod, sorted by name.
+func (r *PodReconciler) selectingPolicies(ctx context.Context, pod *v1.Pod,
+	policies []forwardingv1alpha1.ForwardingPolicy) ([]forwardingv1alpha1.ForwardingPolicy, error) {
+	var namespace v1.Namespace
+	if err := r.Get(ctx, types.NamespacedName{Name: pod.Namespace}, &namespace); err != nil {
+		return nil, err
+	}
+
+	selecting := []forwardingv1alpha1.ForwardingPolicy{}
+	for _, policy := range policies {
+		selector, err := metav1.LabelSelectorAsSelector(&policy.Spec.NamespaceSelector)
+		if err == nil && selector.Matches(labels.Set(namespace.Labels)) {
+			selecting = append(selecting, policy)
+		}
+	}
+	sort.Slice(selecting, func(i, j int) bool { return selecting[i].Name < selecting[j].Name })
+	return selecting, nil
+}
+
+// policyViolation returns why the policy does not allow the forwards of the pod, if it does not.
+func (r *PodReconciler) policyViolation(ctx context.Context, policy *forwardingv1alpha1.ForwardingPolicy, pod *v1.Pod) (string, error) {
+	forwards, _ := r.desiredForwards(pod)
+	for _, forward := range forwards {
+		if !policyAllowsPort(policy, forward.ExternalPort) {
+			return fmt.Sprintf("external port %d is not allowed", forward.ExternalPort), nil
+		}
+		if !policyAllowsProtocol(policy, forward.Protocol) {
+			return fmt.Sprintf("protocol %s is not allowed", forward.Protocol), nil
+		}
+		if policy.Spec.RequireSourceRanges && len(forward.Sources) == 0 {
+			return fmt.Sprintf("external port %s must be restricted with %s", forward, SourceRangesAnnotation), nil
+		}
+	}
+
+	if policy.Spec.MaxForwardsPerNamespace == nil {
+		return "", nil
+	}
+	var pods v1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(pod.Namespace)); err != nil {
+		return "", err
+	}
+	count := gatewayForwards(forwards)
+	for i := range pods.Items {
+		other := &pods.Items[i]
+		if other.Name == pod.Name || !other.DeletionTimestamp.IsZero() || !r.controls(ctx, other) || policyDenied(other) {
+			continue
+		}
+		// Pods being admitted have no creation time yet and come last
+		if pod.CreationTimestamp.IsZero() || claimsBefore(other, pod) {
+			otherForwards, _ := r.desiredForwards(other)
+			count += gatewayForwards(otherForwards)
+		}
+	}
+	if limit := *policy.Spec.MaxForwardsPerNamespace; int32(count) > limit {
+		return fmt.Sprintf("namespace %s may only forward %d ports", pod.Namespace, limit), nil
+	}
+	return "", nil
+}
+
+// gatewayForwards counts the forwards that hold a port of the gateway, leaving out pinholes.
+func gatewayForwards(forwards []forwarding.PortForward) int {
+	count := 0
+	for _, forward := range forwards {
+		if !forward.IsPinhole() {
+			count++
+		}
+	}
+	return count
+}
+
+func policyAllowsPort(policy *forwardingv1alpha1.ForwardingPolicy, port int32) bool {
+	if len(policy.Spec.ExternalPorts) == 0 {
+		return true
+	}
+	for _, allowed := range policy.Spec.ExternalPorts {
+		// Invalid ranges are rejected by the webhook and allow nothing
+		portRange, err := forwarding.ParsePortRange(allowed)
+		if err == nil && portRange.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func policyAllowsProtocol(policy *forwardingv1alpha1.ForwardingPolicy, protocol string) bool {
+	if len(policy.Spec.Protocols) == 0 {
+		return true
+	}
+	allowed := map[string]bool{}
+	for _, p := range policy.Spec.Protocols {
+		allowed[string(p)] = true
+		if p == forwardingv1alpha1.ProtocolTCPUDP {
+			allowed["tcp"], allowed["udp"] = true, true
+		}
+	}
+	if protocol == "tcp_udp" {
+		return allowed["tcp"] && allowed["udp"]
+	}
+	return allowed[protocol]
+}
+
+// denyByPolicy removes the forwards of the pod a policy does not allow. Changes to the policies or
+// to the labels of the namespace trigger another reconcile.
+func (r *PodReconciler) denyByPolicy(ctx context.Context, pod *v1.Pod, violation string) error {
+	r.Recorder.Eventf(pod, v1.EventTypeWarning, ReasonPolicyDenied, "Forwards are not allowed: %s", violation)
+	if err := r.deleteFromGateways(ctx, pod); err != nil {
+		return err
+	}
+	return r.setForwardedCondition(ctx, pod, v1.ConditionFalse, ReasonPolicyDenied, violation)
+}
+
+// policyDenied reports whether the forwards of the pod were withheld because of a policy, in
+// which case they do not count against the limits of its namespace.
+func policyDenied(pod *v1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == ForwardedCondition {
+			return condition.Reason == ReasonPolicyDenied
+		}
+	}
+	return false
+}
+
+// policyPods maps a policy event to every controlled pod, as any of them may now be allowed or
+// denied.
+func (r *PodReconciler) policyPods(ctx context.Context, _ client.Object) []reconcile.Request {
+	return r.controlledPods(ctx)
+}
+
+// namespacePods maps a namespace event to the controlled pods in the namespace, whose opt-in and
+// policies may have changed with its labels and annotations.
+func (r *PodReconciler) namespacePods(ctx context.Context, obj client.Object) []reconcile.Request {
+	return r.controlledPods(ctx, client.InNamespace(obj.GetName()))
+}
+
+// controlledPods returns the pods that are controlled or still hold forwards, so that pods that
+// opted out give them up.
+func (r *PodReconciler) controlledPods(ctx context.Context, opts ...client.ListOption) []reconcile.Request {
+	var pods v1.PodList
+	if err := r.List(ctx, &pods, opts...); err != nil {
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for i := range pods.Items {
+		if r.controls(ctx, &pods.Items[i]) || controllerutil.ContainsFinalizer(&pods.Items[i], finalizerName) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&pods.Items[i])})
+		}
+	}
+	return requests
+}
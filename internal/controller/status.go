@@ -0,0 +1,163 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"atte.cloud/port-forward-controller/internal/forwarding"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// ForwardedCondition is the pod condition reporting whether all forwards of the pod are live.
+// Pods can list it as a readiness gate to only become ready once they are reachable.
+const ForwardedCondition v1.PodConditionType = Annotation + "/Forwarded"
+
+// Reasons used for events and the forwarded condition.
+const (
+	ReasonAdopted             = "RuleAdopted"
+	ReasonAdoptionFailed      = "RuleAdoptionFailed"
+	ReasonCreated             = "ForwardCreated"
+	ReasonUpdated             = "ForwardUpdated"
+	ReasonDeleted             = "ForwardDeleted"
+	ReasonConflict            = "PortConflict"
+	ReasonBackendError        = "BackendError"
+	ReasonUnsupportedFirewall = "UnsupportedFirewall"
+	ReasonUnsupportedProtocol = "UnsupportedProtocol"
+	ReasonAllocationFailed    = "PortAllocationFailed"
+	ReasonUnknownGateway      = "UnknownGateway"
+	ReasonInvalidInterface    = "InvalidInterface"
+	ReasonInvalidSourceRanges = "InvalidSourceRanges"
+	ReasonReservedPort        = "ReservedPort"
+	ReasonPolicyDenied        = "ForbiddenByPolicy"
+	ReasonForwarded           = "Forwarded"
+	ReasonPlanned             = "ForwardPlanned"
+	ReasonDryRun              = "DryRun"
+)
+
+// +kubebuilder:rbac:groups="",resources=pods/status,verbs=get;update;patch
+
+// recordResult emits an event for every rule changed by EnsureAddresses and every mirror member
+// that failed to apply them. In dry run mode the planned changes are reported instead.
+func (r *PodReconciler) recordResult(pod *v1.Pod, result forwarding.Result) {
+	if result.DryRun {
+		r.recordPlan(pod, result)
+		return
+	}
+	for _, rule := range result.Adopted {
+		r.Recorder.Eventf(pod, v1.EventTypeNormal, ReasonAdopted,
+			"Adopted router rule %q forwarding external port %s to %s", rule.Name, rule, forwardTarget(rule))
+	}
+	for _, forward := range result.Created {
+		r.Recorder.Eventf(pod, v1.EventTypeNormal, ReasonCreated,
+			"Forwarding external port %s to %s", forward, forwardTarget(forward))
+	}
+	for _, forward := range result.Updated {
+		r.Recorder.Eventf(pod, v1.EventTypeNormal, ReasonUpdated,
+			"Updated forward of external port %s to %s", forward, forwardTarget(forward))
+	}
+	for _, forward := range result.Deleted {
+		r.Recorder.Eventf(pod, v1.EventTypeNormal, ReasonDeleted,
+			"Stopped forwarding external port %s to %s", forward, forwardTarget(forward))
+	}
+	for member, err := range result.MemberErrors {
+		r.Recorder.Eventf(pod, v1.EventTypeWarning, ReasonBackendError,
+			"Unable to apply forwards on mirror member %s: %v", member, err)
+	}
+}
+
+func (r *PodReconciler) recordPlan(pod *v1.Pod, result forwarding.Result) {
+	for _, rule := range result.Adopted {
+		r.Recorder.Eventf(pod, v1.EventTypeNormal, ReasonPlanned,
+			"Dry run: would adopt router rule %q forwarding external port %s to %s", rule.Name, rule, forwardTarget(rule))
+	}
+	for _, forward := range result.Created {
+		r.Recorder.Eventf(pod, v1.EventTypeNormal, ReasonPlanned,
+			"Dry run: would forward external port %s to %s", forward, forwardTarget(forward))
+	}
+	for _, forward := range result.Updated {
+		r.Recorder.Eventf(pod, v1.EventTypeNormal, ReasonPlanned,
+			"Dry run: would update forward of external port %s to %s", forward, forwardTarget(forward))
+	}
+	for _, forward := range result.Deleted {
+		r.Recorder.Eventf(pod, v1.EventTypeNormal, ReasonPlanned,
+			"Dry run: would stop forwarding external port %s to %s", forward, forwardTarget(forward))
+	}
+}
+
+// reportUnsupportedPorts records an event for every hostPort whose protocol cannot be forwarded and
+// keeps the unsupported ports annotation of the pod in sync. The events are only recorded when the
+// ports change, rather than on every reconcile.
+func (r *PodReconciler) reportUnsupportedPorts(ctx context.Context, pod *v1.Pod, unsupported []v1.ContainerPort) error {
+	ports := []string{}
+	for _, port := range unsupported {
+		ports = append(ports, fmt.Sprintf("%d/%s", port.HostPort, strings.ToLower(string(port.Protocol))))
+	}
+	value := strings.Join(ports, ",")
+	if pod.Annotations[UnsupportedPortsAnnotation] == value {
+		return nil
+	}
+
+	for _, port := range unsupported {
+		log.FromContext(ctx).Info("Skipping port with unsupported protocol", "port", port.HostPort, "protocol", port.Protocol)
+		r.Recorder.Eventf(pod, v1.EventTypeWarning, ReasonUnsupportedProtocol,
+			"HostPort %d uses protocol %s, which cannot be forwarded", port.HostPort, port.Protocol)
+	}
+	return setAnnotation(ctx, r.Client, pod, UnsupportedPortsAnnotation, value)
+}
+
+// forwardTarget returns the address and port traffic is forwarded to.
+func forwardTarget(forward forwarding.PortForward) string {
+	return net.JoinHostPort(forward.Address, fmt.Sprint(forward.Port))
+}
+
+// setForwardedCondition updates the forwarded condition of the pod.
+func (r *PodReconciler) setForwardedCondition(ctx context.Context, pod *v1.Pod, status v1.ConditionStatus, reason string, message string) error {
+	condition := v1.PodCondition{
+		Type:    ForwardedCondition,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	}
+
+	for i, existing := range pod.Status.Conditions {
+		if existing.Type != ForwardedCondition {
+			continue
+		}
+		if existing.Status == status && existing.Reason == reason && existing.Message == message {
+			return nil
+		}
+		patch := client.StrategicMergeFrom(pod.DeepCopy())
+		condition.LastTransitionTime = existing.LastTransitionTime
+		if existing.Status != status {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		pod.Status.Conditions[i] = condition
+		return r.Status().Patch(ctx, pod, patch)
+	}
+
+	patch := client.StrategicMergeFrom(pod.DeepCopy())
+	condition.LastTransitionTime = metav1.Now()
+	pod.Status.Conditions = append(pod.Status.Conditions, condition)
+	return r.Status().Patch(ctx, pod, patch)
+}
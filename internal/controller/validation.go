@@ -0,0 +1,156 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// userAnnotations are the annotations users set on pods; the others are managed by the controller.
+var userAnnotations = []string{
+	EnableAnnotation,
+	ExternalPortAnnotation,
+	InterfaceAnnotation,
+	SourceRangesAnnotation,
+	GatewayAnnotation,
+	PortsAnnotation,
+	ExcludePortsAnnotation,
+	AdoptRulesAnnotation,
+}
+
+var knownAnnotations = append([]string{
+	ConflictsAnnotation,
+	UnsupportedPortsAnnotation,
+	AssignedExternalPortsAnnotation,
+	ExternalEndpointsAnnotation,
+	AppliedGatewayAnnotation,
+}, userAnnotations...)
+
+// checkReservedPorts returns an error if the pod forwards a reserved external port.
+func (r *PodReconciler) checkReservedPorts(pod *v1.Pod) error {
+	forwards, _ := r.desiredForwards(pod)
+	for _, forward := range forwards {
+		// Pinholes do not use the ports of the gateway
+		if forward.IsPinhole() {
+			continue
+		}
+		for _, reserved := range r.ReservedPorts {
+			if reserved.Contains(forward.ExternalPort) {
+				return fmt.Errorf("external port %d is reserved", forward.ExternalPort)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckPod returns every problem with the forwarding annotations of the pod.
+func (r *PodReconciler) CheckPod(ctx context.Context, pod *v1.Pod) error {
+	var errs []error
+	keys := []string{}
+	for key := range pod.Annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		known := false
+		for _, annotation := range knownAnnotations {
+			known = known || key == annotation
+		}
+		if strings.HasPrefix(key, Annotation+"/") && !known {
+			errs = append(errs, fmt.Errorf("unknown annotation %s", key))
+		}
+	}
+	if value, ok := pod.Annotations[EnableAnnotation]; ok && value != "true" && value != "false" {
+		errs = append(errs, fmt.Errorf("%s must be true or false, got %q", EnableAnnotation, value))
+	}
+	if !r.controls(ctx, pod) {
+		return errors.Join(errs...)
+	}
+
+	if len(hostPorts(pod)) == 0 {
+		errs = append(errs, fmt.Errorf("the pod opts in to forwarding but has no hostPorts"))
+	}
+	if _, _, err := externalPorts(pod.Annotations); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", ExternalPortAnnotation, err))
+	}
+	for _, annotation := range []string{PortsAnnotation, ExcludePortsAnnotation} {
+		for _, entry := range portSelection(pod.Annotations[annotation]) {
+			if !selectsAny(entry, hostPorts(pod)) {
+				errs = append(errs, fmt.Errorf("%s: no hostPort is named or numbered %q", annotation, entry))
+			}
+		}
+	}
+	if len(hostPorts(pod)) > 0 && len(selectedPorts(pod)) == 0 {
+		errs = append(errs, fmt.Errorf("%s and %s select none of the hostPorts", PortsAnnotation, ExcludePortsAnnotation))
+	}
+	if _, _, err := r.validate(pod); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func selectsAny(entry string, ports []v1.ContainerPort) bool {
+	for _, port := range ports {
+		if selectsPort([]string{entry}, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// UserAnnotationsChanged reports whether the annotations users set differ between both pods.
+func UserAnnotationsChanged(a *v1.Pod, b *v1.Pod) bool {
+	for _, annotation := range userAnnotations {
+		if a.Annotations[annotation] != b.Annotations[annotation] {
+			return true
+		}
+	}
+	return false
+}
+
+// LikelyConflicts describes the forwards of the pod whose external ports other controlled pods on
+// the same gateway already claim.
+func (r *PodReconciler) LikelyConflicts(ctx context.Context, pod *v1.Pod) ([]string, error) {
+	if !r.controls(ctx, pod) {
+		return nil, nil
+	}
+	conflicts := []string{}
+	forwards, _ := r.desiredForwards(pod)
+	if len(forwards) == 0 {
+		return conflicts, nil
+	}
+	var pods v1.PodList
+	if err := r.List(ctx, &pods); err != nil {
+		return nil, err
+	}
+
+	others := r.claimants(ctx, pod, pods.Items)
+	for _, forward := range forwards {
+		if other := claimedBy(forward, others); other != nil {
+			conflicts = append(conflicts, fmt.Sprintf("external port %s is already claimed by pod %s",
+				forward, client.ObjectKeyFromObject(other)))
+		}
+	}
+	return conflicts, nil
+}
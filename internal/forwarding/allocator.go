@@ -0,0 +1,129 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarding
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of external ports available for automatic allocation.
+// The zero value is an empty range.
+type PortRange struct {
+	First int32
+	Last  int32
+}
+
+// ParsePortRange parses a range such as "30000-30999". An empty string yields an empty range.
+func ParsePortRange(s string) (PortRange, error) {
+	if s == "" {
+		return PortRange{}, nil
+	}
+
+	first, last, found := strings.Cut(s, "-")
+	if !found {
+		last = first
+	}
+	firstPort, err := ParsePort(first)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	lastPort, err := ParsePort(last)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	if firstPort > lastPort {
+		return PortRange{}, fmt.Errorf("invalid port range %q: first port is above last port", s)
+	}
+	return PortRange{First: firstPort, Last: lastPort}, nil
+}
+
+// ParsePortList parses a comma separated list of ports and ranges such as "80,443,8000-8099".
+func ParsePortList(s string) ([]PortRange, error) {
+	ranges := []PortRange{}
+	for _, part := range strings.Split(s, ",") {
+		pr, err := ParsePortRange(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		if pr.IsEmpty() {
+			return nil, fmt.Errorf("invalid port list %q", s)
+		}
+		ranges = append(ranges, pr)
+	}
+	return ranges, nil
+}
+
+// FormatPortList formats ranges the way ParsePortList parses them.
+func FormatPortList(ranges []PortRange) string {
+	parts := make([]string, 0, len(ranges))
+	for _, pr := range ranges {
+		if pr.First == pr.Last {
+			parts = append(parts, strconv.Itoa(int(pr.First)))
+		} else {
+			parts = append(parts, pr.String())
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (pr PortRange) IsEmpty() bool {
+	return pr.First == 0
+}
+
+func (pr PortRange) Contains(port int32) bool {
+	return !pr.IsEmpty() && port >= pr.First && port <= pr.Last
+}
+
+// Intersect returns the ports in both ranges, or an empty range if they do not overlap.
+func (pr PortRange) Intersect(other PortRange) PortRange {
+	first, last := max(pr.First, other.First), min(pr.Last, other.Last)
+	if pr.IsEmpty() || other.IsEmpty() || first > last {
+		return PortRange{}
+	}
+	return PortRange{First: first, Last: last}
+}
+
+func (pr PortRange) String() string {
+	return fmt.Sprintf("%d-%d", pr.First, pr.Last)
+}
+
+// Allocate returns the lowest port of the range that none of the used forwards hold for protocol.
+func (pr PortRange) Allocate(protocol string, used []PortForward) (int32, error) {
+	if pr.IsEmpty() {
+		return 0, fmt.Errorf("no external port range is configured")
+	}
+	for port := pr.First; port <= pr.Last; port++ {
+		if _, taken := overlapping(PortForward{ExternalPort: port, Protocol: protocol}, used); !taken {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free external port left in range %s", pr)
+}
+
+// ParsePort parses a single port number between 1 and 65535.
+func ParsePort(s string) (int32, error) {
+	port, err := strconv.ParseInt(strings.TrimSpace(s), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d is out of range", port)
+	}
+	return int32(port), nil
+}
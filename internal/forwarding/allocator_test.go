@@ -0,0 +1,76 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarding
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PortRange", func() {
+	It("should parse ranges and single ports", func() {
+		Expect(ParsePortRange("30000-30010")).To(Equal(PortRange{First: 30000, Last: 30010}))
+		Expect(ParsePortRange("30000")).To(Equal(PortRange{First: 30000, Last: 30000}))
+		Expect(ParsePortRange("")).To(Equal(PortRange{}))
+	})
+
+	It("should reject malformed ranges", func() {
+		for _, value := range []string{"30010-30000", "0-10", "a-b", "1-70000"} {
+			_, err := ParsePortRange(value)
+			Expect(err).To(HaveOccurred(), value)
+		}
+	})
+
+	It("should parse lists of ports and ranges", func() {
+		ranges, err := ParsePortList("80, 443,8000-8099")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ranges).To(Equal([]PortRange{{First: 80, Last: 80}, {First: 443, Last: 443}, {First: 8000, Last: 8099}}))
+		Expect(FormatPortList(ranges)).To(Equal("80,443,8000-8099"))
+		_, err = ParsePortList("80,,443")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should intersect ranges", func() {
+		pr := PortRange{First: 30000, Last: 30999}
+		Expect(pr.Intersect(PortRange{First: 30500, Last: 31999})).To(Equal(PortRange{First: 30500, Last: 30999}))
+		Expect(pr.Intersect(PortRange{First: 443, Last: 443})).To(Equal(PortRange{}))
+		Expect(pr.Intersect(PortRange{})).To(Equal(PortRange{}))
+	})
+
+	It("should allocate the lowest free port", func() {
+		pr := PortRange{First: 30000, Last: 30002}
+		used := []PortForward{
+			{ExternalPort: 30000, Protocol: "tcp_udp"},
+			{ExternalPort: 30001, Protocol: "udp"},
+		}
+		Expect(pr.Allocate("tcp", used)).To(Equal(int32(30001)))
+		Expect(pr.Allocate("udp", used)).To(Equal(int32(30002)))
+	})
+
+	It("should skip reserved ranges", func() {
+		pr := PortRange{First: 30000, Last: 30999}
+		used := []PortForward{{ExternalPorts: []PortRange{{First: 1, Last: 30499}}, Protocol: "tcp_udp"}}
+		Expect(pr.Allocate("udp", used)).To(Equal(int32(30500)))
+	})
+
+	It("should fail when the range is exhausted or empty", func() {
+		_, err := PortRange{First: 30000, Last: 30000}.Allocate("tcp", []PortForward{{ExternalPort: 30000, Protocol: "tcp"}})
+		Expect(err).To(HaveOccurred())
+		_, err = PortRange{}.Allocate("tcp", nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,282 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package conformance holds Ginkgo specs every forwarding.Client implementation has to pass. They
+// cover the semantics the ForwardingReconciler relies on: listing what was created, updating and
+// deleting single rules, leaving the rules of other owners alone and converging without changes
+// once the rules match, also after a batch was only partly applied.
+package conformance
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/types"
+
+	"atte.cloud/port-forward-controller/internal/forwarding"
+)
+
+// DescribeClient registers the conformance specs of a Client implementation:
+//
+//	var _ = conformance.DescribeClient("FakeClient", func() forwarding.Client {
+//		return forwarding.NewFakeClient()
+//	})
+//
+// newClient is called before every spec and must return a client of a backend without rules.
+func DescribeClient(name string, newClient func() forwarding.Client) bool {
+	return Describe(name+" conformance", func() {
+		var (
+			ctx    context.Context
+			client forwarding.Client
+		)
+
+		forward := func(name string, port int32, protocol string) forwarding.PortForward {
+			return forwarding.PortForward{Name: name, Address: "10.0.0.1", Port: port, ExternalPort: port, Protocol: protocol}
+		}
+
+		list := func() []forwarding.PortForward {
+			forwards, err := client.ListPortForwards(ctx)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			return forwards
+		}
+
+		BeforeEach(func() {
+			ctx = context.Background()
+			client = newClient()
+		})
+
+		It("should be healthy", func() {
+			Expect(client.Health(ctx)).To(Succeed())
+		})
+
+		It("should list the forwards it created", func() {
+			Expect(list()).To(BeEmpty())
+			Expect(client.CreatePortForwards(ctx, []forwarding.PortForward{
+				forward("k8s-default-pod", 25565, "tcp"),
+				forward("k8s-default-pod", 25566, "udp"),
+			})).To(Succeed())
+			Expect(list()).To(ConsistOf(
+				beForward(forward("k8s-default-pod", 25565, "tcp")),
+				beForward(forward("k8s-default-pod", 25566, "udp")),
+			))
+		})
+
+		It("should update a forward in place", func() {
+			Expect(client.CreatePortForwards(ctx, []forwarding.PortForward{
+				forward("k8s-default-pod", 25565, "tcp"),
+				forward("k8s-default-other", 25566, "tcp"),
+			})).To(Succeed())
+			existing := findForward(list(), forward("k8s-default-pod", 25565, "tcp"))
+
+			desired := existing
+			desired.Address = "10.0.0.2"
+			desired.Protocol = "tcp_udp"
+			Expect(client.UpdatePortForward(ctx, existing, desired)).To(Succeed())
+			Expect(list()).To(ConsistOf(
+				beForward(desired),
+				beForward(forward("k8s-default-other", 25566, "tcp")),
+			))
+		})
+
+		It("should fail to update a forward that does not exist", func() {
+			Expect(client.UpdatePortForward(ctx, forward("k8s-default-pod", 25565, "tcp"),
+				forward("k8s-default-pod", 25566, "tcp"))).NotTo(Succeed())
+			Expect(list()).To(BeEmpty())
+		})
+
+		It("should only delete the given forwards", func() {
+			Expect(client.CreatePortForwards(ctx, []forwarding.PortForward{
+				forward("k8s-default-pod", 25565, "tcp"),
+				forward("k8s-default-pod", 25566, "tcp"),
+				forward("manual", 25567, "tcp"),
+			})).To(Succeed())
+			Expect(client.DeletePortForwards(ctx, []forwarding.PortForward{
+				findForward(list(), forward("k8s-default-pod", 25565, "tcp")),
+			})).To(Succeed())
+			Expect(list()).To(ConsistOf(
+				beForward(forward("k8s-default-pod", 25566, "tcp")),
+				beForward(forward("manual", 25567, "tcp")),
+			))
+		})
+
+		It("should ignore deleting forwards that do not exist", func() {
+			Expect(client.CreatePortForwards(ctx, []forwarding.PortForward{forward("manual", 25565, "tcp")})).To(Succeed())
+			Expect(client.DeletePortForwards(ctx, []forwarding.PortForward{forward("k8s-default-pod", 25566, "tcp")})).
+				To(Succeed())
+			Expect(list()).To(ConsistOf(beForward(forward("manual", 25565, "tcp"))))
+		})
+
+		Context("with a ForwardingReconciler", func() {
+			var fr *forwarding.ForwardingReconciler
+
+			BeforeEach(func() {
+				fr = &forwarding.ForwardingReconciler{Client: client, RulePrefix: "k8s-"}
+			})
+
+			It("should preserve the rules of other owners", func() {
+				Expect(client.CreatePortForwards(ctx, []forwarding.PortForward{
+					forward("manual", 25565, "tcp"),
+					forward("k8s-default-other", 25566, "tcp"),
+				})).To(Succeed())
+
+				result, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []forwarding.PortForward{
+					forward("k8s-default-pod", 25565, "tcp"),
+					forward("k8s-default-pod", 25567, "tcp"),
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Conflicts).To(HaveLen(1))
+				Expect(result.Conflicts[0].Holder).To(Equal("manual"))
+				_, err = fr.DeleteAddresses(ctx, "k8s-default-pod")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(list()).To(ConsistOf(
+					beForward(forward("manual", 25565, "tcp")),
+					beForward(forward("k8s-default-other", 25566, "tcp")),
+				))
+			})
+
+			It("should converge without further changes", func() {
+				forwards := []forwarding.PortForward{
+					forward("k8s-default-pod", 25565, "tcp"),
+					forward("k8s-default-pod", 25566, "udp"),
+				}
+				result, err := fr.EnsureAddresses(ctx, "k8s-default-pod", forwards)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Created).To(HaveLen(2))
+
+				applied := list()
+				result, err = fr.EnsureAddresses(ctx, "k8s-default-pod", forwards)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Created).To(BeEmpty())
+				Expect(result.Updated).To(BeEmpty())
+				Expect(result.Deleted).To(BeEmpty())
+				Expect(list()).To(ConsistOf(applied))
+
+				deleted, err := fr.DeleteAddresses(ctx, "k8s-default-pod")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(deleted).To(HaveLen(2))
+				deleted, err = fr.DeleteAddresses(ctx, "k8s-default-pod")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(deleted).To(BeEmpty())
+				Expect(list()).To(BeEmpty())
+			})
+
+			Context("when a batch is only partly applied", func() {
+				var partial *partialClient
+				forwards := []forwarding.PortForward{
+					forward("k8s-default-pod", 25565, "tcp"),
+					forward("k8s-default-pod", 25566, "tcp"),
+					forward("k8s-default-pod", 25567, "udp"),
+				}
+
+				BeforeEach(func() {
+					partial = &partialClient{SwappableClient: forwarding.NewSwappableClient(client)}
+					fr.Client = partial
+				})
+
+				It("should create the rest of the forwards without duplicates", func() {
+					partial.failCreate = true
+					_, err := fr.EnsureAddresses(ctx, "k8s-default-pod", forwards)
+					Expect(err).To(MatchError(errPartial))
+					Expect(list()).To(ConsistOf(beForward(forwards[0])))
+
+					result, err := fr.EnsureAddresses(ctx, "k8s-default-pod", forwards)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(result.Created).To(ConsistOf(beForward(forwards[1]), beForward(forwards[2])))
+					Expect(result.Deleted).To(BeEmpty())
+					Expect(list()).To(ConsistOf(beForward(forwards[0]), beForward(forwards[1]), beForward(forwards[2])))
+
+					applied := list()
+					result, err = fr.EnsureAddresses(ctx, "k8s-default-pod", forwards)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(result.Created).To(BeEmpty())
+					Expect(result.Updated).To(BeEmpty())
+					Expect(result.Deleted).To(BeEmpty())
+					Expect(list()).To(ConsistOf(applied))
+				})
+
+				It("should delete the rest of the forwards", func() {
+					_, err := fr.EnsureAddresses(ctx, "k8s-default-pod", forwards)
+					Expect(err).NotTo(HaveOccurred())
+
+					partial.failDelete = true
+					_, err = fr.DeleteAddresses(ctx, "k8s-default-pod")
+					Expect(err).To(MatchError(errPartial))
+					Expect(list()).To(HaveLen(2))
+
+					deleted, err := fr.DeleteAddresses(ctx, "k8s-default-pod")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(deleted).To(HaveLen(2))
+					Expect(list()).To(BeEmpty())
+				})
+			})
+		})
+	})
+}
+
+var errPartial = errors.New("connection lost halfway through the batch")
+
+// partialClient applies only the first forward of the next batch of creations or deletions it is
+// told to fail, and then fails like a backend losing the connection halfway through. It wraps a
+// SwappableClient, which passes on the optional interfaces of the client, such as its default
+// interface, so that the listed rules compare like they do without the wrapper.
+type partialClient struct {
+	*forwarding.SwappableClient
+	failCreate bool
+	failDelete bool
+}
+
+func (c *partialClient) CreatePortForwards(ctx context.Context, forwards []forwarding.PortForward) error {
+	if !c.failCreate || len(forwards) < 2 {
+		return c.SwappableClient.CreatePortForwards(ctx, forwards)
+	}
+	c.failCreate = false
+	if err := c.SwappableClient.CreatePortForwards(ctx, forwards[:1]); err != nil {
+		return err
+	}
+	return errPartial
+}
+
+func (c *partialClient) DeletePortForwards(ctx context.Context, forwards []forwarding.PortForward) error {
+	if !c.failDelete || len(forwards) < 2 {
+		return c.SwappableClient.DeletePortForwards(ctx, forwards)
+	}
+	c.failDelete = false
+	if err := c.SwappableClient.DeletePortForwards(ctx, forwards[:1]); err != nil {
+		return err
+	}
+	return errPartial
+}
+
+// beForward matches a listed rule with the name and target of the forward. Backends may fill in
+// defaults, such as the interface, so the other fields are ignored.
+func beForward(forward forwarding.PortForward) types.GomegaMatcher {
+	return Satisfy(func(listed forwarding.PortForward) bool {
+		return listed.Name == forward.Name && listed.SameTarget(forward)
+	})
+}
+
+// findForward returns the listed rule matching the forward, as the backend represents it.
+func findForward(listed []forwarding.PortForward, forward forwarding.PortForward) forwarding.PortForward {
+	for _, other := range listed {
+		if other.Name == forward.Name && other.SameTarget(forward) {
+			return other
+		}
+	}
+	Fail("no rule matches " + forward.Name + " " + forward.String())
+	return forwarding.PortForward{}
+}
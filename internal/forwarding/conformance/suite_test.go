@@ -0,0 +1,48 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package conformance
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"atte.cloud/port-forward-controller/internal/forwarding"
+	"atte.cloud/port-forward-controller/internal/forwarding/unifitest"
+)
+
+func TestConformance(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "Conformance Suite")
+}
+
+var _ = DescribeClient("FakeClient", func() forwarding.Client {
+	return forwarding.NewFakeClient()
+})
+
+var _ = DescribeClient("UnifiClient", func() forwarding.Client {
+	server := httptest.NewServer(unifitest.New(unifitest.Options{Username: "admin", Password: "secret"}))
+	DeferCleanup(server.Close)
+	client, err := forwarding.NewUnifiClient(forwarding.UnifiOptions{
+		Site: "default", BaseURL: server.URL, User: "admin", Pass: "secret",
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return client
+})
@@ -0,0 +1,171 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarding
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Fault makes a call of a FakeClient fail.
+type Fault struct {
+	// Err is returned by the call
+	Err error
+	// Applied is the number of forwards of a batch that are created or deleted before the call
+	// fails, like on backends that change rules one by one
+	Applied int
+}
+
+// FakeClient keeps forwards in memory, for tests of code using a Client. Faults can be injected
+// into its calls, and every call can be delayed.
+type FakeClient struct {
+	// Latency delays every call, or until the context is done
+	Latency time.Duration
+
+	mu       sync.Mutex
+	forwards []PortForward
+	calls    int
+	faults   map[int]Fault
+}
+
+var _ Client = &FakeClient{}
+
+// NewFakeClient returns a FakeClient holding the given rules.
+func NewFakeClient(forwards ...PortForward) *FakeClient {
+	return &FakeClient{forwards: slices.Clone(forwards), faults: map[int]Fault{}}
+}
+
+// FailCall makes the nth call from now on fail with the fault, counting from 1.
+func (c *FakeClient) FailCall(n int, fault Fault) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults[c.calls+n] = fault
+}
+
+// Calls returns the number of calls made so far.
+func (c *FakeClient) Calls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+// Forwards returns the rules the client holds.
+func (c *FakeClient) Forwards() []PortForward {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.forwards)
+}
+
+// begin counts a call and waits for the latency. It returns the fault of the call, if any. The
+// lock is held once it returns without an error.
+func (c *FakeClient) begin(ctx context.Context) (*Fault, error) {
+	if c.Latency > 0 {
+		timer := time.NewTimer(c.Latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	c.mu.Lock()
+	c.calls++
+	fault, ok := c.faults[c.calls]
+	if !ok {
+		return nil, nil
+	}
+	delete(c.faults, c.calls)
+	return &fault, nil
+}
+
+// batch returns the forwards of a batch the call gets to apply.
+func batch(forwards []PortForward, fault *Fault) []PortForward {
+	if fault == nil {
+		return forwards
+	}
+	return forwards[:min(fault.Applied, len(forwards))]
+}
+
+func faultErr(fault *Fault) error {
+	if fault == nil {
+		return nil
+	}
+	return fault.Err
+}
+
+func (c *FakeClient) CreatePortForwards(ctx context.Context, forwards []PortForward) error {
+	fault, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.mu.Unlock()
+	c.forwards = append(c.forwards, batch(forwards, fault)...)
+	return faultErr(fault)
+}
+
+func (c *FakeClient) ListPortForwards(ctx context.Context) ([]PortForward, error) {
+	fault, err := c.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+	if fault != nil {
+		return nil, fault.Err
+	}
+	return slices.Clone(c.forwards), nil
+}
+
+func (c *FakeClient) UpdatePortForward(ctx context.Context, existing PortForward, desired PortForward) error {
+	fault, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.mu.Unlock()
+	if fault != nil {
+		return fault.Err
+	}
+	i := slices.IndexFunc(c.forwards, func(forward PortForward) bool { return reflect.DeepEqual(forward, existing) })
+	if i < 0 {
+		return fmt.Errorf("port forward %q for %s does not exist", existing.Name, existing)
+	}
+	c.forwards[i] = desired
+	return nil
+}
+
+func (c *FakeClient) DeletePortForwards(ctx context.Context, forwards []PortForward) error {
+	fault, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.mu.Unlock()
+	toDelete := batch(forwards, fault)
+	c.forwards = slices.DeleteFunc(c.forwards, func(forward PortForward) bool { return contains(toDelete, forward) })
+	return faultErr(fault)
+}
+
+func (c *FakeClient) Health(ctx context.Context) error {
+	fault, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.mu.Unlock()
+	return faultErr(fault)
+}
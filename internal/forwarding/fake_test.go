@@ -0,0 +1,116 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarding
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FakeClient", func() {
+	var (
+		ctx     context.Context
+		backend *FakeClient
+		fr      *ForwardingReconciler
+	)
+	errBackend := errors.New("backend unavailable")
+
+	forward := func(port int32) PortForward {
+		return PortForward{Name: "k8s-default-pod", Address: "10.0.0.1", Port: port, ExternalPort: port, Protocol: "tcp"}
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		backend = NewFakeClient()
+		fr = &ForwardingReconciler{Client: backend, RulePrefix: "k8s-"}
+	})
+
+	It("should fail the given call only", func() {
+		backend.FailCall(2, Fault{Err: errBackend})
+		Expect(backend.Health(ctx)).To(Succeed())
+		Expect(backend.Health(ctx)).To(MatchError(errBackend))
+		Expect(backend.Health(ctx)).To(Succeed())
+		Expect(backend.Calls()).To(Equal(3))
+	})
+
+	It("should converge after a partial failure", func() {
+		forwards := []PortForward{forward(25565), forward(25566), forward(25567)}
+		// The list succeeds, the creation stops after the first forward
+		backend.FailCall(2, Fault{Err: errBackend, Applied: 1})
+		_, err := fr.EnsureAddresses(ctx, "k8s-default-pod", forwards)
+		Expect(err).To(MatchError(errBackend))
+		Expect(backend.Forwards()).To(ConsistOf(forward(25565)))
+
+		result, err := fr.EnsureAddresses(ctx, "k8s-default-pod", forwards)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Created).To(ConsistOf(forward(25566), forward(25567)))
+		Expect(backend.Forwards()).To(ConsistOf(forwards))
+	})
+
+	It("should converge after a partial deletion", func() {
+		forwards := []PortForward{forward(25565), forward(25566), forward(25567)}
+		backend = NewFakeClient(forwards...)
+		fr.Client = backend
+		// The list succeeds, the deletion stops after the second forward
+		backend.FailCall(2, Fault{Err: errBackend, Applied: 2})
+		_, err := fr.DeleteAddresses(ctx, "k8s-default-pod")
+		Expect(err).To(MatchError(errBackend))
+		Expect(backend.Forwards()).To(HaveLen(1))
+
+		deleted, err := fr.DeleteAddresses(ctx, "k8s-default-pod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deleted).To(HaveLen(1))
+		Expect(backend.Forwards()).To(BeEmpty())
+	})
+
+	It("should replace stale forwards after a partial failure without duplicates", func() {
+		stale := []PortForward{forward(8080), forward(8081)}
+		desired := []PortForward{forward(25565), forward(25566)}
+		backend = NewFakeClient(stale...)
+		fr.Client = backend
+		// The list succeeds, one stale forward is deleted before the backend fails
+		backend.FailCall(2, Fault{Err: errBackend, Applied: 1})
+		_, err := fr.EnsureAddresses(ctx, "k8s-default-pod", desired)
+		Expect(err).To(MatchError(errBackend))
+
+		Expect(backend.Forwards()).To(ConsistOf(forward(8081)))
+
+		result, err := fr.EnsureAddresses(ctx, "k8s-default-pod", desired)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Deleted).To(ConsistOf(forward(8081)))
+		Expect(result.Created).To(ConsistOf(desired))
+		Expect(backend.Forwards()).To(ConsistOf(desired))
+		result, err = fr.EnsureAddresses(ctx, "k8s-default-pod", desired)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Created).To(BeEmpty())
+		Expect(result.Updated).To(BeEmpty())
+		Expect(result.Deleted).To(BeEmpty())
+	})
+
+	It("should give up waiting once the context is done", func() {
+		backend.Latency = time.Minute
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err := backend.ListPortForwards(ctx)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		Expect(backend.Calls()).To(BeZero())
+	})
+})
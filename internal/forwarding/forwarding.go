@@ -18,62 +18,763 @@ package forwarding
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
 	"reflect"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 type PortForward struct {
-	Name    string
-	Address string
-	Port    int32
+	Name         string `json:"name"`
+	Address      string `json:"address"`
+	Port         int32  `json:"port"`
+	ExternalPort int32  `json:"externalPort"`
+	// Protocol is one of "tcp", "udp" or "tcp_udp"
+	Protocol string `json:"protocol"`
+	// Interface is the WAN interface the forward is published on. Empty selects the default
+	// interface of the backend.
+	Interface string `json:"interface,omitempty"`
+	// Sources restricts the forward to clients from these addresses or CIDR ranges, sorted.
+	// Backends may also accept references to address groups of their own. Empty allows any
+	// source.
+	Sources []string `json:"sources,omitempty"`
+	// Family is FamilyIPv6 for pinholes, which let traffic through to the port of a global IPv6
+	// address instead of translating an external port. Empty for forwards.
+	Family string `json:"family,omitempty"`
+	// ExternalPorts are the external ports of rules made by hand that publish ranges or lists of
+	// ports, in which case ExternalPort and Port are zero. The controller never makes such rules;
+	// they are only listed to detect conflicts with them.
+	ExternalPorts []PortRange `json:"externalPorts,omitempty"`
+}
+
+// Address families of forwards.
+const (
+	FamilyIPv4 = ""
+	FamilyIPv6 = "ipv6"
+)
+
+// IsPinhole reports whether the forward is an IPv6 pinhole rather than a port forward.
+func (pf PortForward) IsPinhole() bool {
+	return pf.Family == FamilyIPv6
+}
+
+// ParseSource parses a source address or CIDR range.
+func ParseSource(source string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(source); err == nil {
+		return prefix, nil
+	}
+	addr, err := netip.ParseAddr(source)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid source %q, expected an address or CIDR range", source)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Overlaps reports whether both forwards claim the same external port for at least one protocol
+// on the same interface. Pinholes only overlap with pinholes to the same address.
+func (pf PortForward) Overlaps(other PortForward) bool {
+	if !rangesOverlap(pf.externalPorts(), other.externalPorts()) || pf.IsPinhole() != other.IsPinhole() {
+		return false
+	}
+	if pf.IsPinhole() && pf.Address != other.Address {
+		return false
+	}
+	if !pf.IsPinhole() && !interfacesOverlap(pf.Interface, other.Interface) {
+		return false
+	}
+	return pf.Protocol == other.Protocol || pf.Protocol == "tcp_udp" || other.Protocol == "tcp_udp"
+}
+
+// SameTarget reports whether both forwards send the same external port and protocol to the same
+// address and port, regardless of their names and restrictions.
+func (pf PortForward) SameTarget(other PortForward) bool {
+	return pf.Address == other.Address && pf.Port == other.Port &&
+		pf.ExternalPort == other.ExternalPort && pf.Protocol == other.Protocol
+}
+
+// externalPorts returns the external ports claimed by the forward.
+func (pf PortForward) externalPorts() []PortRange {
+	if len(pf.ExternalPorts) > 0 {
+		return pf.ExternalPorts
+	}
+	return []PortRange{{First: pf.ExternalPort, Last: pf.ExternalPort}}
+}
+
+func rangesOverlap(a []PortRange, b []PortRange) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x.First <= y.Last && y.First <= x.Last {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// interfacesOverlap reports whether forwards on both interfaces can compete for a port. The
+// default interface is not known here, so it is assumed to overlap with every other one.
+func interfacesOverlap(a string, b string) bool {
+	return a == "" || b == "" || a == b || a == InterfaceBoth || b == InterfaceBoth
+}
+
+func (pf PortForward) String() string {
+	if pf.IsPinhole() {
+		return fmt.Sprintf("%d/%s (ipv6)", pf.ExternalPort, pf.Protocol)
+	}
+	if len(pf.ExternalPorts) > 0 {
+		return fmt.Sprintf("%s/%s", FormatPortList(pf.ExternalPorts), pf.Protocol)
+	}
+	return fmt.Sprintf("%d/%s", pf.ExternalPort, pf.Protocol)
+}
+
+// Conflict describes a forward that was not applied because its external port is held by someone else.
+type Conflict struct {
+	Forward PortForward `json:"forward"`
+	// Holder identifies the rule or workload holding the external port
+	Holder string `json:"holder"`
+}
+
+// Result describes the outcome of EnsureAddresses.
+type Result struct {
+	// Adopted holds the rules made by someone else that were taken over, with their former names
+	Adopted   []PortForward
+	Created   []PortForward
+	Updated   []PortForward
+	Deleted   []PortForward
+	Conflicts []Conflict
+	// MemberErrors holds the errors of the mirror members that failed while the policy of the
+	// mirror was still met
+	MemberErrors map[string]error
+	// DryRun is set if the changes were only planned
+	DryRun bool
 }
 
 type Client interface {
 	CreatePortForwards(ctx context.Context, forwards []PortForward) error
 	ListPortForwards(ctx context.Context) ([]PortForward, error)
+	// UpdatePortForward changes the existing rule to match desired.
+	UpdatePortForward(ctx context.Context, existing PortForward, desired PortForward) error
 	DeletePortForwards(ctx context.Context, forwards []PortForward) error
+	// Health returns an error if the backend is unreachable or rejects our credentials.
+	Health(ctx context.Context) error
+}
+
+// InterfaceBoth is the interface name of forwards published on every WAN interface.
+const InterfaceBoth = "both"
+
+// InterfaceSelector is implemented by clients that publish forwards on a selectable WAN interface.
+type InterfaceSelector interface {
+	// DefaultInterface is used for forwards that select no interface
+	DefaultInterface() string
+	// ValidateInterface returns an error if the backend has no interface of the given name
+	ValidateInterface(name string) error
+}
+
+// ErrUnsupportedFirewall is returned by FirewallManager and PinholeManager implementations for
+// gateways whose firewall they cannot manage.
+var ErrUnsupportedFirewall = errors.New("the firewall of the gateway is not supported")
+
+// SourceValidator is implemented by clients that restrict forwards to the sources they support.
+type SourceValidator interface {
+	// ValidateSources returns an error if the backend cannot restrict a forward to the sources
+	ValidateSources(sources []string) error
+}
+
+// FirewallManager is implemented by clients that can manage the allow rules forwards need on
+// gateways whose firewall drops forwarded traffic unless told otherwise. Allow rules are owned by
+// name, like forwards.
+type FirewallManager interface {
+	// ValidateFirewall returns an error if the allow rules would not take effect on the gateway,
+	// e.g. because it uses a firewall the manager does not support
+	ValidateFirewall(ctx context.Context) error
+	// EnsureFirewallRules makes the allow rules named name match the forwards
+	EnsureFirewallRules(ctx context.Context, name string, forwards []PortForward) error
+	// DeleteFirewallRules removes the allow rules named name
+	DeleteFirewallRules(ctx context.Context, name string) error
+}
+
+// PinholeManager is implemented by clients that can open IPv6 pinholes: allow rules for traffic
+// to the port of a global address, which needs no NAT. Pinholes are owned by name, like forwards.
+type PinholeManager interface {
+	// EnsurePinholes makes the pinholes named name match the given pinholes
+	EnsurePinholes(ctx context.Context, name string, pinholes []PortForward) error
+	// DeletePinholes removes the pinholes named name
+	DeletePinholes(ctx context.Context, name string) error
+}
+
+// ErrRuleNotFound is returned by RuleFinder if no rule has the given ID.
+var ErrRuleNotFound = errors.New("rule not found")
+
+// RuleFinder is implemented by clients whose rules have IDs of their own, so that rules made by
+// hand can be referenced.
+type RuleFinder interface {
+	// PortForwardByID returns the rule with the given ID, or ErrRuleNotFound
+	PortForwardByID(ctx context.Context, id string) (PortForward, error)
+}
+
+// WANAddresser is implemented by clients that can discover the public address of the gateway.
+type WANAddresser interface {
+	WANAddress(ctx context.Context) (string, error)
+}
+
+// wanAddressTTL is how long a discovered WAN address is reused before asking the gateway again.
+const wanAddressTTL = time.Minute
+
+// healthTTL is how long the result of a health check is reused, so that frequent probes do not
+// hammer the backend.
+const healthTTL = 30 * time.Second
+
+// RuleNameData is passed to the rule name template.
+type RuleNameData struct {
+	Prefix    string
+	Namespace string
+	Name      string
 }
 
 type ForwardingReconciler struct {
 	Client     Client
 	RulePrefix string
+	// RuleNameTemplate renders rule names from RuleNameData. Names default to
+	// "<prefix><namespace>-<name>" and must start with the prefix.
+	RuleNameTemplate *template.Template
+	// Backend names the backend in metrics
+	Backend string
+	// ManageFirewall keeps an allow rule for every forward on backends implementing
+	// FirewallManager
+	ManageFirewall bool
+	// ManagePinholes opens the IPv6 pinholes among the forwards on backends implementing
+	// PinholeManager. Pinholes are ignored otherwise.
+	ManagePinholes bool
+	// AdoptMatching takes over rules made by someone else that forward a desired external port to
+	// the same target, rather than reporting them as conflicts
+	AdoptMatching bool
+	// DryRun computes the changes to the backend without making them. They are logged and kept in
+	// Plans instead.
+	DryRun bool
+	// Plans collects the changes planned in dry run mode, if set
+	Plans *Planner
+
+	mu               sync.Mutex
+	wanAddress       string
+	wanAddressExpiry time.Time
+	health           error
+	healthExpiry     time.Time
+	healthGeneration uint64
+}
+
+// Healthz is a healthz.Checker reporting whether the backend is reachable and accepts our
+// credentials. Results are cached for a short while, but not across swaps of the client.
+func (fr *ForwardingReconciler) Healthz(req *http.Request) error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	var generation uint64
+	if swappable, ok := fr.Client.(*SwappableClient); ok {
+		generation = swappable.Generation()
+	}
+	if time.Now().Before(fr.healthExpiry) && generation == fr.healthGeneration {
+		return fr.health
+	}
+
+	start := time.Now()
+	err := fr.Client.Health(req.Context())
+	observe(fr.Backend, "health", start, err)
+	if err != nil {
+		err = fmt.Errorf("backend %s is unhealthy: %w", fr.Backend, err)
+	}
+	fr.health = err
+	fr.healthExpiry = time.Now().Add(healthTTL)
+	fr.healthGeneration = generation
+	return err
+}
+
+// RuleName returns the name of the rules owned by the given pod.
+func (fr *ForwardingReconciler) RuleName(namespace string, name string) string {
+	if fr.RuleNameTemplate != nil {
+		var rendered strings.Builder
+		err := fr.RuleNameTemplate.Execute(&rendered, RuleNameData{Prefix: fr.RulePrefix, Namespace: namespace, Name: name})
+		if err == nil {
+			return rendered.String()
+		}
+	}
+	return fmt.Sprintf("%s%s-%s", fr.RulePrefix, namespace, name)
+}
+
+// LegacyRuleName returns the name the rules of a pod had before rule names were prefixed, or an
+// empty string if it cannot be told apart from the names of other rules of the controller.
+func (fr *ForwardingReconciler) LegacyRuleName(namespace string, name string) string {
+	legacy := fmt.Sprintf("%s-%s", namespace, name)
+	if legacy == fr.RuleName(namespace, name) || fr.Owns(legacy) {
+		return ""
+	}
+	return legacy
 }
 
-func (fr *ForwardingReconciler) EnsureAddresses(ctx context.Context, addresses []PortForward) error {
-	existingAddresses, err := fr.Client.ListPortForwards(ctx)
+// formerNames returns the set of former names that may be renamed to name. Names that look like
+// the names of the controller may belong to other pods and are left out.
+func (fr *ForwardingReconciler) formerNames(name string, names []string) map[string]bool {
+	former := map[string]bool{}
+	for _, n := range names {
+		if n != "" && n != name && !fr.Owns(n) {
+			former[n] = true
+		}
+	}
+	return former
+}
+
+// Owns returns whether a rule of the given name was made by the controller. Without a prefix,
+// no rule can be told apart from the rules made by hand, so none is considered owned.
+func (fr *ForwardingReconciler) Owns(name string) bool {
+	return fr.RulePrefix != "" && strings.HasPrefix(name, fr.RulePrefix)
+}
+
+// WANAddress returns the public address of the gateway, or an empty string if the client cannot
+// discover it.
+func (fr *ForwardingReconciler) WANAddress(ctx context.Context) (string, error) {
+	addresser, ok := fr.Client.(WANAddresser)
+	if !ok {
+		return "", nil
+	}
+
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if time.Now().Before(fr.wanAddressExpiry) {
+		return fr.wanAddress, nil
+	}
+
+	start := time.Now()
+	address, err := addresser.WANAddress(ctx)
+	observe(fr.Backend, "wan_address", start, err)
+	if err != nil {
+		return "", err
+	}
+	fr.wanAddress = address
+	fr.wanAddressExpiry = time.Now().Add(wanAddressTTL)
+	return address, nil
+}
+
+// EnsureAddresses makes the rules named name match addresses. Addresses whose external port is
+// already held by another rule are not created and are returned as conflicts instead. Rules with
+// one of formerNames, see LegacyRuleName, are renamed to name and adopted first.
+func (fr *ForwardingReconciler) EnsureAddresses(ctx context.Context, name string, addresses []PortForward, formerNames ...string) (Result, error) {
+	if mirror, ok := fr.Client.(*MirrorClient); ok {
+		return fr.ensureMirrored(ctx, mirror, name, addresses, formerNames)
+	}
+
+	result := Result{DryRun: fr.DryRun}
+	// Nothing is changed unless the allow rules the forwards need can be made as well
+	if err := fr.validateFirewall(ctx); err != nil {
+		return result, err
+	}
+	addresses, pinholes := splitPinholes(addresses)
+	addresses = fr.withDefaultInterface(addresses)
+	existingAddresses, err := fr.ListAddresses(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	former := fr.formerNames(name, formerNames)
+	ownedAddresses := []PortForward{}
+	otherAddresses := []PortForward{}
+	for _, address := range existingAddresses {
+		switch {
+		case address.Name == name:
+			ownedAddresses = append(ownedAddresses, address)
+		case former[address.Name]:
+			if err = fr.adopt(ctx, name, address); err != nil {
+				return result, err
+			}
+			result.Adopted = append(result.Adopted, address)
+			address.Name = name
+			ownedAddresses = append(ownedAddresses, address)
+		default:
+			otherAddresses = append(otherAddresses, address)
+		}
+	}
+
+	if fr.AdoptMatching {
+		for _, address := range addresses {
+			i := fr.indexOfAdoptable(otherAddresses, address)
+			if i < 0 || indexOfRule(ownedAddresses, address) >= 0 {
+				continue
+			}
+			rule := otherAddresses[i]
+			if err = fr.adopt(ctx, name, rule); err != nil {
+				return result, err
+			}
+			result.Adopted = append(result.Adopted, rule)
+			rule.Name = name
+			ownedAddresses = append(ownedAddresses, rule)
+			otherAddresses = append(otherAddresses[:i], otherAddresses[i+1:]...)
+		}
+	}
+
+	// Rules we already hold are kept even if someone else has claimed the same port since.
+	newAddresses := fr.missingAddresses(addresses, ownedAddresses)
+	desiredAddresses := []PortForward{}
+	for _, address := range addresses {
+		if holder, ok := overlapping(address, otherAddresses); ok && contains(newAddresses, address) {
+			result.Conflicts = append(result.Conflicts, Conflict{Forward: address, Holder: holder.Name})
+			continue
+		}
+		desiredAddresses = append(desiredAddresses, address)
+	}
+
+	staleAddresses := fr.missingAddresses(ownedAddresses, desiredAddresses)
+	missingAddresses := fr.missingAddresses(desiredAddresses, ownedAddresses)
+
+	// A rule for the same external port is changed in place rather than replaced
+	remainingAddresses := []PortForward{}
+	updates := []PlannedUpdate{}
+	for _, address := range missingAddresses {
+		i := indexOfRule(staleAddresses, address)
+		if i < 0 {
+			remainingAddresses = append(remainingAddresses, address)
+			continue
+		}
+		if err = fr.update(ctx, staleAddresses[i], address); err != nil {
+			return result, err
+		}
+		result.Updated = append(result.Updated, address)
+		updates = append(updates, PlannedUpdate{Existing: staleAddresses[i], Desired: address})
+		staleAddresses = append(staleAddresses[:i], staleAddresses[i+1:]...)
+	}
+	missingAddresses = remainingAddresses
+
+	err = fr.delete(ctx, staleAddresses)
 	if err != nil {
-		return err
+		return result, err
 	}
+	result.Deleted = staleAddresses
 
-	staleAddresses := fr.staleAddresses(addresses, existingAddresses)
-	err = fr.Client.DeletePortForwards(ctx, staleAddresses)
+	err = fr.create(ctx, missingAddresses)
 	if err != nil {
-		return err
+		return result, err
 	}
+	result.Created = missingAddresses
 
-	missingAddresses := fr.missingAddresses(addresses, existingAddresses)
-	return fr.Client.CreatePortForwards(ctx, missingAddresses)
+	if err = fr.ensureFirewallRules(ctx, name, desiredAddresses); err != nil {
+		return result, err
+	}
+	if err = fr.ensurePinholes(ctx, name, pinholes); err != nil {
+		return result, err
+	}
+	if fr.DryRun {
+		fr.recordPlan(name, result, updates)
+		return result, nil
+	}
+	recordResult(fr.Backend, result)
+	return result, nil
 }
 
-func (fr *ForwardingReconciler) DeleteAddresses(ctx context.Context, addresses []PortForward) error {
-	existingAddresses, err := fr.Client.ListPortForwards(ctx)
+// DeleteAddresses removes every rule named name or one of formerNames and returns the removed
+// rules.
+func (fr *ForwardingReconciler) DeleteAddresses(ctx context.Context, name string, formerNames ...string) ([]PortForward, error) {
+	if mirror, ok := fr.Client.(*MirrorClient); ok {
+		return fr.deleteMirrored(ctx, mirror, name, formerNames)
+	}
+
+	existingAddresses, err := fr.ListAddresses(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	former := fr.formerNames(name, formerNames)
 	addressesToDelete := []PortForward{}
-	for _, address := range addresses {
-		for _, existingAddress := range existingAddresses {
-			if reflect.DeepEqual(address, existingAddress) {
-				addressesToDelete = append(addressesToDelete, existingAddress)
-				break
-			}
+	for _, existingAddress := range existingAddresses {
+		if existingAddress.Name == name || former[existingAddress.Name] {
+			addressesToDelete = append(addressesToDelete, existingAddress)
+		}
+	}
+
+	if err = fr.delete(ctx, addressesToDelete); err != nil {
+		return nil, err
+	}
+	if err = fr.ensureFirewallRules(ctx, name, nil); err != nil {
+		return addressesToDelete, err
+	}
+	if err = fr.ensurePinholes(ctx, name, nil); err != nil {
+		return addressesToDelete, err
+	}
+	if fr.DryRun {
+		fr.recordPlan(name, Result{Deleted: addressesToDelete}, nil)
+		return addressesToDelete, nil
+	}
+	recordResult(fr.Backend, Result{Deleted: addressesToDelete})
+	return addressesToDelete, nil
+}
+
+// Adopt renames a rule made by someone else to name, so that it is managed like the other rules
+// named name from then on.
+func (fr *ForwardingReconciler) Adopt(ctx context.Context, name string, rule PortForward) error {
+	return fr.adopt(ctx, name, rule)
+}
+
+// AdoptRules adopts the rules with the given IDs as rules named name and returns them with their
+// former names. Rules that are named name already or no longer exist are skipped; rules of other
+// owners are never taken.
+func (fr *ForwardingReconciler) AdoptRules(ctx context.Context, name string, ids []string) ([]PortForward, error) {
+	finder, ok := fr.Client.(RuleFinder)
+	if !ok || !fr.CanAdoptRules() {
+		return nil, fmt.Errorf("backend %s cannot look up rules by ID", fr.Backend)
+	}
+
+	adopted := []PortForward{}
+	for _, id := range ids {
+		rule, err := finder.PortForwardByID(ctx, id)
+		if errors.Is(err, ErrRuleNotFound) {
+			log.FromContext(ctx).V(1).Info("Rule to adopt does not exist", "backend", fr.Backend, "id", id)
+			continue
+		}
+		if err != nil {
+			return adopted, err
+		}
+		if rule.Name == name {
+			continue
+		}
+		if fr.Owns(rule.Name) {
+			return adopted, fmt.Errorf("rule %s is owned by %s", id, rule.Name)
+		}
+		if len(rule.ExternalPorts) > 0 {
+			return adopted, fmt.Errorf("rule %s forwards a range or list of ports, which cannot be adopted", id)
+		}
+		if err = fr.adopt(ctx, name, rule); err != nil {
+			return adopted, err
+		}
+		adopted = append(adopted, rule)
+	}
+	return adopted, nil
+}
+
+// CanAdoptRules reports whether the backend can look up rules by ID, which adopting them needs.
+// Mirrors cannot, as every member has IDs of its own.
+func (fr *ForwardingReconciler) CanAdoptRules() bool {
+	client := fr.Client
+	if swappable, ok := client.(*SwappableClient); ok {
+		client = swappable.Current()
+	}
+	_, ok := client.(RuleFinder)
+	return ok
+}
+
+func (fr *ForwardingReconciler) adopt(ctx context.Context, name string, rule PortForward) error {
+	log.FromContext(ctx).Info("Adopting rule", "backend", fr.Backend, "rule", rule.Name, "name", name,
+		"forward", rule.String(), "dryRun", fr.DryRun)
+	adopted := rule
+	adopted.Name = name
+	return fr.update(ctx, rule, adopted)
+}
+
+// indexOfAdoptable returns the index of a rule made by someone else that forwards to the same
+// target as forward.
+func (fr *ForwardingReconciler) indexOfAdoptable(rules []PortForward, forward PortForward) int {
+	for i, rule := range rules {
+		if !fr.Owns(rule.Name) && rule.SameTarget(forward) {
+			return i
 		}
 	}
+	return -1
+}
 
-	return fr.Client.DeletePortForwards(ctx, addressesToDelete)
+// ListAddresses returns every rule on the backend.
+func (fr *ForwardingReconciler) ListAddresses(ctx context.Context) ([]PortForward, error) {
+	start := time.Now()
+	forwards, err := fr.Client.ListPortForwards(ctx)
+	observe(fr.Backend, "list", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	owned := []PortForward{}
+	for _, forward := range forwards {
+		if fr.Owns(forward.Name) {
+			owned = append(owned, forward)
+		}
+	}
+	recordManagedRules(fr.Backend, owned)
+	return forwards, nil
 }
 
+func (fr *ForwardingReconciler) create(ctx context.Context, forwards []PortForward) error {
+	if len(forwards) == 0 {
+		return nil
+	}
+	if fr.DryRun {
+		fr.logPlanned(ctx, "create", forwards)
+		return nil
+	}
+	start := time.Now()
+	err := fr.Client.CreatePortForwards(ctx, forwards)
+	observe(fr.Backend, "create", start, err)
+	return err
+}
+
+func (fr *ForwardingReconciler) update(ctx context.Context, existing PortForward, desired PortForward) error {
+	if fr.DryRun {
+		log.FromContext(ctx).Info("Dry run, not updating forward", "backend", fr.Backend,
+			"existing", existing, "desired", desired)
+		return nil
+	}
+	start := time.Now()
+	err := fr.Client.UpdatePortForward(ctx, existing, desired)
+	observe(fr.Backend, "update", start, err)
+	return err
+}
+
+// validateFirewall checks that the allow rules and pinholes will take effect, if the reconciler
+// manages them.
+func (fr *ForwardingReconciler) validateFirewall(ctx context.Context) error {
+	manager, ok := fr.Client.(FirewallManager)
+	if !fr.ManageFirewall && !fr.ManagePinholes || !ok {
+		return nil
+	}
+	if err := manager.ValidateFirewall(ctx); err != nil {
+		return fmt.Errorf("unable to manage firewall rules: %w", err)
+	}
+	return nil
+}
+
+// ensureFirewallRules keeps the allow rules named name in line with the forwards, if the
+// reconciler manages them.
+func (fr *ForwardingReconciler) ensureFirewallRules(ctx context.Context, name string, forwards []PortForward) error {
+	manager, ok := fr.Client.(FirewallManager)
+	if !fr.ManageFirewall || !ok {
+		return nil
+	}
+	if fr.DryRun {
+		log.FromContext(ctx).Info("Dry run, not updating firewall rules", "backend", fr.Backend,
+			"name", name, "forwards", forwards)
+		return nil
+	}
+	start := time.Now()
+	var err error
+	if len(forwards) == 0 {
+		err = manager.DeleteFirewallRules(ctx, name)
+	} else {
+		err = manager.EnsureFirewallRules(ctx, name, forwards)
+	}
+	observe(fr.Backend, "firewall", start, err)
+	if err != nil {
+		return fmt.Errorf("unable to update firewall rules: %w", err)
+	}
+	return nil
+}
+
+// ensurePinholes keeps the pinholes named name in line with the given ones, if the reconciler
+// manages them.
+func (fr *ForwardingReconciler) ensurePinholes(ctx context.Context, name string, pinholes []PortForward) error {
+	manager, ok := fr.Client.(PinholeManager)
+	if !fr.ManagePinholes || !ok {
+		return nil
+	}
+	if fr.DryRun {
+		log.FromContext(ctx).Info("Dry run, not updating pinholes", "backend", fr.Backend,
+			"name", name, "pinholes", pinholes)
+		return nil
+	}
+	start := time.Now()
+	var err error
+	if len(pinholes) == 0 {
+		err = manager.DeletePinholes(ctx, name)
+	} else {
+		err = manager.EnsurePinholes(ctx, name, pinholes)
+	}
+	observe(fr.Backend, "pinhole", start, err)
+	if err != nil {
+		return fmt.Errorf("unable to update pinholes: %w", err)
+	}
+	return nil
+}
+
+// splitPinholes separates the port forwards from the pinholes.
+func splitPinholes(forwards []PortForward) ([]PortForward, []PortForward) {
+	addresses := []PortForward{}
+	pinholes := []PortForward{}
+	for _, forward := range forwards {
+		if forward.IsPinhole() {
+			pinholes = append(pinholes, forward)
+		} else {
+			addresses = append(addresses, forward)
+		}
+	}
+	return addresses, pinholes
+}
+
+func (fr *ForwardingReconciler) delete(ctx context.Context, forwards []PortForward) error {
+	if len(forwards) == 0 {
+		return nil
+	}
+	if fr.DryRun {
+		fr.logPlanned(ctx, "delete", forwards)
+		return nil
+	}
+	start := time.Now()
+	err := fr.Client.DeletePortForwards(ctx, forwards)
+	observe(fr.Backend, "delete", start, err)
+	return err
+}
+
+func (fr *ForwardingReconciler) logPlanned(ctx context.Context, action string, forwards []PortForward) {
+	log.FromContext(ctx).Info("Dry run, not changing forwards", "backend", fr.Backend,
+		"action", action, "forwards", forwards)
+}
+
+// recordPlan keeps the changes of a dry run for the debug endpoint and metrics.
+func (fr *ForwardingReconciler) recordPlan(name string, result Result, updates []PlannedUpdate) {
+	if fr.Plans == nil {
+		return
+	}
+	fr.Plans.record(Plan{
+		Gateway:   fr.Backend,
+		Name:      name,
+		Adopt:     result.Adopted,
+		Create:    result.Created,
+		Update:    updates,
+		Delete:    result.Deleted,
+		Conflicts: result.Conflicts,
+	})
+}
+
+// ValidateInterface returns an error if the backend does not know the interface.
+func (fr *ForwardingReconciler) ValidateInterface(name string) error {
+	if selector, ok := fr.Client.(InterfaceSelector); ok {
+		return selector.ValidateInterface(name)
+	}
+	return nil
+}
+
+// ValidateSources returns an error if the backend cannot restrict forwards to the sources.
+func (fr *ForwardingReconciler) ValidateSources(sources []string) error {
+	if validator, ok := fr.Client.(SourceValidator); ok {
+		return validator.ValidateSources(sources)
+	}
+	return nil
+}
+
+// withDefaultInterface fills in the default interface of the backend, so that forwards compare
+// equal to the rules listed by it.
+func (fr *ForwardingReconciler) withDefaultInterface(addresses []PortForward) []PortForward {
+	selector, ok := fr.Client.(InterfaceSelector)
+	if !ok {
+		return addresses
+	}
+	result := make([]PortForward, 0, len(addresses))
+	for _, address := range addresses {
+		if address.Interface == "" {
+			address.Interface = selector.DefaultInterface()
+		}
+		result = append(result, address)
+	}
+	return result
+}
+
+// missingAddresses returns the addresses in desiredAddresses that are not in existingAddresses.
 func (fr *ForwardingReconciler) missingAddresses(desiredAddresses []PortForward, existingAddresses []PortForward) []PortForward {
 	missingAddresses := []PortForward{}
 
@@ -94,24 +795,30 @@ func (fr *ForwardingReconciler) missingAddresses(desiredAddresses []PortForward,
 	return missingAddresses
 }
 
-func (fr *ForwardingReconciler) staleAddresses(desiredAddresses []PortForward, existingAddresses []PortForward) []PortForward {
-	staleAddresses := []PortForward{}
+// indexOfRule returns the index of the forward in forwards for the same external port and protocol.
+func indexOfRule(forwards []PortForward, forward PortForward) int {
+	for i, other := range forwards {
+		if other.ExternalPort == forward.ExternalPort && other.Protocol == forward.Protocol {
+			return i
+		}
+	}
+	return -1
+}
 
-	for _, address := range existingAddresses {
-		match := false
-		for _, desiredAddress := range desiredAddresses {
-			if strings.HasPrefix(address.Name, desiredAddress.Name) {
-				if reflect.DeepEqual(address, desiredAddress) {
-					match = true
-					break
-				}
-			}
+func contains(forwards []PortForward, forward PortForward) bool {
+	for _, other := range forwards {
+		if reflect.DeepEqual(other, forward) {
+			return true
 		}
+	}
+	return false
+}
 
-		// A currently existing address that is no longer desired is considered "stale"
-		if !match {
-			staleAddresses = append(staleAddresses, address)
+func overlapping(forward PortForward, forwards []PortForward) (PortForward, bool) {
+	for _, other := range forwards {
+		if forward.Overlaps(other) {
+			return other, true
 		}
 	}
-	return staleAddresses
+	return PortForward{}, false
 }
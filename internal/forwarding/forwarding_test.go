@@ -0,0 +1,445 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarding
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// memoryClient keeps forwards in a slice.
+type memoryClient struct {
+	forwards []PortForward
+}
+
+func (c *memoryClient) CreatePortForwards(_ context.Context, forwards []PortForward) error {
+	c.forwards = append(c.forwards, forwards...)
+	return nil
+}
+
+func (c *memoryClient) ListPortForwards(_ context.Context) ([]PortForward, error) {
+	return append([]PortForward{}, c.forwards...), nil
+}
+
+func (c *memoryClient) UpdatePortForward(_ context.Context, existing PortForward, desired PortForward) error {
+	for i, forward := range c.forwards {
+		if reflect.DeepEqual(forward, existing) {
+			c.forwards[i] = desired
+		}
+	}
+	return nil
+}
+
+func (c *memoryClient) Health(_ context.Context) error {
+	return nil
+}
+
+func (c *memoryClient) DeletePortForwards(_ context.Context, forwards []PortForward) error {
+	kept := []PortForward{}
+	for _, forward := range c.forwards {
+		deleted := false
+		for _, toDelete := range forwards {
+			if reflect.DeepEqual(forward, toDelete) {
+				deleted = true
+			}
+		}
+		if !deleted {
+			kept = append(kept, forward)
+		}
+	}
+	c.forwards = kept
+	return nil
+}
+
+// wanClient is a memoryClient with the interfaces of a UniFi gateway.
+type wanClient struct {
+	*memoryClient
+}
+
+func (wanClient) DefaultInterface() string {
+	return "wan"
+}
+
+func (wanClient) ValidateInterface(name string) error {
+	if name != "wan" && name != "wan2" && name != InterfaceBoth {
+		return fmt.Errorf("unknown interface %q", name)
+	}
+	return nil
+}
+
+// firewallClient is a memoryClient that also keeps allow rules by name.
+type firewallClient struct {
+	*memoryClient
+	rules       map[string][]PortForward
+	unsupported bool
+}
+
+func (c firewallClient) ValidateFirewall(context.Context) error {
+	if c.unsupported {
+		return ErrUnsupportedFirewall
+	}
+	return nil
+}
+
+func (c firewallClient) EnsureFirewallRules(_ context.Context, name string, forwards []PortForward) error {
+	c.rules[name] = forwards
+	return nil
+}
+
+func (c firewallClient) DeleteFirewallRules(_ context.Context, name string) error {
+	delete(c.rules, name)
+	return nil
+}
+
+// pinholeClient is a memoryClient that also keeps pinholes by name.
+type pinholeClient struct {
+	*memoryClient
+	pinholes map[string][]PortForward
+}
+
+func (c pinholeClient) EnsurePinholes(_ context.Context, name string, pinholes []PortForward) error {
+	c.pinholes[name] = pinholes
+	return nil
+}
+
+func (c pinholeClient) DeletePinholes(_ context.Context, name string) error {
+	delete(c.pinholes, name)
+	return nil
+}
+
+// idClient is a memoryClient whose rules are found by their index.
+type idClient struct {
+	*memoryClient
+}
+
+func (c idClient) PortForwardByID(_ context.Context, id string) (PortForward, error) {
+	for i, forward := range c.forwards {
+		if fmt.Sprint(i) == id {
+			return forward, nil
+		}
+	}
+	return PortForward{}, ErrRuleNotFound
+}
+
+var _ = Describe("ForwardingReconciler", func() {
+	var (
+		ctx     context.Context
+		backend *memoryClient
+		fr      *ForwardingReconciler
+	)
+
+	forward := func(name string, port int32, protocol string) PortForward {
+		return PortForward{Name: name, Address: "10.0.0.1", Port: port, ExternalPort: port, Protocol: protocol}
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		backend = &memoryClient{}
+		fr = &ForwardingReconciler{Client: backend, RulePrefix: "k8s-"}
+	})
+
+	It("should only replace the rules of the given owner", func() {
+		other := forward("k8s-default-other", 8080, "tcp")
+		backend.forwards = []PortForward{other, forward("k8s-default-pod", 9000, "tcp")}
+
+		result, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{forward("k8s-default-pod", 9001, "tcp")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Conflicts).To(BeEmpty())
+		Expect(result.Created).To(ConsistOf(forward("k8s-default-pod", 9001, "tcp")))
+		Expect(result.Deleted).To(ConsistOf(forward("k8s-default-pod", 9000, "tcp")))
+		Expect(backend.forwards).To(ConsistOf(other, forward("k8s-default-pod", 9001, "tcp")))
+	})
+
+	It("should update rules for the same external port in place", func() {
+		moved := forward("k8s-default-pod", 9000, "tcp")
+		moved.Address = "10.0.0.2"
+		backend.forwards = []PortForward{forward("k8s-default-pod", 9000, "tcp")}
+
+		result, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{moved})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Updated).To(ConsistOf(moved))
+		Expect(result.Created).To(BeEmpty())
+		Expect(result.Deleted).To(BeEmpty())
+		Expect(backend.forwards).To(ConsistOf(moved))
+	})
+
+	It("should report forwards whose external port is held by another rule", func() {
+		foreign := forward("manual", 25565, "tcp_udp")
+		backend.forwards = []PortForward{foreign}
+
+		result, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{
+			forward("k8s-default-pod", 25565, "tcp"),
+			forward("k8s-default-pod", 25566, "tcp"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Conflicts).To(ConsistOf(Conflict{Forward: forward("k8s-default-pod", 25565, "tcp"), Holder: "manual"}))
+		Expect(backend.forwards).To(ConsistOf(foreign, forward("k8s-default-pod", 25566, "tcp")))
+	})
+
+	It("should keep rules it already holds", func() {
+		held := forward("k8s-default-pod", 25565, "tcp")
+		backend.forwards = []PortForward{held, forward("manual", 25565, "tcp")}
+
+		result, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{held})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Conflicts).To(BeEmpty())
+		Expect(backend.forwards).To(ContainElement(held))
+	})
+
+	It("should not consider different protocols on the same port a conflict", func() {
+		Expect(forward("a", 53, "tcp").Overlaps(forward("b", 53, "udp"))).To(BeFalse())
+		Expect(forward("a", 53, "tcp").Overlaps(forward("b", 53, "tcp_udp"))).To(BeTrue())
+	})
+
+	It("should only consider forwards on the same interface a conflict", func() {
+		wan := forward("a", 443, "tcp")
+		wan.Interface = "wan"
+		wan2 := forward("b", 443, "tcp")
+		wan2.Interface = "wan2"
+		Expect(wan.Overlaps(wan2)).To(BeFalse())
+
+		wan2.Interface = InterfaceBoth
+		Expect(wan.Overlaps(wan2)).To(BeTrue())
+		wan2.Interface = ""
+		Expect(wan.Overlaps(wan2)).To(BeTrue())
+	})
+
+	It("should move rules to another interface in place", func() {
+		fr.Client = wanClient{backend}
+		existing := forward("k8s-default-pod", 443, "tcp")
+		existing.Interface = "wan"
+		backend.forwards = []PortForward{existing}
+
+		result, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{forward("k8s-default-pod", 443, "tcp")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Created).To(BeEmpty())
+		Expect(result.Updated).To(BeEmpty())
+
+		moved := forward("k8s-default-pod", 443, "tcp")
+		moved.Interface = "wan2"
+		result, err = fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{moved})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Updated).To(ConsistOf(moved))
+		Expect(backend.forwards).To(ConsistOf(moved))
+		Expect(fr.ValidateInterface("wan3")).NotTo(Succeed())
+	})
+
+	It("should keep allow rules in lockstep with the forwards", func() {
+		firewall := firewallClient{memoryClient: backend, rules: map[string][]PortForward{}}
+		fr.Client = firewall
+		fr.ManageFirewall = true
+		backend.forwards = []PortForward{forward("manual", 25565, "tcp")}
+
+		_, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{
+			forward("k8s-default-pod", 25565, "tcp"),
+			forward("k8s-default-pod", 25566, "tcp"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(firewall.rules).To(HaveKeyWithValue("k8s-default-pod", ConsistOf(forward("k8s-default-pod", 25566, "tcp"))))
+
+		_, err = fr.DeleteAddresses(ctx, "k8s-default-pod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(firewall.rules).NotTo(HaveKey("k8s-default-pod"))
+	})
+
+	It("should not forward anything when the allow rules would not take effect", func() {
+		fr.Client = firewallClient{memoryClient: backend, rules: map[string][]PortForward{}, unsupported: true}
+		fr.ManageFirewall = true
+
+		_, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{forward("k8s-default-pod", 25565, "tcp")})
+		Expect(err).To(MatchError(ErrUnsupportedFirewall))
+		Expect(backend.forwards).To(BeEmpty())
+	})
+
+	It("should open pinholes instead of forwarding IPv6", func() {
+		pinholes := pinholeClient{memoryClient: backend, pinholes: map[string][]PortForward{}}
+		fr.Client = pinholes
+		fr.ManagePinholes = true
+		pinhole := forward("k8s-default-pod", 25565, "tcp")
+		pinhole.Family = FamilyIPv6
+		pinhole.Address = "2001:db8::1"
+
+		_, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{forward("k8s-default-pod", 25565, "tcp"), pinhole})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.forwards).To(ConsistOf(forward("k8s-default-pod", 25565, "tcp")))
+		Expect(pinholes.pinholes).To(HaveKeyWithValue("k8s-default-pod", ConsistOf(pinhole)))
+
+		_, err = fr.DeleteAddresses(ctx, "k8s-default-pod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pinholes.pinholes).NotTo(HaveKey("k8s-default-pod"))
+	})
+
+	It("should only consider pinholes to the same address a conflict", func() {
+		pinhole := PortForward{Family: FamilyIPv6, Address: "2001:db8::1", ExternalPort: 25565, Protocol: "tcp"}
+		other := pinhole
+		other.Address = "2001:db8::2"
+		Expect(pinhole.Overlaps(pinhole)).To(BeTrue())
+		Expect(pinhole.Overlaps(other)).To(BeFalse())
+		Expect(pinhole.Overlaps(forward("", 25565, "tcp"))).To(BeFalse())
+	})
+
+	It("should adopt rules made by hand", func() {
+		manual := forward("manual", 25565, "tcp")
+		manual.Interface = "wan2"
+		backend.forwards = []PortForward{manual}
+		Expect(manual.SameTarget(forward("k8s-default-pod", 25565, "tcp"))).To(BeTrue())
+
+		Expect(fr.Adopt(ctx, "k8s-default-pod", manual)).To(Succeed())
+		adopted := manual
+		adopted.Name = "k8s-default-pod"
+		Expect(backend.forwards).To(ConsistOf(adopted))
+
+		result, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{forward("k8s-default-pod", 25565, "tcp")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Created).To(BeEmpty())
+		Expect(result.Updated).To(ConsistOf(forward("k8s-default-pod", 25565, "tcp")))
+	})
+
+	It("should adopt matching rules instead of reporting conflicts", func() {
+		fr.AdoptMatching = true
+		manual := forward("manual", 25565, "tcp")
+		elsewhere := forward("other", 25566, "tcp")
+		elsewhere.Address = "10.0.0.2"
+		backend.forwards = []PortForward{manual, elsewhere}
+
+		result, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{
+			forward("k8s-default-pod", 25565, "tcp"),
+			forward("k8s-default-pod", 25566, "tcp"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Adopted).To(ConsistOf(manual))
+		Expect(result.Created).To(BeEmpty())
+		Expect(result.Conflicts).To(ConsistOf(Conflict{Forward: forward("k8s-default-pod", 25566, "tcp"), Holder: "other"}))
+		Expect(backend.forwards).To(ConsistOf(forward("k8s-default-pod", 25565, "tcp"), elsewhere))
+	})
+
+	It("should adopt rules by ID but never from other owners", func() {
+		fr.Client = idClient{backend}
+		backend.forwards = []PortForward{forward("manual", 25565, "tcp"), forward("k8s-default-other", 25566, "tcp")}
+
+		adopted, err := fr.AdoptRules(ctx, "k8s-default-pod", []string{"0", "7"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(adopted).To(ConsistOf(forward("manual", 25565, "tcp")))
+		Expect(backend.forwards[0].Name).To(Equal("k8s-default-pod"))
+
+		adopted, err = fr.AdoptRules(ctx, "k8s-default-pod", []string{"0"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(adopted).To(BeEmpty())
+
+		_, err = fr.AdoptRules(ctx, "k8s-default-pod", []string{"1"})
+		Expect(err).To(MatchError(ContainSubstring("owned by k8s-default-other")))
+	})
+
+	It("should report conflicts with rules for ranges of ports", func() {
+		games := PortForward{Name: "games", Address: "10.0.0.2", Protocol: "tcp", ExternalPorts: []PortRange{{First: 25560, Last: 25570}}}
+		backend.forwards = []PortForward{games}
+
+		result, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{forward("k8s-default-pod", 25565, "tcp")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Conflicts).To(ConsistOf(Conflict{Forward: forward("k8s-default-pod", 25565, "tcp"), Holder: "games"}))
+		Expect(backend.forwards).To(ConsistOf(games))
+	})
+
+	It("should take over the rules named as before rule names were prefixed", func() {
+		Expect(fr.LegacyRuleName("default", "pod")).To(Equal("default-pod"))
+		Expect(fr.LegacyRuleName("k8s-system", "pod")).To(BeEmpty())
+		backend.forwards = []PortForward{forward("default-pod", 25565, "tcp"), forward("default-other", 25566, "tcp")}
+
+		result, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{forward("k8s-default-pod", 25565, "tcp")}, "default-pod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Adopted).To(ConsistOf(forward("default-pod", 25565, "tcp")))
+		Expect(result.Created).To(BeEmpty())
+		Expect(result.Conflicts).To(BeEmpty())
+		Expect(backend.forwards).To(ConsistOf(forward("k8s-default-pod", 25565, "tcp"), forward("default-other", 25566, "tcp")))
+
+		backend.forwards = append(backend.forwards, forward("default-pod", 8080, "tcp"))
+		deleted, err := fr.DeleteAddresses(ctx, "k8s-default-pod", "default-pod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deleted).To(HaveLen(2))
+		Expect(backend.forwards).To(ConsistOf(forward("default-other", 25566, "tcp")))
+	})
+
+	It("should delete every rule of the owner", func() {
+		other := forward("k8s-default-other", 8080, "tcp")
+		backend.forwards = []PortForward{other, forward("k8s-default-pod", 9000, "tcp"), forward("k8s-default-pod", 9001, "udp")}
+
+		deleted, err := fr.DeleteAddresses(ctx, "k8s-default-pod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deleted).To(HaveLen(2))
+		Expect(backend.forwards).To(ConsistOf(other))
+	})
+})
+
+var _ = Describe("SwappableClient", func() {
+	It("should send later calls to the new client", func() {
+		ctx := context.Background()
+		old := &memoryClient{forwards: []PortForward{{Name: "old", ExternalPort: 80, Protocol: "tcp"}}}
+		swappable := NewSwappableClient(old)
+
+		replacement := &memoryClient{}
+		swappable.Swap(replacement)
+		Expect(swappable.CreatePortForwards(ctx, []PortForward{{Name: "new", ExternalPort: 81, Protocol: "tcp"}})).To(Succeed())
+
+		forwards, err := swappable.ListPortForwards(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(forwards).To(ConsistOf(PortForward{Name: "new", ExternalPort: 81, Protocol: "tcp"}))
+		Expect(old.forwards).To(HaveLen(1))
+	})
+
+	It("should check the health of a new client right away", func() {
+		swappable := NewSwappableClient(unreachableClient{})
+		fr := &ForwardingReconciler{Client: swappable, Backend: "unifi"}
+		req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+		Expect(fr.Healthz(req)).To(MatchError(errUnreachable))
+
+		swappable.Swap(&memoryClient{})
+		Expect(fr.Healthz(req)).To(Succeed())
+	})
+
+	It("should skip firewall rules of clients without them", func() {
+		ctx := context.Background()
+		backend := &memoryClient{}
+		fr := &ForwardingReconciler{Client: NewSwappableClient(backend), RulePrefix: "k8s-", ManageFirewall: true}
+		forward := PortForward{Name: "k8s-default-pod", Address: "10.0.0.1", Port: 25565, ExternalPort: 25565, Protocol: "tcp"}
+
+		_, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{forward})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.forwards).To(HaveLen(1))
+		_, err = fr.DeleteAddresses(ctx, "k8s-default-pod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.forwards).To(BeEmpty())
+	})
+
+	It("should ignore pinholes of clients without them", func() {
+		ctx := context.Background()
+		backend := &memoryClient{}
+		fr := &ForwardingReconciler{Client: NewSwappableClient(backend), RulePrefix: "k8s-", ManagePinholes: true}
+		pinhole := PortForward{Name: "k8s-default-pod", Family: FamilyIPv6, Address: "2001:db8::1",
+			Port: 25565, ExternalPort: 25565, Protocol: "tcp"}
+
+		_, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{pinhole})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = fr.DeleteAddresses(ctx, "k8s-default-pod")
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,141 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarding
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const metricsNamespace = "port_forward_controller"
+
+var (
+	backendRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "backend_requests_total",
+		Help:      "Number of calls made to the forwarding backend, by operation.",
+	}, []string{"backend", "operation"})
+
+	backendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "backend_errors_total",
+		Help:      "Number of failed calls made to the forwarding backend, by operation.",
+	}, []string{"backend", "operation"})
+
+	backendLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "backend_request_duration_seconds",
+		Help:      "Latency of calls made to the forwarding backend, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "operation"})
+
+	managedRules = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "managed_rules",
+		Help:      "Number of rules on the backend owned by the controller, by protocol.",
+	}, []string{"backend", "protocol"})
+
+	driftCorrections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "drift_corrections_total",
+		Help:      "Number of rules created, updated or deleted to match the desired state.",
+	}, []string{"backend", "action"})
+
+	conflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "conflicts_total",
+		Help:      "Number of forwards not applied because their external port is held by another rule.",
+	}, []string{"backend"})
+
+	loginFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "login_failures_total",
+		Help:      "Number of failed attempts to log in to the backend.",
+	}, []string{"backend"})
+
+	lastSuccessfulSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "Unix time of the last reconcile that brought the backend in line with the desired state.",
+	}, []string{"backend"})
+
+	plannedChanges = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "planned_changes",
+		Help:      "Number of rule changes pending in dry run mode, by action.",
+	}, []string{"backend", "action"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		backendRequests,
+		backendErrors,
+		backendLatency,
+		managedRules,
+		driftCorrections,
+		conflicts,
+		loginFailures,
+		lastSuccessfulSync,
+		plannedChanges,
+	)
+}
+
+// observe records a call to the backend.
+func observe(backend string, operation string, start time.Time, err error) {
+	backendRequests.WithLabelValues(backend, operation).Inc()
+	backendLatency.WithLabelValues(backend, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		backendErrors.WithLabelValues(backend, operation).Inc()
+	}
+}
+
+// RecordConflicts counts forwards that were refused because another claimant holds their port.
+func RecordConflicts(backend string, count int) {
+	conflicts.WithLabelValues(backend).Add(float64(count))
+}
+
+// initLoginFailures exports the login failures of a backend before the first one, so that the
+// counter can be watched from the start.
+func initLoginFailures(backend string) {
+	loginFailures.WithLabelValues(backend)
+}
+
+func recordLoginFailure(backend string) {
+	loginFailures.WithLabelValues(backend).Inc()
+}
+
+// recordManagedRules sets the number of owned rules per protocol.
+func recordManagedRules(backend string, forwards []PortForward) {
+	counts := map[string]int{"tcp": 0, "udp": 0, "tcp_udp": 0}
+	for _, forward := range forwards {
+		counts[forward.Protocol]++
+	}
+	for protocol, count := range counts {
+		managedRules.WithLabelValues(backend, protocol).Set(float64(count))
+	}
+}
+
+func recordResult(backend string, result Result) {
+	driftCorrections.WithLabelValues(backend, "adopt").Add(float64(len(result.Adopted)))
+	driftCorrections.WithLabelValues(backend, "create").Add(float64(len(result.Created)))
+	driftCorrections.WithLabelValues(backend, "update").Add(float64(len(result.Updated)))
+	driftCorrections.WithLabelValues(backend, "delete").Add(float64(len(result.Deleted)))
+	RecordConflicts(backend, len(result.Conflicts))
+	lastSuccessfulSync.WithLabelValues(backend).SetToCurrentTime()
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// MirrorPolicy decides whether an operation on a MirrorClient succeeded.
+type MirrorPolicy string
+
+const (
+	// MirrorAll requires every member to succeed
+	MirrorAll MirrorPolicy = "all"
+	// MirrorAny requires a single member to succeed
+	MirrorAny MirrorPolicy = "any"
+	// MirrorQuorum requires a majority of the members to succeed
+	MirrorQuorum MirrorPolicy = "quorum"
+)
+
+// satisfied reports whether succeeded out of total members are enough for the policy.
+func (p MirrorPolicy) satisfied(succeeded int, total int) bool {
+	switch p {
+	case MirrorAny:
+		return succeeded > 0
+	case MirrorQuorum:
+		return succeeded > total/2
+	default:
+		return succeeded == total
+	}
+}
+
+// MirrorMember is a gateway of a MirrorClient.
+type MirrorMember struct {
+	Name   string
+	Client Client
+}
+
+// MirrorClient publishes identical forwards on several gateways, e.g. redundant edge routers.
+// Every operation is sent to all members at once and succeeds according to the policy.
+// ForwardingReconciler reconciles each member on its own, so that members which missed an
+// operation catch up.
+type MirrorClient struct {
+	Members []MirrorMember
+	Policy  MirrorPolicy
+}
+
+// fanOut calls fn for every member concurrently and checks the outcome against the policy. It
+// returns the errors of the members that failed.
+func (m *MirrorClient) fanOut(fn func(i int, member MirrorMember) error) (map[string]error, error) {
+	errs := make([]error, len(m.Members))
+	var wg sync.WaitGroup
+	for i, member := range m.Members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i, member)
+		}()
+	}
+	wg.Wait()
+
+	failed := map[string]error{}
+	failures := []error{}
+	for i, member := range m.Members {
+		if errs[i] != nil {
+			failed[member.Name] = errs[i]
+			failures = append(failures, fmt.Errorf("member %s: %w", member.Name, errs[i]))
+		}
+	}
+
+	succeeded := len(m.Members) - len(failed)
+	if m.Policy.satisfied(succeeded, len(m.Members)) {
+		return failed, nil
+	}
+	return failed, fmt.Errorf("%d of %d members succeeded, policy %q not met: %w",
+		succeeded, len(m.Members), m.Policy, errors.Join(failures...))
+}
+
+func (m *MirrorClient) CreatePortForwards(ctx context.Context, forwards []PortForward) error {
+	_, err := m.fanOut(func(_ int, member MirrorMember) error {
+		return member.Client.CreatePortForwards(ctx, forwards)
+	})
+	return err
+}
+
+// ListPortForwards returns the rules of all members that answered, so that ports held on any
+// of them are considered taken.
+func (m *MirrorClient) ListPortForwards(ctx context.Context) ([]PortForward, error) {
+	lists := make([][]PortForward, len(m.Members))
+	_, err := m.fanOut(func(i int, member MirrorMember) error {
+		var err error
+		lists[i], err = member.Client.ListPortForwards(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	forwards := []PortForward{}
+	for _, list := range lists {
+		for _, forward := range list {
+			if !contains(forwards, forward) {
+				forwards = append(forwards, forward)
+			}
+		}
+	}
+	return forwards, nil
+}
+
+func (m *MirrorClient) UpdatePortForward(ctx context.Context, existing PortForward, desired PortForward) error {
+	_, err := m.fanOut(func(_ int, member MirrorMember) error {
+		return member.Client.UpdatePortForward(ctx, existing, desired)
+	})
+	return err
+}
+
+func (m *MirrorClient) DeletePortForwards(ctx context.Context, forwards []PortForward) error {
+	_, err := m.fanOut(func(_ int, member MirrorMember) error {
+		return member.Client.DeletePortForwards(ctx, forwards)
+	})
+	return err
+}
+
+func (m *MirrorClient) Health(ctx context.Context) error {
+	_, err := m.fanOut(func(_ int, member MirrorMember) error {
+		return member.Client.Health(ctx)
+	})
+	return err
+}
+
+// DefaultInterface is empty, as every member fills in its own default.
+func (m *MirrorClient) DefaultInterface() string {
+	return ""
+}
+
+// ValidateInterface checks that every member knows the interface.
+func (m *MirrorClient) ValidateInterface(name string) error {
+	for _, member := range m.Members {
+		selector, ok := member.Client.(InterfaceSelector)
+		if !ok {
+			continue
+		}
+		if err := selector.ValidateInterface(name); err != nil {
+			return fmt.Errorf("member %s: %w", member.Name, err)
+		}
+	}
+	return nil
+}
+
+// ValidateSources checks that every member supports the sources.
+func (m *MirrorClient) ValidateSources(sources []string) error {
+	for _, member := range m.Members {
+		validator, ok := member.Client.(SourceValidator)
+		if !ok {
+			continue
+		}
+		if err := validator.ValidateSources(sources); err != nil {
+			return fmt.Errorf("member %s: %w", member.Name, err)
+		}
+	}
+	return nil
+}
+
+// WANAddress returns the address of the first member that reports one.
+func (m *MirrorClient) WANAddress(ctx context.Context) (string, error) {
+	var errs []error
+	for _, member := range m.Members {
+		addresser, ok := member.Client.(WANAddresser)
+		if !ok {
+			continue
+		}
+		address, err := addresser.WANAddress(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("member %s: %w", member.Name, err))
+			continue
+		}
+		if address != "" {
+			return address, nil
+		}
+	}
+	return "", errors.Join(errs...)
+}
+
+// ensureMirrored reconciles the rules named name on every member of the mirror on its own and
+// merges the results.
+func (fr *ForwardingReconciler) ensureMirrored(ctx context.Context, mirror *MirrorClient, name string, addresses []PortForward,
+	formerNames []string) (Result, error) {
+	results := make([]Result, len(mirror.Members))
+	failed, err := mirror.fanOut(func(i int, member MirrorMember) error {
+		var err error
+		results[i], err = fr.member(member).EnsureAddresses(ctx, name, addresses, formerNames...)
+		return err
+	})
+
+	merged := Result{MemberErrors: failed, DryRun: fr.DryRun}
+	for _, result := range results {
+		merged.Adopted = appendMissing(merged.Adopted, result.Adopted...)
+		merged.Created = appendMissing(merged.Created, result.Created...)
+		merged.Updated = appendMissing(merged.Updated, result.Updated...)
+		merged.Deleted = appendMissing(merged.Deleted, result.Deleted...)
+		for _, conflict := range result.Conflicts {
+			if !containsConflict(merged.Conflicts, conflict) {
+				merged.Conflicts = append(merged.Conflicts, conflict)
+			}
+		}
+	}
+	return merged, err
+}
+
+// deleteMirrored removes the rules named name from every member of the mirror.
+func (fr *ForwardingReconciler) deleteMirrored(ctx context.Context, mirror *MirrorClient, name string, formerNames []string) ([]PortForward, error) {
+	deleted := make([][]PortForward, len(mirror.Members))
+	_, err := mirror.fanOut(func(i int, member MirrorMember) error {
+		var err error
+		deleted[i], err = fr.member(member).DeleteAddresses(ctx, name, formerNames...)
+		return err
+	})
+
+	merged := []PortForward{}
+	for _, forwards := range deleted {
+		merged = appendMissing(merged, forwards...)
+	}
+	return merged, err
+}
+
+// member returns a reconciler for a single member of a mirror, reporting metrics as
+// "<mirror>/<member>".
+func (fr *ForwardingReconciler) member(member MirrorMember) *ForwardingReconciler {
+	return &ForwardingReconciler{
+		Client:           member.Client,
+		RulePrefix:       fr.RulePrefix,
+		RuleNameTemplate: fr.RuleNameTemplate,
+		Backend:          fr.Backend + "/" + member.Name,
+		ManageFirewall:   fr.ManageFirewall,
+		ManagePinholes:   fr.ManagePinholes,
+		AdoptMatching:    fr.AdoptMatching,
+		DryRun:           fr.DryRun,
+		Plans:            fr.Plans,
+	}
+}
+
+func appendMissing(forwards []PortForward, others ...PortForward) []PortForward {
+	for _, forward := range others {
+		if !contains(forwards, forward) {
+			forwards = append(forwards, forward)
+		}
+	}
+	return forwards
+}
+
+func containsConflict(conflicts []Conflict, conflict Conflict) bool {
+	for _, other := range conflicts {
+		if reflect.DeepEqual(other, conflict) {
+			return true
+		}
+	}
+	return false
+}
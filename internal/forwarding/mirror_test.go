@@ -0,0 +1,107 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarding
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// unreachableClient fails every call.
+type unreachableClient struct{}
+
+var errUnreachable = errors.New("unreachable")
+
+func (unreachableClient) CreatePortForwards(context.Context, []PortForward) error {
+	return errUnreachable
+}
+func (unreachableClient) ListPortForwards(context.Context) ([]PortForward, error) {
+	return nil, errUnreachable
+}
+func (unreachableClient) UpdatePortForward(context.Context, PortForward, PortForward) error {
+	return errUnreachable
+}
+func (unreachableClient) DeletePortForwards(context.Context, []PortForward) error {
+	return errUnreachable
+}
+func (unreachableClient) Health(context.Context) error { return errUnreachable }
+
+var _ = Describe("MirrorClient", func() {
+	var (
+		ctx     context.Context
+		primary *memoryClient
+		standby *memoryClient
+	)
+
+	forward := PortForward{Name: "k8s-default-pod", Address: "10.0.0.1", Port: 8080, ExternalPort: 8080, Protocol: "tcp"}
+
+	mirrored := func(policy MirrorPolicy, members ...MirrorMember) *ForwardingReconciler {
+		return &ForwardingReconciler{Client: &MirrorClient{Members: members, Policy: policy}, RulePrefix: "k8s-"}
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		primary = &memoryClient{}
+		standby = &memoryClient{}
+	})
+
+	It("should bring every member in line on its own", func() {
+		primary.forwards = []PortForward{forward}
+		fr := mirrored(MirrorAll, MirrorMember{Name: "primary", Client: primary}, MirrorMember{Name: "standby", Client: standby})
+
+		result, err := fr.EnsureAddresses(ctx, forward.Name, []PortForward{forward})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Created).To(ConsistOf(forward))
+		Expect(primary.forwards).To(ConsistOf(forward))
+		Expect(standby.forwards).To(ConsistOf(forward))
+	})
+
+	It("should fail when the policy requires every member", func() {
+		fr := mirrored(MirrorAll, MirrorMember{Name: "primary", Client: primary}, MirrorMember{Name: "down", Client: unreachableClient{}})
+
+		_, err := fr.EnsureAddresses(ctx, forward.Name, []PortForward{forward})
+		Expect(err).To(MatchError(ContainSubstring("member down")))
+		Expect(primary.forwards).To(ConsistOf(forward))
+	})
+
+	It("should report failed members when the policy is met", func() {
+		fr := mirrored(MirrorQuorum,
+			MirrorMember{Name: "primary", Client: primary},
+			MirrorMember{Name: "standby", Client: standby},
+			MirrorMember{Name: "down", Client: unreachableClient{}})
+
+		result, err := fr.EnsureAddresses(ctx, forward.Name, []PortForward{forward})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.MemberErrors).To(HaveKey("down"))
+		Expect(result.MemberErrors).NotTo(HaveKey("primary"))
+	})
+
+	It("should delete from every member", func() {
+		primary.forwards = []PortForward{forward}
+		standby.forwards = []PortForward{forward}
+		fr := mirrored(MirrorAny, MirrorMember{Name: "primary", Client: primary}, MirrorMember{Name: "standby", Client: standby})
+
+		deleted, err := fr.DeleteAddresses(ctx, forward.Name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deleted).To(ConsistOf(forward))
+		Expect(primary.forwards).To(BeEmpty())
+		Expect(standby.forwards).To(BeEmpty())
+	})
+})
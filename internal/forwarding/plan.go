@@ -0,0 +1,109 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarding
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Plan lists the changes a dry run would have made to the rules of one owner on a gateway.
+type Plan struct {
+	Gateway   string          `json:"gateway"`
+	Name      string          `json:"name"`
+	Adopt     []PortForward   `json:"adopt,omitempty"`
+	Create    []PortForward   `json:"create,omitempty"`
+	Update    []PlannedUpdate `json:"update,omitempty"`
+	Delete    []PortForward   `json:"delete,omitempty"`
+	Conflicts []Conflict      `json:"conflicts,omitempty"`
+}
+
+// PlannedUpdate is a rule a dry run would have changed in place.
+type PlannedUpdate struct {
+	Existing PortForward `json:"existing"`
+	Desired  PortForward `json:"desired"`
+}
+
+func (p Plan) empty() bool {
+	return len(p.Adopt) == 0 && len(p.Create) == 0 && len(p.Update) == 0 && len(p.Delete) == 0 && len(p.Conflicts) == 0
+}
+
+// Planner keeps the latest plan of every owner, so that the changes pending on the gateways can
+// be inspected before leaving dry run mode. It serves them as JSON.
+type Planner struct {
+	mu    sync.Mutex
+	plans map[string]map[string]Plan
+}
+
+func NewPlanner() *Planner {
+	return &Planner{plans: map[string]map[string]Plan{}}
+}
+
+// record replaces the plan of the owner; owners without pending changes are dropped.
+func (p *Planner) record(plan Plan) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.plans[plan.Gateway] == nil {
+		p.plans[plan.Gateway] = map[string]Plan{}
+	}
+	if plan.empty() {
+		delete(p.plans[plan.Gateway], plan.Name)
+	} else {
+		p.plans[plan.Gateway][plan.Name] = plan
+	}
+
+	counts := map[string]int{"adopt": 0, "create": 0, "update": 0, "delete": 0}
+	for _, plan := range p.plans[plan.Gateway] {
+		counts["adopt"] += len(plan.Adopt)
+		counts["create"] += len(plan.Create)
+		counts["update"] += len(plan.Update)
+		counts["delete"] += len(plan.Delete)
+	}
+	for action, count := range counts {
+		plannedChanges.WithLabelValues(plan.Gateway, action).Set(float64(count))
+	}
+}
+
+// Plans returns the pending plans ordered by gateway and name.
+func (p *Planner) Plans() []Plan {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	plans := []Plan{}
+	for _, byName := range p.plans {
+		for _, plan := range byName {
+			plans = append(plans, plan)
+		}
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		if plans[i].Gateway != plans[j].Gateway {
+			return plans[i].Gateway < plans[j].Gateway
+		}
+		return plans[i].Name < plans[j].Name
+	})
+	return plans
+}
+
+func (p *Planner) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(p.Plans()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
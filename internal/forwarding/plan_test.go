@@ -0,0 +1,105 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarding
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Dry run", func() {
+	var (
+		ctx     context.Context
+		backend *memoryClient
+		planner *Planner
+		fr      *ForwardingReconciler
+	)
+
+	forward := func(name string, port int32, externalPort int32) PortForward {
+		return PortForward{Name: name, Address: "10.0.0.1", Port: port, ExternalPort: externalPort, Protocol: "tcp"}
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		backend = &memoryClient{forwards: []PortForward{
+			forward("k8s-default-pod", 80, 8080),
+			forward("k8s-default-pod", 443, 8443),
+			forward("manual", 22, 2222),
+		}}
+		planner = NewPlanner()
+		fr = &ForwardingReconciler{Client: backend, RulePrefix: "k8s-", Backend: "default", DryRun: true, Plans: planner}
+	})
+
+	It("should plan changes without making them", func() {
+		before := append([]PortForward{}, backend.forwards...)
+		result, err := fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{
+			forward("k8s-default-pod", 81, 8080),
+			forward("k8s-default-pod", 22, 2222),
+			forward("k8s-default-pod", 53, 5353),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.DryRun).To(BeTrue())
+		Expect(result.Created).To(ConsistOf(forward("k8s-default-pod", 53, 5353)))
+		Expect(result.Updated).To(ConsistOf(forward("k8s-default-pod", 81, 8080)))
+		Expect(result.Deleted).To(ConsistOf(forward("k8s-default-pod", 443, 8443)))
+		Expect(result.Conflicts).To(HaveLen(1))
+		Expect(backend.forwards).To(Equal(before))
+
+		Expect(planner.Plans()).To(ConsistOf(Plan{
+			Gateway: "default",
+			Name:    "k8s-default-pod",
+			Create:  []PortForward{forward("k8s-default-pod", 53, 5353)},
+			Update: []PlannedUpdate{{
+				Existing: forward("k8s-default-pod", 80, 8080),
+				Desired:  forward("k8s-default-pod", 81, 8080),
+			}},
+			Delete:    []PortForward{forward("k8s-default-pod", 443, 8443)},
+			Conflicts: []Conflict{{Forward: forward("k8s-default-pod", 22, 2222), Holder: "manual"}},
+		}))
+	})
+
+	It("should plan deletions and drop owners without changes", func() {
+		deleted, err := fr.DeleteAddresses(ctx, "k8s-default-pod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deleted).To(HaveLen(2))
+		Expect(backend.forwards).To(HaveLen(3))
+		Expect(planner.Plans()).To(ConsistOf(HaveField("Delete", HaveLen(2))))
+
+		_, err = fr.EnsureAddresses(ctx, "k8s-default-pod", []PortForward{
+			forward("k8s-default-pod", 80, 8080),
+			forward("k8s-default-pod", 443, 8443),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(planner.Plans()).To(BeEmpty())
+	})
+
+	It("should serve the plans as JSON", func() {
+		_, err := fr.DeleteAddresses(ctx, "k8s-default-pod")
+		Expect(err).NotTo(HaveOccurred())
+
+		recorder := httptest.NewRecorder()
+		planner.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/plan", nil))
+		Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+		var plans []Plan
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &plans)).To(Succeed())
+		Expect(plans).To(Equal(planner.Plans()))
+	})
+})
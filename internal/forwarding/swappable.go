@@ -0,0 +1,160 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarding
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// SwappableClient is a Client whose implementation can be replaced while it is in use, e.g. when
+// the credentials of the backend are rotated. Calls in flight finish on the client they started
+// on; later calls use the new one.
+type SwappableClient struct {
+	mu     sync.RWMutex
+	client Client
+	// generation counts the swaps, so that results cached for an earlier client can be told apart
+	generation uint64
+}
+
+func NewSwappableClient(client Client) *SwappableClient {
+	return &SwappableClient{client: client}
+}
+
+// Swap replaces the client used by later calls.
+func (s *SwappableClient) Swap(client Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.client = client
+	s.generation++
+}
+
+// Generation returns how often the client has been swapped.
+func (s *SwappableClient) Generation() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.generation
+}
+
+// Current returns the client calls are currently made on.
+func (s *SwappableClient) Current() Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client
+}
+
+func (s *SwappableClient) CreatePortForwards(ctx context.Context, forwards []PortForward) error {
+	return s.Current().CreatePortForwards(ctx, forwards)
+}
+
+func (s *SwappableClient) ListPortForwards(ctx context.Context) ([]PortForward, error) {
+	return s.Current().ListPortForwards(ctx)
+}
+
+func (s *SwappableClient) UpdatePortForward(ctx context.Context, existing PortForward, desired PortForward) error {
+	return s.Current().UpdatePortForward(ctx, existing, desired)
+}
+
+func (s *SwappableClient) DeletePortForwards(ctx context.Context, forwards []PortForward) error {
+	return s.Current().DeletePortForwards(ctx, forwards)
+}
+
+func (s *SwappableClient) Health(ctx context.Context) error {
+	return s.Current().Health(ctx)
+}
+
+// DefaultInterface returns the default interface of the current client, if it has interfaces.
+func (s *SwappableClient) DefaultInterface() string {
+	if selector, ok := s.Current().(InterfaceSelector); ok {
+		return selector.DefaultInterface()
+	}
+	return ""
+}
+
+func (s *SwappableClient) ValidateInterface(name string) error {
+	if selector, ok := s.Current().(InterfaceSelector); ok {
+		return selector.ValidateInterface(name)
+	}
+	return nil
+}
+
+func (s *SwappableClient) ValidateSources(sources []string) error {
+	if validator, ok := s.Current().(SourceValidator); ok {
+		return validator.ValidateSources(sources)
+	}
+	return nil
+}
+
+// ValidateFirewall, EnsureFirewallRules and DeleteFirewallRules do nothing if the current client
+// does not manage firewall rules, like the reconciler does for such clients.
+func (s *SwappableClient) ValidateFirewall(ctx context.Context) error {
+	if manager, ok := s.Current().(FirewallManager); ok {
+		return manager.ValidateFirewall(ctx)
+	}
+	return nil
+}
+
+func (s *SwappableClient) EnsureFirewallRules(ctx context.Context, name string, forwards []PortForward) error {
+	if manager, ok := s.Current().(FirewallManager); ok {
+		return manager.EnsureFirewallRules(ctx, name, forwards)
+	}
+	return nil
+}
+
+func (s *SwappableClient) DeleteFirewallRules(ctx context.Context, name string) error {
+	if manager, ok := s.Current().(FirewallManager); ok {
+		return manager.DeleteFirewallRules(ctx, name)
+	}
+	return nil
+}
+
+// EnsurePinholes and DeletePinholes do nothing if the current client does not manage pinholes,
+// which are ignored for such clients.
+func (s *SwappableClient) EnsurePinholes(ctx context.Context, name string, pinholes []PortForward) error {
+	if manager, ok := s.Current().(PinholeManager); ok {
+		return manager.EnsurePinholes(ctx, name, pinholes)
+	}
+	return nil
+}
+
+func (s *SwappableClient) DeletePinholes(ctx context.Context, name string) error {
+	if manager, ok := s.Current().(PinholeManager); ok {
+		return manager.DeletePinholes(ctx, name)
+	}
+	return nil
+}
+
+func (s *SwappableClient) PortForwardByID(ctx context.Context, id string) (PortForward, error) {
+	finder, ok := s.Current().(RuleFinder)
+	if !ok {
+		return PortForward{}, errNoRuleIDs
+	}
+	return finder.PortForwardByID(ctx, id)
+}
+
+var errNoRuleIDs = errors.New("backend cannot look up rules by ID")
+
+// WANAddress returns the address discovered by the current client, or an empty string if it
+// cannot discover one.
+func (s *SwappableClient) WANAddress(ctx context.Context) (string, error) {
+	addresser, ok := s.Current().(WANAddresser)
+	if !ok {
+		return "", nil
+	}
+	return addresser.WANAddress(ctx)
+}
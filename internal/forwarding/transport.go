@@ -0,0 +1,163 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarding
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TLSOptions configures how HTTP based backends verify the router and authenticate to it.
+type TLSOptions struct {
+	// Insecure disables verification of the certificate chain. Pins are still checked.
+	Insecure bool
+	// CA is a PEM bundle of the authorities trusted to sign the certificate of the router,
+	// replacing the system roots
+	CA []byte
+	// Pins are SHA-256 digests of the subject public key info of certificates, in the
+	// "sha256/<base64>" form used by curl. The connection is only accepted if a certificate of
+	// the verified chain matches one of them. Without a CA, pinned certificates are not required
+	// to chain to a trusted root, which is what self-signed router certificates need: the leaf
+	// must then be pinned itself or be signed through the presented chain by a pinned certificate.
+	Pins []string
+	// Certificate is presented to the router if set
+	Certificate *tls.Certificate
+}
+
+// ParsePin decodes a pin in the "sha256/<base64>" form; the prefix is optional.
+func ParsePin(pin string) ([]byte, error) {
+	digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pin %q: %w", pin, err)
+	}
+	if len(digest) != sha256.Size {
+		return nil, fmt.Errorf("invalid pin %q: expected a SHA-256 digest", pin)
+	}
+	return digest, nil
+}
+
+// Pin returns the pin of a certificate.
+func Pin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// NewTransport returns a transport for the given options, based on the default transport so that
+// proxy settings and timeouts are kept.
+func NewTransport(opts TLSOptions) (*http.Transport, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.Insecure}
+
+	if opts.CA != nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(opts.CA) {
+			return nil, fmt.Errorf("CA bundle contains no certificates")
+		}
+	}
+	if opts.Certificate != nil {
+		tlsConfig.Certificates = []tls.Certificate{*opts.Certificate}
+	}
+
+	if len(opts.Pins) > 0 {
+		pins := make([][]byte, 0, len(opts.Pins))
+		for _, pin := range opts.Pins {
+			digest, err := ParsePin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pins = append(pins, digest)
+		}
+		if opts.CA == nil {
+			// The pins establish trust on their own
+			tlsConfig.InsecureSkipVerify = true
+		}
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return verifyPins(rawCerts, verifiedChains, pins)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+var errNoPin = fmt.Errorf("no certificate presented by the peer matches a pinned public key")
+
+// verifyPins checks that the peer is trusted through one of the pins. Any certificate of a
+// verified chain may be pinned. When the chain was not verified, the certificates after the leaf
+// prove nothing on their own, so the leaf must be pinned or chain up to a pinned certificate.
+func verifyPins(rawCerts [][]byte, verifiedChains [][]*x509.Certificate, pins [][]byte) error {
+	if len(verifiedChains) > 0 {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if pinned(cert, pins) {
+					return nil
+				}
+			}
+		}
+		return errNoPin
+	}
+
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("peer presented no certificate")
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	if pinned(certs[0], pins) {
+		return nil
+	}
+
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		if pinned(cert, pins) {
+			roots.AddCert(cert)
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %w", errNoPin, err)
+	}
+	return nil
+}
+
+// pinned returns whether the public key of a certificate matches one of the pins.
+func pinned(cert *x509.Certificate, pins [][]byte) bool {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(digest[:], pin) {
+			return true
+		}
+	}
+	return false
+}
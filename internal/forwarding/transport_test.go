@@ -0,0 +1,128 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarding
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NewTransport", func() {
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+		DeferCleanup(server.Close)
+	})
+
+	get := func(opts TLSOptions) error {
+		transport, err := NewTransport(opts)
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	It("should reject self-signed certificates by default", func() {
+		Expect(get(TLSOptions{})).NotTo(Succeed())
+	})
+
+	It("should trust certificates signed by the CA bundle", func() {
+		ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		Expect(get(TLSOptions{CA: ca})).To(Succeed())
+	})
+
+	It("should trust self-signed certificates matching a pin", func() {
+		Expect(get(TLSOptions{Pins: []string{Pin(server.Certificate())}})).To(Succeed())
+	})
+
+	It("should reject certificates matching no pin", func() {
+		pin := "sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+		Expect(get(TLSOptions{Insecure: true, Pins: []string{pin}})).NotTo(Succeed())
+	})
+
+	Context("with a chain presented by the peer", func() {
+		var router *x509.Certificate
+		var routerKey *ecdsa.PrivateKey
+
+		// certificate issues a certificate for a new key, self-signed unless a parent is given.
+		certificate := func(name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).NotTo(HaveOccurred())
+			template := &x509.Certificate{
+				SerialNumber:          big.NewInt(time.Now().UnixNano()),
+				Subject:               pkix.Name{CommonName: name},
+				NotBefore:             time.Now().Add(-time.Hour),
+				NotAfter:              time.Now().Add(time.Hour),
+				KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+				BasicConstraintsValid: true,
+				IsCA:                  parent == nil,
+			}
+			if parent == nil {
+				parent, parentKey = template, key
+			}
+			raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+			Expect(err).NotTo(HaveOccurred())
+			cert, err := x509.ParseCertificate(raw)
+			Expect(err).NotTo(HaveOccurred())
+			return cert, key
+		}
+
+		serve := func(leaf *x509.Certificate, key *ecdsa.PrivateKey) {
+			server.Close()
+			server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+			server.TLS = &tls.Config{Certificates: []tls.Certificate{{
+				Certificate: [][]byte{leaf.Raw, router.Raw},
+				PrivateKey:  key,
+			}}}
+			server.StartTLS()
+		}
+
+		BeforeEach(func() {
+			router, routerKey = certificate("router", nil, nil)
+		})
+
+		It("should trust leaves signed by a pinned certificate", func() {
+			serve(certificate("leaf", router, routerKey))
+			Expect(get(TLSOptions{Pins: []string{Pin(router)}})).To(Succeed())
+		})
+
+		It("should reject foreign leaves followed by a pinned certificate", func() {
+			serve(certificate("foreign", nil, nil))
+			Expect(get(TLSOptions{Pins: []string{Pin(router)}})).NotTo(Succeed())
+		})
+	})
+
+	It("should reject malformed pins", func() {
+		_, err := NewTransport(TLSOptions{Pins: []string{"sha256/abc"}})
+		Expect(err).To(HaveOccurred())
+	})
+})
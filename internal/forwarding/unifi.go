@@ -2,123 +2,611 @@ package forwarding
 
 import (
 	"context"
-	"crypto/tls"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/cookiejar"
+	"net/url"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/paultyng/go-unifi/unifi"
 )
 
+// UnifiOptions configures a UnifiClient.
+type UnifiOptions struct {
+	// Backend names the backend in metrics, "unifi" if empty
+	Backend string
+	Site    string
+	BaseURL string
+	User    string
+	Pass    string
+	// APIKey authenticates with an API key of a UniFi OS console instead of User and Pass
+	APIKey string
+	TLS    TLSOptions
+	// Interface is the WAN interface forwards are published on: wan, wan2, or both
+	Interface string
+}
+
 type UnifiClient struct {
-	site  string
-	inner *unifi.Client
+	backend  string
+	site     string
+	baseURL  string
+	iface    string
+	apiKey   string
+	http     *http.Client
+	inner    *unifi.Client
+	session  *unifiSession
+	firewall *firewallMode
 }
 
-func NewUnifiClient(site string, baseURL string, user string, pass string, insecure bool) (UnifiClient, error) {
-	var err error
+// unifiTimeout bounds every request to the controller, so that an unresponsive controller
+// cannot stall reconciles or health checks.
+const unifiTimeout = 30 * time.Second
 
-	ctx := context.TODO()
+// unifiSession tracks whether the inner client holds a valid login.
+type unifiSession struct {
+	mu       sync.Mutex
+	user     string
+	pass     string
+	loggedIn bool
+}
+
+// NewUnifiClient configures a client for the given controller. It does not log in; that happens
+// on first use and again whenever the session expires, so an unreachable controller does not
+// prevent the client from being created.
+func NewUnifiClient(opts UnifiOptions) (UnifiClient, error) {
 	c := unifi.Client{}
-	if insecure {
-		jar, _ := cookiejar.New(nil)
-		err = c.SetHTTPClient(&http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-				},
-			},
-			Jar: jar,
-		})
-		if err != nil {
-			return UnifiClient{}, err
-		}
+	jar, _ := cookiejar.New(nil)
+	transport, err := NewTransport(opts.TLS)
+	if err != nil {
+		return UnifiClient{}, err
+	}
+	httpClient := &http.Client{Jar: jar, Transport: transport, Timeout: unifiTimeout}
+	baseURL := strings.TrimSuffix(opts.BaseURL, "/")
+	if opts.APIKey != "" {
+		httpClient.Transport = apiKeyTransport{key: opts.APIKey, next: httpClient.Transport}
+		// API keys are only accepted by UniFi OS consoles, and go-unifi only discovers the API
+		// path when logging in, so point it at the network API directly
+		err = c.SetBaseURL(baseURL + "/proxy/network/api/")
+	} else {
+		err = c.SetBaseURL(baseURL)
 	}
-	err = c.SetBaseURL(baseURL)
 	if err != nil {
 		return UnifiClient{}, err
 	}
-	err = c.Login(ctx, user, pass)
+	err = c.SetHTTPClient(httpClient)
 	if err != nil {
 		return UnifiClient{}, err
 	}
+	iface := opts.Interface
+	if iface == "" {
+		iface = "wan"
+	}
+	backend := opts.Backend
+	if backend == "" {
+		backend = "unifi"
+	}
+	initLoginFailures(backend)
 	client := UnifiClient{
-		site:  site,
-		inner: &c,
+		backend:  backend,
+		site:     opts.Site,
+		baseURL:  baseURL,
+		iface:    iface,
+		apiKey:   opts.APIKey,
+		http:     httpClient,
+		inner:    &c,
+		session:  &unifiSession{user: opts.User, pass: opts.Pass},
+		firewall: &firewallMode{},
 	}
 
 	return client, nil
 }
 
+// apiKeyTransport authenticates every request with an API key.
+type apiKeyTransport struct {
+	key  string
+	next http.RoundTripper
+}
+
+func (t apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("X-API-KEY", t.key)
+	return next.RoundTrip(req)
+}
+
+// login logs in unless the client already holds a session or authenticates with an API key.
+func (c UnifiClient) login(ctx context.Context) error {
+	if c.apiKey != "" {
+		return nil
+	}
+	c.session.mu.Lock()
+	defer c.session.mu.Unlock()
+	if c.session.loggedIn {
+		return nil
+	}
+
+	if err := c.inner.Login(ctx, c.session.user, c.session.pass); err != nil {
+		recordLoginFailure(c.backend)
+		return fmt.Errorf("unable to log in to %s: %w", c.baseURL, err)
+	}
+	c.session.loggedIn = true
+	return nil
+}
+
+// call runs fn with a valid session, logging in again once if the session has expired.
+func (c UnifiClient) call(ctx context.Context, fn func() error) error {
+	if err := c.login(ctx); err != nil {
+		return err
+	}
+
+	err := fn()
+	if !isLoginRequired(err) {
+		return err
+	}
+
+	c.session.mu.Lock()
+	c.session.loggedIn = false
+	c.session.mu.Unlock()
+	if err := c.login(ctx); err != nil {
+		return err
+	}
+	return fn()
+}
+
+func isLoginRequired(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiErr *unifi.APIError
+	if errors.As(err, &apiErr) && apiErr.Message == "api.err.LoginRequired" {
+		return true
+	}
+	return strings.Contains(err.Error(), "401 Unauthorized")
+}
+
+// Health logs in if necessary and checks that the session is accepted by the controller.
+func (c UnifiClient) Health(ctx context.Context) error {
+	return c.call(ctx, func() error {
+		return c.get(ctx, "self", &struct{}{})
+	})
+}
+
 func (c UnifiClient) CreatePortForwards(ctx context.Context, forwards []PortForward) error {
-	for _, forward := range forwards {
-		_, err := c.inner.CreatePortForward(ctx, c.site, &unifi.PortForward{
-			Enabled:       true,
-			Name:          forward.Name,
-			Fwd:           forward.Address,
-			FwdPort:       fmt.Sprint(forward.Port),
-			DstPort:       fmt.Sprint(forward.Port), // TODO: support multiple hostPorts targeting the same port
-			Src:           "any",
-			Proto:         "tcp_udp", // tcp, udp, or tcp_udp
-			PfwdInterface: "wan",     // wan, wan2, or both
-		})
+	return c.call(ctx, func() error {
+		for _, forward := range forwards {
+			rule := &unifi.PortForward{}
+			if err := c.setPortForward(ctx, rule, forward); err != nil {
+				return err
+			}
+			_, err := c.inner.CreatePortForward(ctx, c.site, rule)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c UnifiClient) UpdatePortForward(ctx context.Context, existing PortForward, desired PortForward) error {
+	return c.call(ctx, func() error {
+		rules, forwards, err := c.listPortForwards(ctx)
 		if err != nil {
 			return err
 		}
+		i := slices.IndexFunc(forwards, func(forward PortForward) bool { return reflect.DeepEqual(forward, existing) })
+		if i < 0 {
+			return fmt.Errorf("port forward %q for %s does not exist", existing.Name, existing)
+		}
+		if err = c.setPortForward(ctx, &rules[i], desired); err != nil {
+			return err
+		}
+		if _, err = c.inner.UpdatePortForward(ctx, c.site, &rules[i]); err != nil {
+			return err
+		}
+		return c.pruneSourceGroups(ctx)
+	})
+}
+
+// PortForwardByID returns the port forward with the given ID.
+func (c UnifiClient) PortForwardByID(ctx context.Context, id string) (PortForward, error) {
+	var forward PortForward
+	err := c.call(ctx, func() error {
+		rules, forwards, err := c.listPortForwards(ctx)
+		if err != nil {
+			return err
+		}
+		i := slices.IndexFunc(rules, func(rule unifi.PortForward) bool { return rule.ID == id })
+		if i < 0 {
+			return fmt.Errorf("port forward %s: %w", id, ErrRuleNotFound)
+		}
+		forward = forwards[i]
+		return nil
+	})
+	return forward, err
+}
+
+// setPortForward updates the fields of rule managed by the controller to match forward.
+func (c UnifiClient) setPortForward(ctx context.Context, rule *unifi.PortForward, forward PortForward) error {
+	rule.Enabled = true
+	rule.Name = forward.Name
+	rule.Fwd = forward.Address
+	rule.FwdPort = fmt.Sprint(forward.Port)
+	rule.DstPort = fmt.Sprint(forward.ExternalPort)
+	rule.Proto = forward.Protocol // tcp, udp, or tcp_udp
+	rule.PfwdInterface = forward.Interface
+	if rule.PfwdInterface == "" {
+		rule.PfwdInterface = c.iface
+	}
+	return c.setSources(ctx, rule, forward.Sources)
+}
+
+// UnifiInterfaces are the WAN interfaces UniFi gateways publish forwards on.
+var UnifiInterfaces = []string{"wan", "wan2", InterfaceBoth}
+
+func (c UnifiClient) DefaultInterface() string {
+	return c.iface
+}
+
+func (c UnifiClient) ValidateInterface(name string) error {
+	if !slices.Contains(UnifiInterfaces, name) {
+		return fmt.Errorf("unknown interface %q, expected one of %s", name, strings.Join(UnifiInterfaces, ", "))
 	}
 	return nil
 }
 
 func (c UnifiClient) ListPortForwards(ctx context.Context) ([]PortForward, error) {
-	forwards, err := c.inner.ListPortForward(ctx, c.site)
+	var forwards []PortForward
+	err := c.call(ctx, func() error {
+		var err error
+		_, forwards, err = c.listPortForwards(ctx)
+		return err
+	})
+	return forwards, err
+}
+
+// listPortForwards returns the rules the controller can represent, along with their conversions.
+func (c UnifiClient) listPortForwards(ctx context.Context) ([]unifi.PortForward, []PortForward, error) {
+	rules, err := c.inner.ListPortForward(ctx, c.site)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	convertedForwards := []PortForward{}
-	for _, forward := range forwards {
-		// TODO: fwdport can have value like 8000-8001!
-		// Right now, we skip them since those aren't related to the controller
-		if strings.Contains(forward.FwdPort, "-") {
-			continue
+	// Firewall groups are only fetched if a rule references one
+	var groups map[string]unifi.FirewallGroup
+	for _, rule := range rules {
+		if rule.SrcLimitingEnabled && rule.SrcLimitingType == "firewall_group" {
+			if groups, err = c.firewallGroups(ctx); err != nil {
+				return nil, nil, err
+			}
+			break
 		}
-		port, err := strconv.Atoi(forward.FwdPort)
+	}
+
+	convertedRules := []unifi.PortForward{}
+	convertedForwards := []PortForward{}
+	for _, rule := range rules {
+		convertedForward, ok, err := convertPortForward(rule, groups)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		if ok {
+			convertedRules = append(convertedRules, rule)
+			convertedForwards = append(convertedForwards, convertedForward)
 		}
+	}
+	return convertedRules, convertedForwards, nil
+}
 
-		convertedForwards = append(convertedForwards, PortForward{
-			Name:    forward.Name,
-			Address: forward.Fwd,
-			Port:    int32(port),
-		})
+func convertPortForward(forward unifi.PortForward, groups map[string]unifi.FirewallGroup) (PortForward, bool, error) {
+	// Rules for ranges or lists of ports such as 8000-8001 are never made by the controller, but
+	// their external ports may still conflict with ours
+	if strings.ContainsAny(forward.FwdPort, "-,") || strings.ContainsAny(forward.DstPort, "-,") {
+		externalPorts, err := ParsePortList(forward.DstPort)
+		if err != nil {
+			return PortForward{}, false, err
+		}
+		return PortForward{
+			Name:          forward.Name,
+			Address:       forward.Fwd,
+			Protocol:      forward.Proto,
+			Interface:     forward.PfwdInterface,
+			Sources:       convertSources(forward, groups),
+			ExternalPorts: externalPorts,
+		}, true, nil
 	}
-	return convertedForwards, nil
+	port, err := strconv.Atoi(forward.FwdPort)
+	if err != nil {
+		return PortForward{}, false, err
+	}
+	externalPort, err := strconv.Atoi(forward.DstPort)
+	if err != nil {
+		return PortForward{}, false, err
+	}
+
+	return PortForward{
+		Name:         forward.Name,
+		Address:      forward.Fwd,
+		Port:         int32(port),
+		ExternalPort: int32(externalPort),
+		Protocol:     forward.Proto,
+		Interface:    forward.PfwdInterface,
+		Sources:      convertSources(forward, groups),
+	}, true, nil
 }
 
 func (c UnifiClient) DeletePortForwards(ctx context.Context, forwards []PortForward) error {
-	// hack to fetch the ids of the to-be-deleted forwarding rules as we do not track
-	// the ids in the controller as it is Unifi-specific
-	existingForwards, err := c.inner.ListPortForward(ctx, c.site)
+	return c.call(ctx, func() error {
+		// hack to fetch the ids of the to-be-deleted forwarding rules as we do not track
+		// the ids in the controller as it is Unifi-specific
+		rules, existingForwards, err := c.listPortForwards(ctx)
+		if err != nil {
+			return err
+		}
+		var idsToDelete []string
+		for i, existingForward := range existingForwards {
+			if contains(forwards, existingForward) {
+				idsToDelete = append(idsToDelete, rules[i].ID)
+			}
+		}
+
+		for _, id := range idsToDelete {
+			err = c.inner.DeletePortForward(ctx, c.site, id)
+			if err != nil {
+				return err
+			}
+		}
+		return c.pruneSourceGroups(ctx)
+	})
+}
+
+// sourceGroupPrefix marks sources that reference a firewall address group by name.
+const sourceGroupPrefix = "group:"
+
+// managedGroupPrefix names the firewall groups the controller creates for forwards restricted to
+// several sources, as port forwards only accept a single address or a group.
+const managedGroupPrefix = "port-forward-controller-"
+
+// ValidateSources checks that the gateway can restrict a forward to the sources: IPv4 addresses,
+// ranges in CIDR notation, or a single reference to a firewall address group.
+func (c UnifiClient) ValidateSources(sources []string) error {
+	groups := 0
+	for _, source := range sources {
+		if strings.HasPrefix(source, sourceGroupPrefix) {
+			groups++
+			continue
+		}
+		if prefix, err := ParseSource(source); err != nil {
+			return err
+		} else if !prefix.Addr().Is4() {
+			return fmt.Errorf("source %q is not an IPv4 address", source)
+		}
+	}
+	if groups > 0 && len(sources) > 1 {
+		return fmt.Errorf("a firewall group reference cannot be combined with other sources")
+	}
+	return nil
+}
+
+// setSources restricts rule to the sources, creating a firewall group for them if necessary.
+func (c UnifiClient) setSources(ctx context.Context, rule *unifi.PortForward, sources []string) error {
+	rule.Src = "any"
+	rule.SrcLimitingEnabled = false
+	rule.SrcLimitingType = ""
+	rule.SrcFirewallGroupID = ""
+	if len(sources) == 0 {
+		return nil
+	}
+
+	address, groupID, err := c.sourceRestriction(ctx, sources)
+	if err != nil {
+		return err
+	}
+	rule.SrcLimitingEnabled = true
+	if groupID == "" {
+		rule.SrcLimitingType = "ip"
+		rule.Src = address
+	} else {
+		rule.SrcLimitingType = "firewall_group"
+		rule.SrcFirewallGroupID = groupID
+	}
+	return nil
+}
+
+// sourceRestriction returns either the single address the sources consist of, or the ID of the
+// firewall group holding them, creating a managed group if necessary.
+func (c UnifiClient) sourceRestriction(ctx context.Context, sources []string) (string, string, error) {
+	if len(sources) == 1 && !strings.HasPrefix(sources[0], sourceGroupPrefix) {
+		return sources[0], "", nil
+	}
+
+	groups, err := c.firewallGroups(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	name := managedGroupName(sources)
+	if len(sources) == 1 {
+		name = strings.TrimPrefix(sources[0], sourceGroupPrefix)
+	}
+	for _, group := range groups {
+		if group.Name == name && group.GroupType == "address-group" {
+			return "", group.ID, nil
+		}
+	}
+	if len(sources) == 1 {
+		return "", "", fmt.Errorf("firewall address group %q does not exist", name)
+	}
+
+	group, err := c.inner.CreateFirewallGroup(ctx, c.site, &unifi.FirewallGroup{
+		Name:         name,
+		GroupType:    "address-group",
+		GroupMembers: sortedSources(sources),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("unable to create firewall group %q: %w", name, err)
+	}
+	return "", group.ID, nil
+}
+
+// convertSources returns the sources a rule is restricted to.
+func convertSources(rule unifi.PortForward, groups map[string]unifi.FirewallGroup) []string {
+	if !rule.SrcLimitingEnabled {
+		return nil
+	}
+	switch rule.SrcLimitingType {
+	case "firewall_group":
+		return groupSources(rule.SrcFirewallGroupID, groups)
+	default:
+		if rule.Src == "" || rule.Src == "any" {
+			return nil
+		}
+		return []string{rule.Src}
+	}
+}
+
+// groupSources returns the members of managed groups as is and other groups as a reference.
+func groupSources(id string, groups map[string]unifi.FirewallGroup) []string {
+	group, ok := groups[id]
+	if !ok {
+		return []string{sourceGroupPrefix + id}
+	}
+	if strings.HasPrefix(group.Name, managedGroupPrefix) {
+		return sortedSources(group.GroupMembers)
+	}
+	return []string{sourceGroupPrefix + group.Name}
+}
+
+func (c UnifiClient) firewallGroups(ctx context.Context) (map[string]unifi.FirewallGroup, error) {
+	groups, err := c.inner.ListFirewallGroup(ctx, c.site)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[string]unifi.FirewallGroup{}
+	for _, group := range groups {
+		byID[group.ID] = group
+	}
+	return byID, nil
+}
+
+// pruneSourceGroups deletes the managed firewall groups no port forward or firewall rule
+// references anymore.
+func (c UnifiClient) pruneSourceGroups(ctx context.Context) error {
+	rules, err := c.inner.ListPortForward(ctx, c.site)
+	if err != nil {
+		return err
+	}
+	firewallRules, err := c.inner.ListFirewallRule(ctx, c.site)
+	if err != nil {
+		return err
+	}
+	groups, err := c.firewallGroups(ctx)
 	if err != nil {
 		return err
 	}
-	var idsToDelete []string
-	for _, forward := range forwards {
-		for _, existingForward := range existingForwards {
-			if forward.Name == existingForward.Name {
-				idsToDelete = append(idsToDelete, existingForward.ID)
+
+	referenced := map[string]bool{}
+	for _, rule := range rules {
+		if rule.SrcLimitingEnabled && rule.SrcLimitingType == "firewall_group" {
+			referenced[rule.SrcFirewallGroupID] = true
+		}
+	}
+	for _, rule := range firewallRules {
+		for _, id := range rule.SrcFirewallGroupIDs {
+			referenced[id] = true
+		}
+	}
+	for id, group := range groups {
+		if strings.HasPrefix(group.Name, managedGroupPrefix) && !referenced[id] {
+			if err = c.inner.DeleteFirewallGroup(ctx, c.site, id); err != nil {
+				return fmt.Errorf("unable to delete firewall group %q: %w", group.Name, err)
 			}
 		}
 	}
+	return nil
+}
 
-	for _, id := range idsToDelete {
-		err = c.inner.DeletePortForward(ctx, c.site, id)
-		if err != nil {
+// managedGroupName derives the name of the managed group from its members, so that forwards
+// restricted to the same sources share a group.
+func managedGroupName(sources []string) string {
+	digest := sha256.Sum256([]byte(strings.Join(sortedSources(sources), ",")))
+	return managedGroupPrefix + hex.EncodeToString(digest[:])[:16]
+}
+
+func sortedSources(sources []string) []string {
+	sorted := slices.Clone(sources)
+	slices.Sort(sorted)
+	return sorted
+}
+
+// WANAddress returns the IP address of the primary WAN uplink as reported by the site health API.
+func (c UnifiClient) WANAddress(ctx context.Context) (string, error) {
+	var health struct {
+		Data []struct {
+			Subsystem string `json:"subsystem"`
+			WANIP     string `json:"wan_ip"`
+		} `json:"data"`
+	}
+	err := c.call(ctx, func() error {
+		return c.get(ctx, fmt.Sprintf("s/%s/stat/health", url.PathEscape(c.site)), &health)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, subsystem := range health.Data {
+		if subsystem.Subsystem == "wan" && subsystem.WANIP != "" {
+			return subsystem.WANIP, nil
+		}
+	}
+	return "", fmt.Errorf("site %q does not report a WAN address", c.site)
+}
+
+// get fetches an API endpoint go-unifi has no wrapper for, using the session of the inner client.
+// UniFi OS consoles serve the API below /proxy/network, standalone controllers serve it directly.
+func (c UnifiClient) get(ctx context.Context, path string, out any) error {
+	var err error
+	for _, prefix := range []string{"/proxy/network/api/", "/api/"} {
+		err = c.getURL(ctx, c.baseURL+prefix+path, out)
+		if !errors.Is(err, errNotFound) {
 			return err
 		}
 	}
-	return nil
+	return err
+}
+
+var errNotFound = errors.New("not found")
+
+func (c UnifiClient) getURL(ctx context.Context, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if csrf := c.inner.CSRFToken(); csrf != "" {
+		req.Header.Set("X-Csrf-Token", csrf)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("unexpected status %s for GET %s", resp.Status, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
 }
@@ -0,0 +1,262 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/paultyng/go-unifi/unifi"
+)
+
+// firewallRuleset holds the allow rules; forwarded traffic passes WAN_IN after the DNAT.
+const firewallRuleset = "WAN_IN"
+
+// pinholeRuleset holds the IPv6 allow rules of pinholes.
+const pinholeRuleset = "WANv6_IN"
+
+// firstFirewallRuleIndex is the first index of user defined rules, which are evaluated before the
+// predefined ones.
+const firstFirewallRuleIndex = 2000
+
+// zoneBasedFirewallTTL is how long the firewall of a site is assumed to stay the same. Sites are
+// migrated to the zone based firewall once and never back.
+const zoneBasedFirewallTTL = 10 * time.Minute
+
+// firewallMode caches whether the site uses the zone based firewall.
+type firewallMode struct {
+	mu        sync.Mutex
+	zoneBased bool
+	expiry    time.Time
+}
+
+// featureMigration is a feature a site was migrated to, as listed by the v2 API of UniFi OS.
+type featureMigration struct {
+	Feature string `json:"feature"`
+}
+
+// ValidateFirewall fails on sites migrated to the zone based firewall of Network 9 and later.
+// go-unifi has no API for its policies, and the WAN_IN rules it still accepts are never applied.
+func (c UnifiClient) ValidateFirewall(ctx context.Context) error {
+	zoneBased, err := c.zoneBasedFirewall(ctx)
+	if err != nil {
+		return err
+	}
+	if zoneBased {
+		return fmt.Errorf("%w: site %s uses the zone based firewall, allow the forwards in its policies "+
+			"and turn manageFirewallRules and managePinholes off", ErrUnsupportedFirewall, c.site)
+	}
+	return nil
+}
+
+// zoneBasedFirewall reports whether the site was migrated to the zone based firewall. Standalone
+// controllers and older consoles do not know the migration at all.
+func (c UnifiClient) zoneBasedFirewall(ctx context.Context) (bool, error) {
+	c.firewall.mu.Lock()
+	defer c.firewall.mu.Unlock()
+	if time.Now().Before(c.firewall.expiry) {
+		return c.firewall.zoneBased, nil
+	}
+
+	var migrations []featureMigration
+	err := c.call(ctx, func() error {
+		return c.getURL(ctx, c.baseURL+"/proxy/network/v2/api/site/"+c.site+"/site-feature-migration", &migrations)
+	})
+	if err != nil && !errors.Is(err, errNotFound) {
+		return false, err
+	}
+	c.firewall.zoneBased = slices.ContainsFunc(migrations, func(migration featureMigration) bool {
+		return migration.Feature == "ZONE_BASED_FIREWALL"
+	})
+	c.firewall.expiry = time.Now().Add(zoneBasedFirewallTTL)
+	return c.firewall.zoneBased, nil
+}
+
+// EnsureFirewallRules makes the WAN_IN allow rules named name match the forwards.
+func (c UnifiClient) EnsureFirewallRules(ctx context.Context, name string, forwards []PortForward) error {
+	return c.ensureAllowRules(ctx, firewallRuleset, name, forwards)
+}
+
+// DeleteFirewallRules removes the WAN_IN allow rules named name.
+func (c UnifiClient) DeleteFirewallRules(ctx context.Context, name string) error {
+	return c.EnsureFirewallRules(ctx, name, nil)
+}
+
+// EnsurePinholes makes the WANv6_IN allow rules named name match the pinholes.
+func (c UnifiClient) EnsurePinholes(ctx context.Context, name string, pinholes []PortForward) error {
+	for _, pinhole := range pinholes {
+		if len(pinhole.Sources) > 0 {
+			return errors.New("source restrictions of pinholes are not supported")
+		}
+	}
+	return c.ensureAllowRules(ctx, pinholeRuleset, name, pinholes)
+}
+
+// DeletePinholes removes the WANv6_IN allow rules named name.
+func (c UnifiClient) DeletePinholes(ctx context.Context, name string) error {
+	return c.EnsurePinholes(ctx, name, nil)
+}
+
+// ensureAllowRules makes the allow rules named name in the ruleset match the forwards. Rules are
+// still removed on sites using the zone based firewall, but never made.
+func (c UnifiClient) ensureAllowRules(ctx context.Context, ruleset string, name string, forwards []PortForward) error {
+	if len(forwards) > 0 {
+		if err := c.ValidateFirewall(ctx); err != nil {
+			return err
+		}
+	}
+	return c.call(ctx, func() error {
+		rules, err := c.inner.ListFirewallRule(ctx, c.site)
+		if err != nil {
+			return err
+		}
+		groups, err := c.firewallGroups(ctx)
+		if err != nil {
+			return err
+		}
+
+		desired := []PortForward{}
+		for _, forward := range forwards {
+			desired = appendMissing(desired, firewallForward(forward))
+		}
+		changed := false
+		existing := []PortForward{}
+		usedIndexes := map[int]bool{}
+		for _, rule := range rules {
+			if rule.Ruleset != ruleset {
+				continue
+			}
+			usedIndexes[rule.RuleIndex] = true
+			if rule.Name != name {
+				continue
+			}
+			forward := convertFirewallRule(rule, groups)
+			if contains(desired, forward) && !contains(existing, forward) {
+				existing = append(existing, forward)
+				continue
+			}
+			if err = c.inner.DeleteFirewallRule(ctx, c.site, rule.ID); err != nil {
+				return err
+			}
+			changed = true
+		}
+
+		index := firstFirewallRuleIndex
+		for _, forward := range desired {
+			if contains(existing, forward) {
+				continue
+			}
+			for usedIndexes[index] {
+				index++
+			}
+			usedIndexes[index] = true
+			rule, err := c.firewallRule(ctx, ruleset, forward, index)
+			if err != nil {
+				return err
+			}
+			if _, err = c.inner.CreateFirewallRule(ctx, c.site, rule); err != nil {
+				return err
+			}
+			changed = true
+		}
+		if !changed {
+			return nil
+		}
+		return c.pruneSourceGroups(ctx)
+	})
+}
+
+// firewallForward returns the part of a forward an allow rule matches on: the traffic to the
+// forwarded address and port after the DNAT, from the allowed sources.
+func firewallForward(forward PortForward) PortForward {
+	return PortForward{
+		Name:     forward.Name,
+		Address:  forward.Address,
+		Port:     forward.Port,
+		Protocol: forward.Protocol,
+		Sources:  forward.Sources,
+		Family:   forward.Family,
+	}
+}
+
+func (c UnifiClient) firewallRule(ctx context.Context, ruleset string, forward PortForward, index int) (*unifi.FirewallRule, error) {
+	if ruleset == pinholeRuleset {
+		return &unifi.FirewallRule{
+			Name:           forward.Name,
+			Ruleset:        pinholeRuleset,
+			RuleIndex:      index,
+			Action:         "accept",
+			Enabled:        true,
+			ProtocolV6:     forward.Protocol,
+			DstAddressIPV6: forward.Address,
+			DstPort:        fmt.Sprint(forward.Port),
+			StateNew:       true,
+		}, nil
+	}
+	rule := &unifi.FirewallRule{
+		Name:           forward.Name,
+		Ruleset:        firewallRuleset,
+		RuleIndex:      index,
+		Action:         "accept",
+		Enabled:        true,
+		Protocol:       forward.Protocol,
+		DstAddress:     forward.Address,
+		DstPort:        fmt.Sprint(forward.Port),
+		DstNetworkType: "ADDRv4",
+		SrcNetworkType: "NETv4",
+		StateNew:       true,
+	}
+	if len(forward.Sources) > 0 {
+		address, groupID, err := c.sourceRestriction(ctx, forward.Sources)
+		if err != nil {
+			return nil, err
+		}
+		if groupID == "" {
+			rule.SrcAddress = address
+		} else {
+			rule.SrcFirewallGroupIDs = []string{groupID}
+		}
+	}
+	return rule, nil
+}
+
+func convertFirewallRule(rule unifi.FirewallRule, groups map[string]unifi.FirewallGroup) PortForward {
+	port, _ := strconv.Atoi(rule.DstPort)
+	forward := PortForward{
+		Name:     rule.Name,
+		Address:  rule.DstAddress,
+		Port:     int32(port),
+		Protocol: rule.Protocol,
+	}
+	if rule.Ruleset == pinholeRuleset {
+		forward.Family = FamilyIPv6
+		forward.Address = rule.DstAddressIPV6
+		forward.Protocol = rule.ProtocolV6
+	}
+	switch {
+	case len(rule.SrcFirewallGroupIDs) > 0:
+		forward.Sources = groupSources(rule.SrcFirewallGroupIDs[0], groups)
+	case rule.SrcAddress != "":
+		forward.Sources = []string{rule.SrcAddress}
+	}
+	return forward
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarding
+
+import (
+	"github.com/paultyng/go-unifi/unifi"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UnifiClient sources", func() {
+	client := UnifiClient{}
+
+	It("should accept addresses, ranges and a single group", func() {
+		Expect(client.ValidateSources([]string{"192.0.2.1", "198.51.100.0/24"})).To(Succeed())
+		Expect(client.ValidateSources([]string{"group:office"})).To(Succeed())
+		Expect(client.ValidateSources([]string{"group:office", "192.0.2.1"})).NotTo(Succeed())
+		Expect(client.ValidateSources([]string{"2001:db8::/32"})).NotTo(Succeed())
+		Expect(client.ValidateSources([]string{"example.com"})).NotTo(Succeed())
+	})
+
+	It("should convert the source restrictions of rules", func() {
+		groups := map[string]unifi.FirewallGroup{
+			"1": {ID: "1", Name: managedGroupName([]string{"198.51.100.0/24", "192.0.2.1"}), GroupMembers: []string{"198.51.100.0/24", "192.0.2.1"}},
+			"2": {ID: "2", Name: "office"},
+		}
+
+		Expect(convertSources(unifi.PortForward{Src: "any"}, groups)).To(BeNil())
+		Expect(convertSources(unifi.PortForward{SrcLimitingEnabled: true, SrcLimitingType: "ip", Src: "192.0.2.1"}, groups)).
+			To(Equal([]string{"192.0.2.1"}))
+		Expect(convertSources(unifi.PortForward{SrcLimitingEnabled: true, SrcLimitingType: "firewall_group", SrcFirewallGroupID: "1"}, groups)).
+			To(Equal([]string{"192.0.2.1", "198.51.100.0/24"}))
+		Expect(convertSources(unifi.PortForward{SrcLimitingEnabled: true, SrcLimitingType: "firewall_group", SrcFirewallGroupID: "2"}, groups)).
+			To(Equal([]string{"group:office"}))
+	})
+
+	It("should share managed groups between forwards with the same sources", func() {
+		Expect(managedGroupName([]string{"192.0.2.1", "198.51.100.0/24"})).
+			To(Equal(managedGroupName([]string{"198.51.100.0/24", "192.0.2.1"})))
+		Expect(len(managedGroupName([]string{"192.0.2.1"}))).To(BeNumerically("<=", 64))
+	})
+})
+
+var _ = Describe("UnifiClient rules", func() {
+	It("should list rules for ranges and lists of ports for conflict detection", func() {
+		forward, ok, err := convertPortForward(unifi.PortForward{
+			Name: "games", Fwd: "10.0.0.2", FwdPort: "25560-25570", DstPort: "25560-25570", Proto: "tcp",
+		}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(forward.ExternalPorts).To(Equal([]PortRange{{First: 25560, Last: 25570}}))
+		Expect(forward.String()).To(Equal("25560-25570/tcp"))
+		Expect(forward.Overlaps(PortForward{ExternalPort: 25565, Protocol: "tcp"})).To(BeTrue())
+		Expect(forward.Overlaps(PortForward{ExternalPort: 25571, Protocol: "tcp"})).To(BeFalse())
+
+		forward, _, err = convertPortForward(unifi.PortForward{Name: "web", FwdPort: "80,443", DstPort: "80,443", Proto: "tcp"}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(forward.Overlaps(PortForward{ExternalPort: 443, Protocol: "tcp_udp"})).To(BeTrue())
+		Expect(forward.Overlaps(PortForward{ExternalPort: 444, Protocol: "tcp"})).To(BeFalse())
+	})
+})
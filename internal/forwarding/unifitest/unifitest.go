@@ -0,0 +1,467 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package unifitest emulates the API of a UniFi Network controller, so that the controller can be
+// tested without a device. It serves login and logout with session cookies and CSRF tokens, the
+// rest collections of port forwards and firewall rules per site, and the endpoints the
+// controller reads the WAN address and health from. Sessions expire and requests are rate
+// limited like on a console, if configured.
+//
+// Serve it with httptest.NewServer in tests, or run cmd/unifi-emulator.
+package unifitest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/paultyng/go-unifi/unifi"
+)
+
+// Options configures an Emulator.
+type Options struct {
+	// Username and Password are the credentials accepted by the login endpoint
+	Username string
+	Password string
+	// APIKey is accepted in the X-API-KEY header by UniFi OS consoles, unless empty
+	APIKey string
+	// Sites are the sites of the controller, "default" unless given
+	Sites []string
+	// WANAddress is reported as the address of the WAN uplink of every site
+	WANAddress string
+	// Version is the reported version of the Network application
+	Version string
+	// SessionTTL is how long a login is valid. Zero keeps sessions forever.
+	SessionTTL time.Duration
+	// RateLimit is the number of requests served per second. Zero serves every request.
+	RateLimit int
+	// Legacy serves the API of a standalone Network controller instead of a UniFi OS console:
+	// the API below / instead of /proxy/network, and the old login endpoint.
+	Legacy bool
+	// ZoneBasedFirewall reports the site as migrated to the zone based firewall of Network 9. The
+	// firewall rules are still served, like a console does.
+	ZoneBasedFirewall bool
+}
+
+// Emulator is an http.Handler serving the API of a UniFi Network controller from memory.
+type Emulator struct {
+	opts Options
+	mux  *http.ServeMux
+
+	mu       sync.Mutex
+	sessions map[string]session
+	sites    map[string]map[string][]map[string]any
+	nextID   int
+	window   time.Time
+	requests int
+}
+
+// session is a login, identified by the value of its cookie.
+type session struct {
+	csrf    string
+	expires time.Time
+}
+
+// New returns an emulator with the given options and no rules.
+func New(opts Options) *Emulator {
+	if len(opts.Sites) == 0 {
+		opts.Sites = []string{"default"}
+	}
+	if opts.Version == "" {
+		opts.Version = "8.4.59"
+	}
+	e := &Emulator{
+		opts:     opts,
+		mux:      http.NewServeMux(),
+		sessions: map[string]session{},
+		sites:    map[string]map[string][]map[string]any{},
+	}
+	for _, site := range opts.Sites {
+		e.sites[site] = map[string][]map[string]any{}
+	}
+
+	prefix, loginPath, logoutPath := "/proxy/network", "/api/auth/login", "/api/auth/logout"
+	if opts.Legacy {
+		prefix, loginPath, logoutPath = "", "/api/login", "/api/logout"
+	}
+	e.mux.HandleFunc("GET /{$}", e.root)
+	e.mux.HandleFunc("POST "+loginPath, e.login)
+	e.mux.HandleFunc("POST "+logoutPath, e.logout)
+	e.mux.HandleFunc("GET "+prefix+"/status", e.status)
+	e.mux.HandleFunc(prefix+"/api/self", e.authorized(e.self))
+	e.mux.HandleFunc(prefix+"/api/self/sites", e.authorized(e.listSites))
+	e.mux.HandleFunc(prefix+"/api/s/{site}/stat/health", e.authorized(e.health))
+	e.mux.HandleFunc(prefix+"/api/s/{site}/stat/sysinfo", e.authorized(e.sysinfo))
+	e.mux.HandleFunc(prefix+"/api/s/{site}/rest/{collection}", e.authorized(e.collection))
+	e.mux.HandleFunc(prefix+"/api/s/{site}/rest/{collection}/{id}", e.authorized(e.object))
+	if !opts.Legacy {
+		e.mux.HandleFunc("GET "+prefix+"/v2/api/site/{site}/site-feature-migration", e.authorized(e.migrations))
+	}
+	return e
+}
+
+func (e *Emulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !e.allow() {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusTooManyRequests, "api.err.RateLimited")
+		return
+	}
+	e.mux.ServeHTTP(w, r)
+}
+
+// allow counts the request and reports whether it is within the rate limit.
+func (e *Emulator) allow() bool {
+	if e.opts.RateLimit <= 0 {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	if now.Sub(e.window) >= time.Second {
+		e.window, e.requests = now, 0
+	}
+	e.requests++
+	return e.requests <= e.opts.RateLimit
+}
+
+// cookieName is the name of the session cookie.
+func (e *Emulator) cookieName() string {
+	if e.opts.Legacy {
+		return "unifises"
+	}
+	return "TOKEN"
+}
+
+// root answers like a console, which go-unifi uses to detect the style of the API: UniFi OS
+// serves its login page, standalone controllers redirect to /manage.
+func (e *Emulator) root(w http.ResponseWriter, r *http.Request) {
+	if e.opts.Legacy {
+		http.Redirect(w, r, "/manage", http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprint(w, "<html><body>UniFi OS</body></html>")
+}
+
+func (e *Emulator) login(w http.ResponseWriter, r *http.Request) {
+	var credentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+		writeError(w, http.StatusBadRequest, "api.err.InvalidPayload")
+		return
+	}
+	if credentials.Username != e.opts.Username || credentials.Password != e.opts.Password {
+		writeError(w, http.StatusUnauthorized, "api.err.Invalid")
+		return
+	}
+
+	token, csrf := randomToken(), randomToken()
+	e.mu.Lock()
+	s := session{csrf: csrf}
+	if e.opts.SessionTTL > 0 {
+		s.expires = time.Now().Add(e.opts.SessionTTL)
+	}
+	e.sessions[token] = s
+	e.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: e.cookieName(), Value: token, Path: "/", HttpOnly: true})
+	w.Header().Set("X-Csrf-Token", csrf)
+	writeData(w, []any{})
+}
+
+func (e *Emulator) logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(e.cookieName()); err == nil {
+		e.mu.Lock()
+		delete(e.sessions, cookie.Value)
+		e.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: e.cookieName(), Value: "", Path: "/", MaxAge: -1})
+	writeData(w, []any{})
+}
+
+func (e *Emulator) status(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"meta": map[string]any{"rc": "ok", "up": true, "server_version": e.opts.Version},
+		"data": []any{},
+	})
+}
+
+// authorized only passes requests on with a valid session, or API key, and site. Changes need
+// the CSRF token of the session.
+func (e *Emulator) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if site := r.PathValue("site"); site != "" && !e.hasSite(site) {
+			writeError(w, http.StatusBadRequest, "api.err.NoSiteContext")
+			return
+		}
+		if key := r.Header.Get("X-API-KEY"); key != "" && !e.opts.Legacy && key == e.opts.APIKey {
+			next(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(e.cookieName())
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "api.err.LoginRequired")
+			return
+		}
+		e.mu.Lock()
+		s, ok := e.sessions[cookie.Value]
+		if ok && !s.expires.IsZero() && time.Now().After(s.expires) {
+			delete(e.sessions, cookie.Value)
+			ok = false
+		}
+		e.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "api.err.LoginRequired")
+			return
+		}
+		if r.Method != http.MethodGet && r.Header.Get("X-Csrf-Token") != s.csrf {
+			writeError(w, http.StatusForbidden, "api.err.InvalidCSRFToken")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (e *Emulator) hasSite(site string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.sites[site]
+	return ok
+}
+
+func (e *Emulator) self(w http.ResponseWriter, _ *http.Request) {
+	writeData(w, []any{map[string]any{"name": e.opts.Username, "site_role": "admin"}})
+}
+
+func (e *Emulator) listSites(w http.ResponseWriter, _ *http.Request) {
+	sites := []any{}
+	for _, site := range e.opts.Sites {
+		sites = append(sites, map[string]any{"name": site, "desc": site, "role": "admin"})
+	}
+	writeData(w, sites)
+}
+
+func (e *Emulator) health(w http.ResponseWriter, _ *http.Request) {
+	writeData(w, []any{
+		map[string]any{"subsystem": "wan", "status": "ok", "wan_ip": e.opts.WANAddress},
+		map[string]any{"subsystem": "lan", "status": "ok"},
+	})
+}
+
+func (e *Emulator) sysinfo(w http.ResponseWriter, _ *http.Request) {
+	writeData(w, []any{map[string]any{"version": e.opts.Version}})
+}
+
+// migrations lists the features the site was migrated to.
+func (e *Emulator) migrations(w http.ResponseWriter, _ *http.Request) {
+	features := []any{}
+	if e.opts.ZoneBasedFirewall {
+		features = append(features, map[string]any{"feature": "ZONE_BASED_FIREWALL"})
+	}
+	writeJSON(w, http.StatusOK, features)
+}
+
+// collection lists the objects of a rest collection or creates one.
+func (e *Emulator) collection(w http.ResponseWriter, r *http.Request) {
+	site, name := r.PathValue("site"), r.PathValue("collection")
+	switch r.Method {
+	case http.MethodGet:
+		e.mu.Lock()
+		objects := slices.Clone(e.sites[site][name])
+		e.mu.Unlock()
+		writeData(w, toAny(objects))
+	case http.MethodPost:
+		object, ok := decodeObject(w, r, name)
+		if !ok {
+			return
+		}
+		e.mu.Lock()
+		e.insert(site, name, object)
+		e.mu.Unlock()
+		writeData(w, []any{object})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "api.err.InvalidMethod")
+	}
+}
+
+// object reads, replaces or deletes an object of a rest collection.
+func (e *Emulator) object(w http.ResponseWriter, r *http.Request) {
+	site, name, id := r.PathValue("site"), r.PathValue("collection"), r.PathValue("id")
+	e.mu.Lock()
+	objects := e.sites[site][name]
+	i := slices.IndexFunc(objects, func(object map[string]any) bool { return object["_id"] == id })
+	e.mu.Unlock()
+	if i < 0 {
+		writeError(w, http.StatusNotFound, "api.err.IdInvalid")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeData(w, []any{objects[i]})
+	case http.MethodPut:
+		object, ok := decodeObject(w, r, name)
+		if !ok {
+			return
+		}
+		object["_id"], object["site_id"] = id, site
+		e.mu.Lock()
+		e.sites[site][name] = replace(e.sites[site][name], id, object)
+		e.mu.Unlock()
+		writeData(w, []any{object})
+	case http.MethodDelete:
+		e.mu.Lock()
+		e.sites[site][name] = replace(e.sites[site][name], id, nil)
+		e.mu.Unlock()
+		writeData(w, []any{})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "api.err.InvalidMethod")
+	}
+}
+
+// insert adds the object to the collection with a new ID. The lock must be held.
+func (e *Emulator) insert(site string, name string, object map[string]any) string {
+	e.nextID++
+	id := fmt.Sprintf("%024x", e.nextID)
+	object["_id"], object["site_id"] = id, site
+	e.sites[site][name] = append(e.sites[site][name], object)
+	return id
+}
+
+// replace returns the objects with the one of the given ID replaced, or removed if object is nil.
+func replace(objects []map[string]any, id string, object map[string]any) []map[string]any {
+	result := []map[string]any{}
+	for _, existing := range objects {
+		switch {
+		case existing["_id"] != id:
+			result = append(result, existing)
+		case object != nil:
+			result = append(result, object)
+		}
+	}
+	return result
+}
+
+// decodeObject reads an object of the collection from the request, rejecting port forwards the
+// controller would not accept either.
+func decodeObject(w http.ResponseWriter, r *http.Request, collection string) (map[string]any, bool) {
+	var object map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&object); err != nil || object == nil {
+		writeError(w, http.StatusBadRequest, "api.err.InvalidPayload")
+		return nil, false
+	}
+	if collection == "portforward" {
+		for _, field := range []string{"name", "fwd", "fwd_port", "dst_port"} {
+			if value, _ := object[field].(string); value == "" {
+				writeError(w, http.StatusBadRequest, "api.err.InvalidPayload")
+				return nil, false
+			}
+		}
+		if proto, _ := object["proto"].(string); proto != "tcp" && proto != "udp" && proto != "tcp_udp" {
+			writeError(w, http.StatusBadRequest, "api.err.InvalidPayload")
+			return nil, false
+		}
+	}
+	return object, true
+}
+
+// ExpireSessions ends every session, as if they had timed out.
+func (e *Emulator) ExpireSessions() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sessions = map[string]session{}
+}
+
+// PortForwards returns the port forwards of the site.
+func (e *Emulator) PortForwards(site string) []unifi.PortForward {
+	var forwards []unifi.PortForward
+	e.decodeCollection(site, "portforward", &forwards)
+	return forwards
+}
+
+// FirewallRules returns the firewall rules of the site.
+func (e *Emulator) FirewallRules(site string) []unifi.FirewallRule {
+	var rules []unifi.FirewallRule
+	e.decodeCollection(site, "firewallrule", &rules)
+	return rules
+}
+
+// AddPortForward adds a port forward to the site, e.g. one made by hand, and returns its ID.
+func (e *Emulator) AddPortForward(site string, forward unifi.PortForward) (string, error) {
+	data, err := json.Marshal(forward)
+	if err != nil {
+		return "", err
+	}
+	var object map[string]any
+	if err = json.Unmarshal(data, &object); err != nil {
+		return "", err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.sites[site]; !ok {
+		return "", fmt.Errorf("unknown site %q", site)
+	}
+	return e.insert(site, "portforward", object), nil
+}
+
+func (e *Emulator) decodeCollection(site string, name string, out any) {
+	e.mu.Lock()
+	data, _ := json.Marshal(e.sites[site][name])
+	e.mu.Unlock()
+	_ = json.Unmarshal(data, out)
+}
+
+func toAny(objects []map[string]any) []any {
+	result := make([]any, 0, len(objects))
+	for _, object := range objects {
+		result = append(result, object)
+	}
+	return result
+}
+
+func randomToken() string {
+	token := make([]byte, 16)
+	_, _ = rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+func writeData(w http.ResponseWriter, data []any) {
+	writeJSON(w, http.StatusOK, map[string]any{"meta": map[string]any{"rc": "ok"}, "data": data})
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]any{"meta": map[string]any{"rc": "error", "msg": message}, "data": []any{}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
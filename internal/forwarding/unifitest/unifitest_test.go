@@ -0,0 +1,243 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unifitest
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/paultyng/go-unifi/unifi"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"atte.cloud/port-forward-controller/internal/forwarding"
+)
+
+func TestUnifitest(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "UniFi Emulator Suite")
+}
+
+var _ = Describe("Emulator", func() {
+	var (
+		ctx      context.Context
+		opts     Options
+		emulator *Emulator
+		server   *httptest.Server
+	)
+
+	forward := func(port int32) forwarding.PortForward {
+		return forwarding.PortForward{Name: "k8s-default-pod", Address: "10.0.0.1", Port: port, ExternalPort: port, Protocol: "tcp"}
+	}
+
+	newClient := func(site string) forwarding.UnifiClient {
+		client, err := forwarding.NewUnifiClient(forwarding.UnifiOptions{
+			Site: site, BaseURL: server.URL, User: "admin", Pass: "secret",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return client
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		opts = Options{Username: "admin", Password: "secret", Sites: []string{"default", "office"}, WANAddress: "203.0.113.1"}
+	})
+
+	JustBeforeEach(func() {
+		emulator = New(opts)
+		server = httptest.NewServer(emulator)
+		DeferCleanup(server.Close)
+	})
+
+	It("should serve the rules of each site on its own", func() {
+		Expect(newClient("default").CreatePortForwards(ctx, []forwarding.PortForward{forward(25565)})).To(Succeed())
+		Expect(emulator.PortForwards("default")).To(ConsistOf(HaveField("DstPort", "25565")))
+		Expect(emulator.PortForwards("office")).To(BeEmpty())
+
+		forwards, err := newClient("office").ListPortForwards(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(forwards).To(BeEmpty())
+		_, err = newClient("elsewhere").ListPortForwards(ctx)
+		Expect(err).To(MatchError(ContainSubstring("api.err.NoSiteContext")))
+	})
+
+	It("should report the WAN address", func() {
+		Expect(newClient("default").WANAddress(ctx)).To(Equal("203.0.113.1"))
+	})
+
+	It("should reject wrong credentials", func() {
+		client, err := forwarding.NewUnifiClient(forwarding.UnifiOptions{
+			Backend: "home", Site: "default", BaseURL: server.URL, User: "admin", Pass: "wrong",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		failures := loginFailures("home")
+		Expect(client.Health(ctx)).To(MatchError(ContainSubstring("unable to log in")))
+		Expect(loginFailures("home")).To(Equal(failures + 1))
+	})
+
+	It("should let clients log in again once their session expired", func() {
+		client := newClient("default")
+		Expect(client.Health(ctx)).To(Succeed())
+		emulator.ExpireSessions()
+		Expect(client.CreatePortForwards(ctx, []forwarding.PortForward{forward(25565)})).To(Succeed())
+		Expect(emulator.PortForwards("default")).To(HaveLen(1))
+	})
+
+	It("should require the CSRF token of the session for changes", func() {
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+		resp, err := client.Post(server.URL+"/api/auth/login", "application/json",
+			strings.NewReader(`{"username":"admin","password":"secret"}`))
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		csrf := resp.Header.Get("X-Csrf-Token")
+		Expect(csrf).NotTo(BeEmpty())
+
+		url := server.URL + "/proxy/network/api/s/default/rest/portforward"
+		body := `{"name":"manual","fwd":"10.0.0.1","fwd_port":"22","dst_port":"2222","proto":"tcp"}`
+		resp, err = client.Post(url, "application/json", strings.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+
+		req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		req.Header.Set("X-Csrf-Token", csrf)
+		resp, err = client.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		resp, err = client.Post(server.URL+"/api/auth/logout", "application/json", nil)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		resp, err = client.Get(url)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should keep rules made by hand", func() {
+		id, err := emulator.AddPortForward("default", unifi.PortForward{
+			Name: "manual", Fwd: "10.0.0.1", FwdPort: "25565", DstPort: "25565", Proto: "tcp", Enabled: true,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		rule, err := newClient("default").PortForwardByID(ctx, id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rule.Name).To(Equal("manual"))
+	})
+
+	It("should open pinholes in the IPv6 ruleset", func() {
+		pinhole := forwarding.PortForward{Name: "k8s-default-pod", Family: forwarding.FamilyIPv6,
+			Address: "2001:db8::1", Port: 25565, ExternalPort: 25565, Protocol: "tcp"}
+		client := newClient("default")
+		Expect(client.EnsurePinholes(ctx, "k8s-default-pod", []forwarding.PortForward{pinhole})).To(Succeed())
+		Expect(emulator.FirewallRules("default")).To(ConsistOf(And(
+			HaveField("Ruleset", "WANv6_IN"),
+			HaveField("DstAddressIPV6", "2001:db8::1"),
+		)))
+		Expect(client.DeletePinholes(ctx, "k8s-default-pod")).To(Succeed())
+		Expect(emulator.FirewallRules("default")).To(BeEmpty())
+	})
+
+	Context("with the zone based firewall", func() {
+		BeforeEach(func() {
+			opts.ZoneBasedFirewall = true
+		})
+
+		It("should refuse to make allow rules", func() {
+			client := newClient("default")
+			Expect(client.ValidateFirewall(ctx)).To(MatchError(forwarding.ErrUnsupportedFirewall))
+			err := client.EnsureFirewallRules(ctx, "k8s-default-pod", []forwarding.PortForward{forward(25565)})
+			Expect(err).To(MatchError(forwarding.ErrUnsupportedFirewall))
+			Expect(emulator.FirewallRules("default")).To(BeEmpty())
+			Expect(client.DeleteFirewallRules(ctx, "k8s-default-pod")).To(Succeed())
+		})
+	})
+
+	Context("with a rate limit", func() {
+		BeforeEach(func() {
+			opts.RateLimit = 2
+		})
+
+		It("should reject requests above it", func() {
+			statuses := []int{}
+			for range 3 {
+				resp, err := http.Get(server.URL + "/proxy/network/status")
+				Expect(err).NotTo(HaveOccurred())
+				resp.Body.Close()
+				statuses = append(statuses, resp.StatusCode)
+			}
+			Expect(statuses).To(Equal([]int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}))
+		})
+	})
+
+	Context("as a standalone controller", func() {
+		BeforeEach(func() {
+			opts.Legacy = true
+		})
+
+		It("should serve the API without the UniFi OS prefix", func() {
+			client := newClient("default")
+			Expect(client.CreatePortForwards(ctx, []forwarding.PortForward{forward(25565)})).To(Succeed())
+			Expect(client.WANAddress(ctx)).To(Equal("203.0.113.1"))
+			Expect(client.ValidateFirewall(ctx)).To(Succeed())
+			Expect(emulator.PortForwards("default")).To(HaveLen(1))
+		})
+	})
+
+	Context("with an API key", func() {
+		BeforeEach(func() {
+			opts.APIKey = "key"
+		})
+
+		It("should accept the key instead of a session", func() {
+			client, err := forwarding.NewUnifiClient(forwarding.UnifiOptions{
+				Site: "default", BaseURL: server.URL, APIKey: "key",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(client.CreatePortForwards(ctx, []forwarding.PortForward{forward(25565)})).To(Succeed())
+			Expect(emulator.PortForwards("default")).To(HaveLen(1))
+		})
+	})
+})
+
+// loginFailures returns the number of failed logins recorded for a backend.
+func loginFailures(backend string) float64 {
+	families, err := metrics.Registry.Gather()
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != "port_forward_controller_login_failures_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "backend" && label.GetValue() == backend {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	Fail("no login failures recorded for backend " + backend)
+	return 0
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"atte.cloud/port-forward-controller/internal/controller"
+)
+
+// podlog is for logging in this package.
+var podlog = logf.Log.WithName("pod-resource")
+
+// SetupPodWebhookWithManager registers the webhook for Pods in the manager. It validates pods with
+// the same rules the reconciler applies.
+func SetupPodWebhookWithManager(mgr ctrl.Manager, pods *controller.PodReconciler) error {
+	return ctrl.NewWebhookManagedBy(mgr).For(&corev1.Pod{}).
+		WithValidator(&PodCustomValidator{Pods: pods}).
+		Complete()
+}
+
+// Pods are validated leniently: the webhook is skipped if the controller is down, as it must not
+// keep unrelated pods from being scheduled. config/webhook/pod_webhook_patch.yaml limits it to
+// pods that could be forwarded, outside the namespace of the controller.
+// +kubebuilder:webhook:path=/validate--v1-pod,mutating=false,failurePolicy=ignore,sideEffects=None,groups="",resources=pods,verbs=create;update,versions=v1,name=vpod-v1.kb.io,admissionReviewVersions=v1
+
+// PodCustomValidator rejects pods whose forwarding annotations cannot be applied and warns about
+// external ports other pods already claim.
+type PodCustomValidator struct {
+	Pods *controller.PodReconciler
+}
+
+var _ webhook.CustomValidator = &PodCustomValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type Pod.
+func (v *PodCustomValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil, fmt.Errorf("expected a Pod object but got %T", obj)
+	}
+	return v.validate(ctx, pod)
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type Pod.
+func (v *PodCustomValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	oldPod, ok := oldObj.(*corev1.Pod)
+	if !ok {
+		return nil, fmt.Errorf("expected a Pod object for the oldObj but got %T", oldObj)
+	}
+	pod, ok := newObj.(*corev1.Pod)
+	if !ok {
+		return nil, fmt.Errorf("expected a Pod object for the newObj but got %T", newObj)
+	}
+	// Pods admitted before the webhook existed must not block the updates of the controller
+	if !controller.UserAnnotationsChanged(oldPod, pod) {
+		return nil, nil
+	}
+	return v.validate(ctx, pod)
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type Pod.
+func (v *PodCustomValidator) ValidateDelete(_ context.Context, _ runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *PodCustomValidator) validate(ctx context.Context, pod *corev1.Pod) (admission.Warnings, error) {
+	if err := v.Pods.CheckPod(ctx, pod); err != nil {
+		podlog.Info("Rejecting pod", "namespace", pod.Namespace, "name", pod.Name, "generateName", pod.GenerateName,
+			"reason", err.Error())
+		return nil, err
+	}
+	violation, err := v.Pods.PolicyViolation(ctx, pod)
+	if err != nil {
+		// Enforced by the controller regardless
+		podlog.Error(err, "Unable to check forwarding policies")
+	} else if violation != "" {
+		podlog.Info("Rejecting pod", "namespace", pod.Namespace, "name", pod.Name, "generateName", pod.GenerateName,
+			"reason", violation)
+		return nil, errors.New(violation)
+	}
+	conflicts, err := v.Pods.LikelyConflicts(ctx, pod)
+	if err != nil {
+		// Warnings are best effort
+		podlog.Error(err, "Unable to look for conflicting pods")
+		return nil, nil
+	}
+	return conflicts, nil
+}
@@ -0,0 +1,320 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	forwardingv1alpha1 "atte.cloud/port-forward-controller/api/v1alpha1"
+	"atte.cloud/port-forward-controller/internal/controller"
+	"atte.cloud/port-forward-controller/internal/forwarding"
+)
+
+var _ = Describe("Pod Webhook", func() {
+	var (
+		ctx       context.Context
+		validator *PodCustomValidator
+	)
+
+	newPod := func(name string, hostPort int32, annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{
+				Name:  "app",
+				Ports: []corev1.ContainerPort{{ContainerPort: 80, HostPort: hostPort, Protocol: corev1.ProtocolTCP}},
+			}}},
+			Status: corev1.PodStatus{HostIP: "10.0.0.1"},
+		}
+	}
+	enabled := map[string]string{controller.EnableAnnotation: "true"}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		reserved, err := forwarding.ParsePortRange("22")
+		Expect(err).NotTo(HaveOccurred())
+		scheme := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(forwardingv1alpha1.AddToScheme(scheme)).To(Succeed())
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: map[string]string{"tier": "games"}}}
+		validator = &PodCustomValidator{Pods: &controller.PodReconciler{
+			Client:        fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace).Build(),
+			Scheme:        scheme,
+			Fwd:           &forwarding.ForwardingReconciler{Backend: "default", RulePrefix: "k8s-"},
+			ReservedPorts: []forwarding.PortRange{reserved},
+		}}
+	})
+
+	It("should admit pods that do not opt in", func() {
+		warnings, err := validator.ValidateCreate(ctx, newPod("plain", 0, nil))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).To(BeEmpty())
+	})
+
+	It("should reject malformed annotations", func() {
+		_, err := validator.ValidateCreate(ctx, newPod("typo", 8080, map[string]string{
+			controller.Annotation + "/enabled": "true",
+		}))
+		Expect(err).To(MatchError(ContainSubstring("unknown annotation")))
+
+		_, err = validator.ValidateCreate(ctx, newPod("yes", 8080, map[string]string{
+			controller.EnableAnnotation: "yes",
+		}))
+		Expect(err).To(MatchError(ContainSubstring("must be true or false")))
+
+		_, err = validator.ValidateCreate(ctx, newPod("mapping", 8080, map[string]string{
+			controller.EnableAnnotation:       "true",
+			controller.ExternalPortAnnotation: "8080",
+		}))
+		Expect(err).To(MatchError(ContainSubstring("invalid port mapping")))
+	})
+
+	It("should reject pods that opt in without hostPorts", func() {
+		_, err := validator.ValidateCreate(ctx, newPod("no-host-port", 0, enabled))
+		Expect(err).To(MatchError(ContainSubstring("no hostPorts")))
+	})
+
+	It("should check pods opted in by their namespace or labels", func() {
+		var namespace corev1.Namespace
+		Expect(validator.Pods.Get(ctx, client.ObjectKey{Name: "default"}, &namespace)).To(Succeed())
+		namespace.Labels[controller.EnableAnnotation] = "true"
+		Expect(validator.Pods.Update(ctx, &namespace)).To(Succeed())
+
+		_, err := validator.ValidateCreate(ctx, newPod("ssh", 22, nil))
+		Expect(err).To(MatchError(ContainSubstring("external port 22 is reserved")))
+		_, err = validator.ValidateCreate(ctx, newPod("opted-out", 22, map[string]string{
+			controller.EnableAnnotation: "false",
+		}))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = validator.ValidateCreate(ctx, newPod("plain", 0, nil))
+		Expect(err).NotTo(HaveOccurred())
+
+		namespace.Labels[controller.EnableAnnotation] = "false"
+		Expect(validator.Pods.Update(ctx, &namespace)).To(Succeed())
+		_, err = validator.ValidateCreate(ctx, newPod("ssh", 22, nil))
+		Expect(err).NotTo(HaveOccurred())
+
+		validator.Pods.PodSelector = labels.SelectorFromSet(labels.Set{"app": "ssh"})
+		pod := newPod("ssh", 22, nil)
+		pod.Labels = map[string]string{"app": "ssh"}
+		_, err = validator.ValidateCreate(ctx, pod)
+		Expect(err).To(MatchError(ContainSubstring("external port 22 is reserved")))
+	})
+
+	It("should reject reserved external ports", func() {
+		_, err := validator.ValidateCreate(ctx, newPod("ssh", 22, enabled))
+		Expect(err).To(MatchError(ContainSubstring("external port 22 is reserved")))
+
+		_, err = validator.ValidateCreate(ctx, newPod("mapped-ssh", 2222, map[string]string{
+			controller.EnableAnnotation:       "true",
+			controller.ExternalPortAnnotation: "2222:22",
+		}))
+		Expect(err).To(MatchError(ContainSubstring("external port 22 is reserved")))
+	})
+
+	It("should only consider the selected ports", func() {
+		newGameServer := func(name string, annotations map[string]string) *corev1.Pod {
+			pod := newPod(name, 25565, annotations)
+			pod.Spec.Containers[0].Ports[0].Name = "game"
+			pod.Spec.Containers[0].Ports = append(pod.Spec.Containers[0].Ports,
+				corev1.ContainerPort{Name: "rcon", ContainerPort: 25575, HostPort: 22, Protocol: corev1.ProtocolTCP})
+			return pod
+		}
+
+		_, err := validator.ValidateCreate(ctx, newGameServer("all", enabled))
+		Expect(err).To(MatchError(ContainSubstring("external port 22 is reserved")))
+		_, err = validator.ValidateCreate(ctx, newGameServer("game", map[string]string{
+			controller.EnableAnnotation: "true",
+			controller.PortsAnnotation:  "game",
+		}))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = validator.ValidateCreate(ctx, newGameServer("no-rcon", map[string]string{
+			controller.EnableAnnotation:       "true",
+			controller.ExcludePortsAnnotation: "22",
+		}))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = validator.ValidateCreate(ctx, newGameServer("typo", map[string]string{
+			controller.EnableAnnotation: "true",
+			controller.PortsAnnotation:  "gmae",
+		}))
+		Expect(err).To(MatchError(ContainSubstring(`no hostPort is named or numbered "gmae"`)))
+		_, err = validator.ValidateCreate(ctx, newGameServer("nothing", map[string]string{
+			controller.EnableAnnotation:       "true",
+			controller.ExcludePortsAnnotation: "game,rcon",
+		}))
+		Expect(err).To(MatchError(ContainSubstring("select none of the hostPorts")))
+	})
+
+	It("should consider the hostPorts of sidecars", func() {
+		always := corev1.ContainerRestartPolicyAlways
+		pod := newPod("sidecar", 0, enabled)
+		pod.Spec.InitContainers = []corev1.Container{{
+			Name:          "ssh",
+			RestartPolicy: &always,
+			Ports:         []corev1.ContainerPort{{ContainerPort: 22, HostPort: 22}},
+		}}
+		_, err := validator.ValidateCreate(ctx, pod)
+		Expect(err).To(MatchError(ContainSubstring("external port 22 is reserved")))
+
+		pod.Spec.InitContainers[0].RestartPolicy = nil
+		_, err = validator.ValidateCreate(ctx, pod)
+		Expect(err).To(MatchError(ContainSubstring("no hostPorts")))
+	})
+
+	It("should consider the container ports of pods on the host network", func() {
+		pod := newPod("host-network", 0, enabled)
+		pod.Spec.HostNetwork = true
+		pod.Spec.Containers[0].Ports[0].ContainerPort = 22
+		_, err := validator.ValidateCreate(ctx, pod)
+		Expect(err).To(MatchError(ContainSubstring("external port 22 is reserved")))
+
+		Expect(validator.Pods.Create(ctx, newPod("first", 8080, enabled))).To(Succeed())
+		pod.Spec.Containers[0].Ports[0].ContainerPort = 8080
+		warnings, err := validator.ValidateCreate(ctx, pod)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).To(ConsistOf(ContainSubstring("already claimed by pod default/first")))
+	})
+
+	It("should open pinholes to the global IPv6 address of pods", func() {
+		validator.Pods.Fwd.ManagePinholes = true
+		pod := newPod("dual-stack", 8080, enabled)
+		pod.Status.HostIPs = []corev1.HostIP{{IP: "10.0.0.1"}, {IP: "fd00::1"}, {IP: "2001:db8::1"}}
+		desired, err := validator.Pods.DesiredForwards(ctx, pod)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(desired.Forwards).To(ConsistOf(
+			forwarding.PortForward{Name: "k8s-default-dual-stack", Address: "10.0.0.1", Port: 8080, ExternalPort: 8080, Protocol: "tcp"},
+			forwarding.PortForward{Name: "k8s-default-dual-stack", Address: "2001:db8::1", Port: 8080, ExternalPort: 8080, Protocol: "tcp",
+				Family: forwarding.FamilyIPv6},
+		))
+
+		// Reserved ports are ports of the gateway, which pinholes do not use
+		pod = newPod("ipv6-only", 22, enabled)
+		pod.Status.HostIP = "2001:db8::2"
+		pod.Status.HostIPs = []corev1.HostIP{{IP: "2001:db8::2"}}
+		_, err = validator.ValidateCreate(ctx, pod)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should reject unknown gateways", func() {
+		_, err := validator.ValidateCreate(ctx, newPod("elsewhere", 8080, map[string]string{
+			controller.EnableAnnotation:  "true",
+			controller.GatewayAnnotation: "missing",
+		}))
+		Expect(err).To(MatchError(ContainSubstring(`unknown gateway "missing"`)))
+	})
+
+	It("should warn about external ports other pods claim", func() {
+		Expect(validator.Pods.Create(ctx, newPod("first", 8080, enabled))).To(Succeed())
+
+		warnings, err := validator.ValidateCreate(ctx, newPod("second", 8080, enabled))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).To(ConsistOf(ContainSubstring("already claimed by pod default/first")))
+
+		warnings, err = validator.ValidateCreate(ctx, newPod("third", 8081, enabled))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).To(BeEmpty())
+	})
+
+	It("should only validate updates that change the forwarding annotations", func() {
+		oldPod := newPod("admitted", 0, enabled)
+		pod := oldPod.DeepCopy()
+		pod.Annotations = map[string]string{
+			controller.EnableAnnotation:                "true",
+			controller.AssignedExternalPortsAnnotation: "80:30000",
+		}
+		_, err := validator.ValidateUpdate(ctx, oldPod, pod)
+		Expect(err).NotTo(HaveOccurred())
+
+		pod.Annotations[controller.ExternalPortAnnotation] = "auto"
+		_, err = validator.ValidateUpdate(ctx, oldPod, pod)
+		Expect(err).To(MatchError(ContainSubstring("no hostPorts")))
+	})
+
+	Context("with forwarding policies", func() {
+		newPolicy := func(name string, tier string, spec forwardingv1alpha1.ForwardingPolicySpec) {
+			spec.NamespaceSelector = metav1.LabelSelector{MatchLabels: map[string]string{"tier": tier}}
+			policy := &forwardingv1alpha1.ForwardingPolicy{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: spec}
+			Expect(validator.Pods.Create(ctx, policy)).To(Succeed())
+		}
+
+		It("should reject pods of namespaces no policy selects", func() {
+			newPolicy("web", "web", forwardingv1alpha1.ForwardingPolicySpec{})
+
+			_, err := validator.ValidateCreate(ctx, newPod("server", 8080, enabled))
+			Expect(err).To(MatchError("no forwarding policy selects namespace default"))
+		})
+
+		It("should admit pods any selecting policy allows", func() {
+			newPolicy("a-udp", "games", forwardingv1alpha1.ForwardingPolicySpec{
+				Protocols: []forwardingv1alpha1.Protocol{forwardingv1alpha1.ProtocolUDP},
+			})
+			newPolicy("b-range", "games", forwardingv1alpha1.ForwardingPolicySpec{
+				ExternalPorts: []string{"25565", "30000-30999"},
+			})
+
+			_, err := validator.ValidateCreate(ctx, newPod("minecraft", 25565, enabled))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = validator.ValidateCreate(ctx, newPod("web", 8080, enabled))
+			Expect(err).To(MatchError("policy a-udp: protocol tcp is not allowed; " +
+				"policy b-range: external port 8080 is not allowed"))
+		})
+
+		It("should require source ranges", func() {
+			newPolicy("restricted", "games", forwardingv1alpha1.ForwardingPolicySpec{RequireSourceRanges: true})
+
+			_, err := validator.ValidateCreate(ctx, newPod("open", 8080, enabled))
+			Expect(err).To(MatchError(ContainSubstring("must be restricted with " + controller.SourceRangesAnnotation)))
+
+			_, err = validator.ValidateCreate(ctx, newPod("office", 8080, map[string]string{
+				controller.EnableAnnotation:       "true",
+				controller.SourceRangesAnnotation: "203.0.113.0/24",
+			}))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should limit the forwards of a namespace", func() {
+			limit := int32(1)
+			newPolicy("limited", "games", forwardingv1alpha1.ForwardingPolicySpec{MaxForwardsPerNamespace: &limit})
+			Expect(validator.Pods.Create(ctx, newPod("first", 8080, enabled))).To(Succeed())
+
+			_, err := validator.ValidateCreate(ctx, newPod("second", 8081, enabled))
+			Expect(err).To(MatchError("policy limited: namespace default may only forward 1 ports"))
+		})
+
+		It("should not count pinholes against the limit of a namespace", func() {
+			validator.Pods.Fwd.ManagePinholes = true
+			limit := int32(1)
+			newPolicy("limited", "games", forwardingv1alpha1.ForwardingPolicySpec{MaxForwardsPerNamespace: &limit})
+			pod := newPod("dual-stack", 8080, enabled)
+			pod.Status.HostIPs = []corev1.HostIP{{IP: "10.0.0.1"}, {IP: "2001:db8::1"}}
+
+			_, err := validator.ValidateCreate(ctx, pod)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,93 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	forwardingv1alpha1 "atte.cloud/port-forward-controller/api/v1alpha1"
+	"atte.cloud/port-forward-controller/internal/forwarding"
+)
+
+// forwardingpolicylog is for logging in this package.
+var forwardingpolicylog = logf.Log.WithName("forwardingpolicy-resource")
+
+// SetupForwardingPolicyWebhookWithManager registers the webhook for ForwardingPolicy in the manager.
+func SetupForwardingPolicyWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).For(&forwardingv1alpha1.ForwardingPolicy{}).
+		WithValidator(&ForwardingPolicyCustomValidator{}).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/validate-forwarding-atte-cloud-v1alpha1-forwardingpolicy,mutating=false,failurePolicy=fail,sideEffects=None,groups=forwarding.atte.cloud,resources=forwardingpolicies,verbs=create;update,versions=v1alpha1,name=vforwardingpolicy-v1alpha1.kb.io,admissionReviewVersions=v1
+
+// ForwardingPolicyCustomValidator rejects policies the controller cannot evaluate.
+type ForwardingPolicyCustomValidator struct{}
+
+var _ webhook.CustomValidator = &ForwardingPolicyCustomValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type ForwardingPolicy.
+func (v *ForwardingPolicyCustomValidator) ValidateCreate(_ context.Context, obj runtime.Object) (admission.Warnings, error) {
+	policy, ok := obj.(*forwardingv1alpha1.ForwardingPolicy)
+	if !ok {
+		return nil, fmt.Errorf("expected a ForwardingPolicy object but got %T", obj)
+	}
+	forwardingpolicylog.Info("Validation for ForwardingPolicy upon creation", "name", policy.GetName())
+	return nil, validateForwardingPolicy(policy)
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type ForwardingPolicy.
+func (v *ForwardingPolicyCustomValidator) ValidateUpdate(_ context.Context, _, newObj runtime.Object) (admission.Warnings, error) {
+	policy, ok := newObj.(*forwardingv1alpha1.ForwardingPolicy)
+	if !ok {
+		return nil, fmt.Errorf("expected a ForwardingPolicy object for the newObj but got %T", newObj)
+	}
+	forwardingpolicylog.Info("Validation for ForwardingPolicy upon update", "name", policy.GetName())
+	return nil, validateForwardingPolicy(policy)
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type ForwardingPolicy.
+func (v *ForwardingPolicyCustomValidator) ValidateDelete(_ context.Context, _ runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func validateForwardingPolicy(policy *forwardingv1alpha1.ForwardingPolicy) error {
+	var errs field.ErrorList
+	spec := field.NewPath("spec")
+	if _, err := metav1.LabelSelectorAsSelector(&policy.Spec.NamespaceSelector); err != nil {
+		errs = append(errs, field.Invalid(spec.Child("namespaceSelector"), policy.Spec.NamespaceSelector, err.Error()))
+	}
+	for i, ports := range policy.Spec.ExternalPorts {
+		if _, err := forwarding.ParsePortRange(ports); err != nil || ports == "" {
+			errs = append(errs, field.Invalid(spec.Child("externalPorts").Index(i), ports, "must be a port or a range such as 30000-30999"))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(forwardingv1alpha1.GroupVersion.WithKind("ForwardingPolicy").GroupKind(), policy.Name, errs)
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	forwardingv1alpha1 "atte.cloud/port-forward-controller/api/v1alpha1"
+)
+
+var _ = Describe("ForwardingPolicy Webhook", func() {
+	var (
+		obj       *forwardingv1alpha1.ForwardingPolicy
+		validator ForwardingPolicyCustomValidator
+	)
+
+	BeforeEach(func() {
+		obj = &forwardingv1alpha1.ForwardingPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "games"},
+			Spec: forwardingv1alpha1.ForwardingPolicySpec{
+				NamespaceSelector: metav1.LabelSelector{MatchLabels: map[string]string{"tier": "games"}},
+				ExternalPorts:     []string{"25565", "30000-30999"},
+			},
+		}
+	})
+
+	It("should admit valid policies", func() {
+		Expect(validator.ValidateCreate(context.Background(), obj)).To(BeNil())
+	})
+
+	It("should reject invalid port ranges", func() {
+		obj.Spec.ExternalPorts = append(obj.Spec.ExternalPorts, "30999-30000", "")
+		_, err := validator.ValidateUpdate(context.Background(), obj, obj)
+		Expect(err).To(MatchError(And(
+			ContainSubstring("spec.externalPorts[2]"),
+			ContainSubstring("spec.externalPorts[3]"),
+		)))
+	})
+
+	It("should reject invalid namespace selectors", func() {
+		obj.Spec.NamespaceSelector.MatchExpressions = []metav1.LabelSelectorRequirement{{Key: "tier", Operator: "Near"}}
+		_, err := validator.ValidateCreate(context.Background(), obj)
+		Expect(err).To(MatchError(ContainSubstring("spec.namespaceSelector")))
+	})
+})
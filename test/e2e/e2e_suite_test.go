@@ -44,6 +44,9 @@ var (
 	// projectImage is the name of the image which will be build and loaded
 	// with the code source changes to be tested.
 	projectImage = "example.com/port-forward-controller:v0.0.1"
+
+	// emulatorImage is the image of the UniFi emulator the controller is tested against.
+	emulatorImage = "example.com/unifi-emulator:v0.0.1"
 )
 
 // TestE2E runs the end-to-end (e2e) test suite for the project. These tests execute in an isolated,
@@ -71,6 +74,15 @@ var _ = BeforeSuite(func() {
 	err = utils.LoadImageToKindClusterWithName(projectImage)
 	ExpectWithOffset(1, err).NotTo(HaveOccurred(), "Failed to load the manager(Operator) image into Kind")
 
+	By("building the UniFi emulator image")
+	cmd = exec.Command("make", "docker-build-emulator", fmt.Sprintf("EMULATOR_IMG=%s", emulatorImage))
+	_, err = utils.Run(cmd)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred(), "Failed to build the UniFi emulator image")
+
+	By("loading the UniFi emulator image on Kind")
+	err = utils.LoadImageToKindClusterWithName(emulatorImage)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred(), "Failed to load the UniFi emulator image into Kind")
+
 	// The tests-e2e are intended to run on a temporary cluster that is created and destroyed for testing.
 	// To prevent errors when tests run in environments with Prometheus or CertManager already installed,
 	// we check for their presence before execution.
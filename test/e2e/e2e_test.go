@@ -42,6 +42,12 @@ const metricsServiceName = "port-forward-controller-controller-manager-metrics-s
 // metricsRoleBindingName is the name of the RBAC that will be created to allow get the metrics data
 const metricsRoleBindingName = "port-forward-controller-metrics-binding"
 
+// controllerDeploymentName is the name of the deployment of the controller
+const controllerDeploymentName = "port-forward-controller-controller-manager"
+
+// forwardingNamespace holds the pods whose hostPorts are forwarded
+const forwardingNamespace = "forwarding-e2e"
+
 var _ = Describe("Manager", Ordered, func() {
 	var controllerPodName string
 
@@ -78,6 +84,11 @@ var _ = Describe("Manager", Ordered, func() {
 		cmd := exec.Command("kubectl", "delete", "pod", "curl-metrics", "-n", namespace)
 		_, _ = utils.Run(cmd)
 
+		// Before undeploying, so that the controller removes the finalizers of the pods
+		By("removing the namespace of the forwarded pods")
+		cmd = exec.Command("kubectl", "delete", "ns", forwardingNamespace, "--ignore-not-found", "--timeout=2m")
+		_, _ = utils.Run(cmd)
+
 		By("undeploying the controller-manager")
 		cmd = exec.Command("make", "undeploy")
 		_, _ = utils.Run(cmd)
@@ -123,6 +134,13 @@ var _ = Describe("Manager", Ordered, func() {
 				_, _ = fmt.Fprintf(GinkgoWriter, "Failed to get curl-metrics logs: %s", err)
 			}
 
+			By("Fetching UniFi emulator logs")
+			cmd = exec.Command("kubectl", "logs", "deployment/unifi-emulator", "-n", namespace)
+			emulatorLogs, err := utils.Run(cmd)
+			if err == nil {
+				_, _ = fmt.Fprintf(GinkgoWriter, "UniFi emulator logs:\n %s", emulatorLogs)
+			}
+
 			By("Fetching controller manager pod description")
 			cmd = exec.Command("kubectl", "describe", "pod", controllerPodName, "-n", namespace)
 			podDescription, err := utils.Run(cmd)
@@ -259,6 +277,68 @@ var _ = Describe("Manager", Ordered, func() {
 			Expect(metricsOutput).To(ContainSubstring(
 				"controller_runtime_reconcile_total",
 			))
+
+			By("checking that the forwarding metrics are exposed")
+			// Login failures are exported for every backend from the start, whether or not the
+			// controller could log in yet
+			Expect(metricsOutput).To(ContainSubstring(
+				`port_forward_controller_login_failures_total{backend="default"}`,
+			))
+		})
+
+		It("should forward the hostPorts of pods on the emulated gateway", func() {
+			By("deploying the UniFi emulator with the credentials of the controller")
+			cmd := exec.Command("kubectl", "create", "secret", "generic", "port-forward-controller-unifi",
+				"-n", namespace, "--from-literal=username=admin", "--from-literal=password=e2e-password")
+			_, err := utils.Run(cmd)
+			Expect(err).NotTo(HaveOccurred(), "Failed to create the credentials Secret")
+			cmd = exec.Command("kubectl", "apply", "-f", "test/e2e/testdata/unifi-emulator.yaml")
+			_, err = utils.Run(cmd)
+			Expect(err).NotTo(HaveOccurred(), "Failed to deploy the UniFi emulator")
+			cmd = exec.Command("kubectl", "rollout", "status", "deployment/unifi-emulator", "-n", namespace, "--timeout=2m")
+			_, err = utils.Run(cmd)
+			Expect(err).NotTo(HaveOccurred(), "UniFi emulator did not become ready")
+
+			By("pointing the controller at the emulator")
+			cmd = exec.Command("kubectl", "set", "env", "deployment/"+controllerDeploymentName, "-n", namespace,
+				fmt.Sprintf("UNIFI_BASEURL=http://unifi-emulator.%s.svc:8080", namespace))
+			_, err = utils.Run(cmd)
+			Expect(err).NotTo(HaveOccurred(), "Failed to configure the controller")
+			cmd = exec.Command("kubectl", "rollout", "status", "deployment/"+controllerDeploymentName, "-n", namespace,
+				"--timeout=2m")
+			_, err = utils.Run(cmd)
+			Expect(err).NotTo(HaveOccurred(), "Controller did not restart")
+
+			By("creating a pod that opts in to forwarding")
+			cmd = exec.Command("kubectl", "create", "ns", forwardingNamespace)
+			_, err = utils.Run(cmd)
+			Expect(err).NotTo(HaveOccurred(), "Failed to create the namespace of the pod")
+			cmd = exec.Command("kubectl", "apply", "-f", "test/e2e/testdata/forwarded-pod.yaml")
+			_, err = utils.Run(cmd)
+			Expect(err).NotTo(HaveOccurred(), "Failed to create the pod")
+
+			By("waiting for the forwards of the pod to be live")
+			verifyForwarded := func(g Gomega) {
+				cmd := exec.Command("kubectl", "get", "pod", "game-server", "-n", forwardingNamespace, "-o",
+					`jsonpath={.status.conditions[?(@.type=="port-forward-controller.atte.cloud/Forwarded")].status}`)
+				output, err := utils.Run(cmd)
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(output).To(Equal("True"), "Forwards of the pod are not live")
+			}
+			Eventually(verifyForwarded).Should(Succeed())
+			emulatorLogs := func() string {
+				cmd := exec.Command("kubectl", "logs", "deployment/unifi-emulator", "-n", namespace)
+				output, err := utils.Run(cmd)
+				Expect(err).NotTo(HaveOccurred())
+				return output
+			}
+			Expect(emulatorLogs()).To(ContainSubstring("POST /proxy/network/api/s/default/rest/portforward 200"))
+
+			By("removing the forwards once the pod is deleted")
+			cmd = exec.Command("kubectl", "delete", "pod", "game-server", "-n", forwardingNamespace)
+			_, err = utils.Run(cmd)
+			Expect(err).NotTo(HaveOccurred(), "Failed to delete the pod")
+			Expect(emulatorLogs()).To(MatchRegexp(`DELETE /proxy/network/api/s/default/rest/portforward/\w+ 200`))
 		})
 
 		// +kubebuilder:scaffold:e2e-webhooks-checks